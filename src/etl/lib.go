@@ -9,7 +9,7 @@ import (
 
 func HandleQuitSignal() {
 	//signal handling, for elegant quit
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGQUIT)
 	s := <-ch
 	log.Println("etl get signal:", s)
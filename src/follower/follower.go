@@ -0,0 +1,313 @@
+/*
+  进程内的文件跟踪器，用于替代tail -F
+  按文件名跟踪，记录inode和已读完整行的字节偏移，
+  文件被改名或替换时读完旧文件再切换，文件被截断时从头开始
+  也可以读一个不会再写入的流（如解压后的归档），偏移为解压后的字节偏移
+*/
+
+package follower
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"loglib"
+)
+
+var ErrStopped = errors.New("follower stopped")
+
+//文件被改名后，旧文件在这么长时间内没有新数据才切换到新文件
+var DrainIdle = 5 * time.Second
+
+//旧文件一直有数据时，最多读这么久
+var DrainMax = time.Minute
+
+type Follower struct {
+	path     string
+	file     *os.File
+	rd       *bufio.Reader
+	dev      uint64
+	ino      uint64
+	offset   int64     //已读完整行的末尾偏移
+	partial  []byte    //已读到但还没有换行符的半行
+	renamed  time.Time //发现文件被改名或替换的时间
+	lastRead time.Time
+	opened   bool //打开过文件
+	w        watcher
+	stop     <-chan bool
+	src      io.ReadCloser //不为nil时读的是流，不跟踪文件
+	head     []byte        //流的头部，用于计算指纹
+	err      error         //读流出错（如归档损坏、解压命令失败），流没有读完
+}
+
+//offset为开始读取的字节偏移，小于0表示从文件末尾开始
+//stop被关闭时Wait立即返回ErrStopped
+func New(path string, offset int64, stop <-chan bool) *Follower {
+	f := &Follower{path: path, offset: offset, stop: stop}
+	w, err := newWatcher(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		loglib.Warning("init file watcher for " + path + " error: " + err.Error() + ", use polling")
+		w = newPollWatcher()
+	}
+	f.w = w
+	return f
+}
+
+//读一个已经结束的流，path为对应的日志文件名，先跳过offset字节
+func NewReader(path string, src io.ReadCloser, offset int64, headSize int) *Follower {
+	f := &Follower{path: path, src: src, offset: 0, opened: true}
+	f.rd = bufio.NewReaderSize(src, 64*1024)
+	head, _ := f.rd.Peek(headSize)
+	f.head = append([]byte{}, head...)
+	if offset > 0 {
+		n, err := f.rd.Discard(int(offset))
+		if err != nil {
+			loglib.Warning(fmt.Sprintf("%s is shorter than the offset %d, skipped %d", path, offset, n))
+		}
+		f.offset = int64(n)
+	}
+	return f
+}
+
+func (f *Follower) Path() string {
+	return f.path
+}
+
+//已读完整行的末尾偏移
+func (f *Follower) Offset() int64 {
+	if f.offset < 0 {
+		return 0
+	}
+	return f.offset
+}
+
+//打开过文件，之后文件被删除也算，读的是流时为true
+func (f *Follower) Opened() bool {
+	return f.opened
+}
+
+//当前打开文件的设备号和inode，文件未打开时为0
+func (f *Follower) Inode() (dev uint64, ino uint64) {
+	if f.file == nil {
+		return 0, 0
+	}
+	return f.dev, f.ino
+}
+
+//打开文件，文件不存在则返回false，等待下次重试
+func (f *Follower) open() bool {
+	fin, err := os.Open(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			//文件还没创建，创建后从头读
+			if f.offset < 0 {
+				f.offset = 0
+			}
+		} else {
+			loglib.Error("follower open " + f.path + " error: " + err.Error())
+		}
+		return false
+	}
+	fi, err := fin.Stat()
+	if err != nil {
+		loglib.Error("follower stat " + f.path + " error: " + err.Error())
+		fin.Close()
+		return false
+	}
+	if f.offset < 0 || f.offset > fi.Size() {
+		if f.offset > fi.Size() {
+			loglib.Warning(f.path + " is shorter than the offset, maybe truncated, read from the beginning")
+			f.offset = 0
+		} else {
+			f.offset = fi.Size()
+		}
+	}
+	if _, err = fin.Seek(f.offset, io.SeekStart); err != nil {
+		loglib.Error("follower seek " + f.path + " error: " + err.Error())
+		fin.Close()
+		return false
+	}
+	f.file = fin
+	f.opened = true
+	f.dev, f.ino = inodeOf(fi)
+	f.rd = bufio.NewReaderSize(fin, 64*1024)
+	f.partial = f.partial[:0]
+	return true
+}
+
+//读取一个完整行（含换行符），当前没有完整行时返回io.EOF
+func (f *Follower) ReadLine() (string, error) {
+	if f.src != nil {
+		return f.readStream()
+	}
+	if f.file == nil && !f.open() {
+		return "", io.EOF
+	}
+	line, err := f.rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		//超长行，先攒起来
+		f.partial = append(f.partial, line...)
+		return f.ReadLine()
+	}
+	if err == nil {
+		var s string
+		if len(f.partial) > 0 {
+			s = string(append(f.partial, line...))
+			f.partial = f.partial[:0]
+		} else {
+			s = string(line)
+		}
+		f.offset += int64(len(s))
+		f.lastRead = time.Now()
+		return s, nil
+	}
+	if len(line) > 0 {
+		f.lastRead = time.Now()
+	}
+	f.partial = append(f.partial, line...)
+	if err != io.EOF {
+		loglib.Error("follower read " + f.path + " error: " + err.Error())
+	}
+	if s, ok := f.checkFile(); ok {
+		return s, nil
+	}
+	return "", io.EOF
+}
+
+func (f *Follower) readStream() (string, error) {
+	line, err := f.rd.ReadString('\n')
+	if err == nil {
+		f.offset += int64(len(line))
+		return line, nil
+	}
+	f.partial = append(f.partial, line...)
+	if err != io.EOF && f.err == nil {
+		f.err = err
+		loglib.Error("follower read " + f.path + " error: " + err.Error())
+	}
+	return "", io.EOF
+}
+
+//读流时出的错，为nil表示流已正常读完（或还没读完）
+func (f *Follower) Err() error {
+	return f.err
+}
+
+//读到文件末尾时检查文件是否被截断或替换
+//文件被改名时，写日志的进程可能还没有重新打开文件，旧文件空闲一段时间后再切换，
+//切换时若有半行则作为最后一行返回
+func (f *Follower) checkFile() (string, bool) {
+	fi, err := f.file.Stat()
+	if err == nil && fi.Size() < f.offset+int64(len(f.partial)) {
+		loglib.Warning(f.path + " truncated, read from the beginning")
+		f.file.Seek(0, io.SeekStart)
+		f.rd.Reset(f.file)
+		f.offset = 0
+		f.partial = f.partial[:0]
+		return "", false
+	}
+	fi, err = os.Stat(f.path)
+	if err != nil {
+		return "", false
+	}
+	if dev, ino := inodeOf(fi); dev != f.dev || ino != f.ino {
+		now := time.Now()
+		if f.renamed.IsZero() {
+			f.renamed = now
+			loglib.Info(fmt.Sprintf("%s renamed or replaced, inode %d -> %d, finish the old file first", f.path, f.ino, ino))
+			return "", false
+		}
+		if now.Sub(f.renamed) < DrainMax && (now.Sub(f.renamed) < DrainIdle || now.Sub(f.lastRead) < DrainIdle) {
+			return "", false
+		}
+		loglib.Info(fmt.Sprintf("finish old %s at offset %d, reopen it", f.path, f.offset))
+		s, ok := f.Flush()
+		f.closeFile()
+		f.offset = 0
+		f.renamed = time.Time{}
+		return s, ok
+	}
+	return "", false
+}
+
+//旧文件是否在等待切换
+func (f *Follower) Draining() bool {
+	return !f.renamed.IsZero()
+}
+
+//当前打开文件的头部n字节，用于计算指纹
+func (f *Follower) Head(n int) []byte {
+	if f.src != nil {
+		if n < len(f.head) {
+			return f.head[:n]
+		}
+		return f.head
+	}
+	if f.file == nil {
+		return nil
+	}
+	buf := make([]byte, n)
+	m, _ := f.file.ReadAt(buf, 0)
+	return buf[:m]
+}
+
+//返回末尾不带换行符的半行，用于文件确定不会再写入时收尾
+func (f *Follower) Flush() (string, bool) {
+	//流出错时末尾的半行不完整
+	if len(f.partial) == 0 || f.err != nil {
+		return "", false
+	}
+	s := string(f.partial) + "\n"
+	f.offset += int64(len(f.partial))
+	f.partial = f.partial[:0]
+	return s, true
+}
+
+//等待文件或所在目录发生变化，最多等待d
+func (f *Follower) Wait(d time.Duration) error {
+	select {
+	case <-f.stop:
+		return ErrStopped
+	default:
+	}
+	if f.w == nil {
+		//流不会再有新数据
+		return nil
+	}
+	//旧文件的写入不一定能收到通知，定时检查
+	if f.Draining() && d > time.Second {
+		d = time.Second
+	}
+	return f.w.wait(d, f.stop)
+}
+
+func (f *Follower) closeFile() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+		f.rd = nil
+	}
+}
+
+func (f *Follower) Close() {
+	f.closeFile()
+	if f.src != nil {
+		f.src.Close()
+	}
+	if f.w != nil {
+		f.w.close()
+	}
+}
+
+func inodeOf(fi os.FileInfo) (dev uint64, ino uint64) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), uint64(st.Ino)
+	}
+	return 0, 0
+}
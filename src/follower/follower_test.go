@@ -0,0 +1,193 @@
+package follower
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"loglib"
+)
+
+func TestMain(m *testing.M) {
+	loglib.Init(map[string]string{})
+	DrainIdle = 100 * time.Millisecond
+	DrainMax = time.Second
+	os.Exit(m.Run())
+}
+
+func appendFile(t *testing.T, path string, s string) {
+	fout, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fout.Close()
+	if _, err := fout.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//一段时间内读到的行
+func readFor(f *Follower, d time.Duration) []string {
+	lines := make([]string, 0)
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		line, err := f.ReadLine()
+		if err == io.EOF {
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestFollower(t *testing.T) {
+	type step struct {
+		do   func(t *testing.T, path string)
+		want []string
+	}
+	write := func(s string) func(t *testing.T, path string) {
+		return func(t *testing.T, path string) { appendFile(t, path, s) }
+	}
+	nop := func(t *testing.T, path string) {}
+	tests := []struct {
+		name    string
+		content string //创建Follower前文件的内容
+		offset  int64
+		steps   []step
+	}{
+		{"from beginning", "", 0, []step{
+			{write("a\nb\n"), []string{"a\n", "b\n"}},
+			{write("par"), []string{}},
+			{write("tial\n"), []string{"partial\n"}},
+		}},
+		{"from end", "skipped\n", -1, []step{
+			{nop, []string{}},
+			{write("new\n"), []string{"new\n"}},
+		}},
+		{"from offset", "a\nb\n", 2, []step{
+			{nop, []string{"b\n"}},
+		}},
+		{"created later", "", -1, []step{
+			{func(t *testing.T, path string) { os.Remove(path) }, []string{}},
+			{write("new\n"), []string{"new\n"}},
+		}},
+		{"truncated", "", 0, []step{
+			{write("aaaa\nbbbb\n"), []string{"aaaa\n", "bbbb\n"}},
+			{func(t *testing.T, path string) {
+				if err := os.Truncate(path, 0); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, path, "c\n")
+			}, []string{"c\n"}},
+		}},
+		{"offset beyond size", "a\n", 100, []step{
+			{nop, []string{"a\n"}},
+		}},
+		//改名后旧文件继续写入的行和末尾的半行都读完，再切换到新文件
+		{"renamed", "", 0, []step{
+			{write("a\n"), []string{"a\n"}},
+			{func(t *testing.T, path string) {
+				if err := os.Rename(path, path+".1"); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, path+".1", "b\nhalf")
+				appendFile(t, path, "c\n")
+			}, []string{"b\n", "half\n", "c\n"}},
+			{write("d\n"), []string{"d\n"}},
+		}},
+		{"replaced", "", 0, []step{
+			{write("a\n"), []string{"a\n"}},
+			{func(t *testing.T, path string) {
+				tmp := path + ".tmp"
+				appendFile(t, tmp, "x\ny\n")
+				if err := os.Rename(tmp, path); err != nil {
+					t.Fatal(err)
+				}
+			}, []string{"x\n", "y\n"}},
+		}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "app.log")
+		appendFile(t, path, tt.content)
+		stop := make(chan bool)
+		f := New(path, tt.offset, stop)
+		for i, s := range tt.steps {
+			s.do(t, path)
+			got := readFor(f, 500*time.Millisecond)
+			if !reflect.DeepEqual(got, s.want) {
+				t.Errorf("%s: step %d got %q, want %q", tt.name, i, got, s.want)
+			}
+		}
+		close(stop)
+		if err := f.Wait(time.Second); err != ErrStopped {
+			t.Errorf("%s: Wait after stop got %v", tt.name, err)
+		}
+		f.Close()
+	}
+}
+
+//读到一半出错的流
+type brokenReader struct {
+	rd io.Reader
+}
+
+func (this *brokenReader) Read(p []byte) (int, error) {
+	n, err := this.rd.Read(p)
+	if err == io.EOF {
+		return n, errors.New("broken")
+	}
+	return n, err
+}
+
+func (this *brokenReader) Close() error {
+	return nil
+}
+
+func TestFollowerReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    io.ReadCloser
+		offset int64
+		want   []string
+		last   string //Flush得到的最后半行
+		err    bool
+	}{
+		{"whole", ioutil.NopCloser(bytes.NewBufferString("a\nb\nc")), 0, []string{"a\n", "b\n"}, "c\n", false},
+		{"offset", ioutil.NopCloser(bytes.NewBufferString("a\nb\n")), 2, []string{"b\n"}, "", false},
+		{"offset beyond end", ioutil.NopCloser(bytes.NewBufferString("a\n")), 10, []string{}, "", false},
+		{"broken", &brokenReader{bytes.NewBufferString("a\nhalf")}, 0, []string{"a\n"}, "", true},
+	}
+	for _, tt := range tests {
+		f := NewReader("app.log", tt.src, tt.offset, 4)
+		lines := make([]string, 0)
+		for {
+			line, err := f.ReadLine()
+			if err != nil {
+				break
+			}
+			lines = append(lines, line)
+		}
+		if !reflect.DeepEqual(lines, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, lines, tt.want)
+		}
+		last, _ := f.Flush()
+		if last != tt.last {
+			t.Errorf("%s: flush %q, want %q", tt.name, last, tt.last)
+		}
+		if (f.Err() != nil) != tt.err {
+			t.Errorf("%s: Err %v", tt.name, f.Err())
+		}
+		if err := f.Wait(time.Second); err != nil {
+			t.Errorf("%s: Wait on stream got %v", tt.name, err)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,36 @@
+package follower
+
+import (
+	"time"
+)
+
+//文件变化的等待方式，linux下用inotify，其他系统轮询
+type watcher interface {
+	//有变化、超时或stop关闭时返回
+	wait(d time.Duration, stop <-chan bool) error
+	close()
+}
+
+var pollInterval = 500 * time.Millisecond
+
+type pollWatcher struct {
+}
+
+func newPollWatcher() *pollWatcher {
+	return &pollWatcher{}
+}
+
+func (w *pollWatcher) wait(d time.Duration, stop <-chan bool) error {
+	if d > pollInterval {
+		d = pollInterval
+	}
+	select {
+	case <-stop:
+		return ErrStopped
+	case <-time.After(d):
+	}
+	return nil
+}
+
+func (w *pollWatcher) close() {
+}
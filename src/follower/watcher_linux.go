@@ -0,0 +1,81 @@
+//go:build linux
+
+package follower
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//监听文件所在目录，目录下文件的写入、创建、改名都能收到通知
+type inotifyWatcher struct {
+	fd     *os.File
+	name   string
+	events chan bool
+}
+
+func newWatcher(dir string, name string) (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	var mask uint32 = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CREATE | syscall.IN_DELETE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	if _, err = syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	w := &inotifyWatcher{fd: os.NewFile(uintptr(fd), "inotify"), name: name, events: make(chan bool, 1)}
+	go w.readEvents()
+	return w, nil
+}
+
+func (w *inotifyWatcher) readEvents() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.fd.Read(buf)
+		if err != nil {
+			//fd已关闭
+			close(w.events)
+			return
+		}
+		notify := false
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			//自己的文件有变化，或者有新文件出现（可能是下一个时段的日志）
+			if name == w.name || ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO|syscall.IN_Q_OVERFLOW|syscall.IN_IGNORED) != 0 {
+				notify = true
+			}
+		}
+		if notify {
+			select {
+			case w.events <- true:
+			default:
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) wait(d time.Duration, stop <-chan bool) error {
+	select {
+	case <-stop:
+		return ErrStopped
+	case _, ok := <-w.events:
+		if !ok {
+			//inotify不可用了，退化为轮询
+			return newPollWatcher().wait(d, stop)
+		}
+	case <-time.After(d):
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) close() {
+	w.fd.Close()
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package follower
+
+func newWatcher(dir string, name string) (watcher, error) {
+	return newPollWatcher(), nil
+}
@@ -15,11 +15,56 @@ import (
 )
 
 //日志完整性检查类
+//hour为日志切割周期的key，按小时切割时是小时，也可以是分钟或天
 type IntegrityChecker struct {
 	dir          string
 	statusFile   string
-	hourReceived map[string]map[string]map[string]int // [ip][hour][id] = 1
-	dayReceived  map[string]map[string]map[string]int // [ip][day][hour] = 1
+	hourReceived map[string]map[string]*hourStatus // [ip][hour]
+	dayReceived  map[string]map[string]*dayStatus  // [ip][day]
+	expected     map[string]map[int]bool           // [source][hour] = true，一天中应该有日志的小时
+}
+
+//一个周期收到的包
+type hourStatus struct {
+	Ids     map[int]bool `json:"ids"` //收到的包的id
+	Lines   int          `json:"lines"`
+	Dropped int          `json:"dropped,omitempty"`
+	Packs   int          `json:"packs"`             //done包的id，即包的总数，0表示还没收到done包
+	Period  int          `json:"period"`            //周期长度（秒）
+	Missing bool         `json:"missing,omitempty"` //发送端没有这个周期的日志文件
+}
+
+//一天中接收完的周期
+type dayStatus struct {
+	Hours  map[string]bool `json:"hours"`
+	Period int             `json:"period"`
+}
+
+//状态文件，老的格式没有version，每个周期是一个map[string]int，id和total_lines等放在一起
+type checkerStatus struct {
+	Version      int                               `json:"version"`
+	HourReceived map[string]map[string]*hourStatus `json:"hour_received"`
+	DayReceived  map[string]map[string]*dayStatus  `json:"day_received"`
+}
+
+const statusVersion = 2
+
+var expectedHoursKey = "expected_hours"
+
+var periodKey = "period" //老的状态文件中周期长度（秒）的key，和id、hour放在一起
+
+//包头中没有周期时按key的格式推断
+func periodSeconds(hour string, period int) int {
+	if period > 0 {
+		return period
+	}
+	switch len(hour) {
+	case 8:
+		return 86400
+	case 12:
+		return 60
+	}
+	return 3600
 }
 
 func NewIntegrityChecker(dir string) *IntegrityChecker {
@@ -33,9 +78,7 @@ func NewIntegrityChecker(dir string) *IntegrityChecker {
 	ic.dir = dir
 	ic.statusFile = statusFile
 
-	status := ic.LoadStatus(ic.statusFile)
-	ic.hourReceived = status["hour_received"]
-	ic.dayReceived = status["day_received"]
+	ic.hourReceived, ic.dayReceived = ic.LoadStatus(ic.statusFile)
 	return ic
 }
 
@@ -47,18 +90,20 @@ func getFilePath() string {
 	return d + "/log_received.json"
 }
 
-func (this *IntegrityChecker) LoadStatus(filename string) map[string]map[string]map[string]map[string]int {
-	m := make(map[string]map[string]map[string]map[string]int)
-	m["hour_received"] = make(map[string]map[string]map[string]int)
-	m["day_received"] = make(map[string]map[string]map[string]int)
+func (this *IntegrityChecker) LoadStatus(filename string) (map[string]map[string]*hourStatus, map[string]map[string]*dayStatus) {
+	st := checkerStatus{}
 	if lib.FileExists(filename) {
 		vbytes, err := ioutil.ReadFile(filename)
 		if err != nil {
 			loglib.Error("read log received file error:" + err.Error())
 		} else {
-			err = json.Unmarshal(vbytes, &m)
+			err = json.Unmarshal(vbytes, &st)
+			if err == nil && st.Version < statusVersion {
+				st, err = oldStatus(vbytes)
+			}
 			if err != nil {
 				loglib.Error("unmarshal log received error:" + err.Error())
+				st = checkerStatus{}
 			} else {
 				loglib.Info("load log received success !")
 			}
@@ -66,14 +111,65 @@ func (this *IntegrityChecker) LoadStatus(filename string) map[string]map[string]
 	} else {
 		loglib.Warning("log received file " + filename + " not found!")
 	}
-	return m
+	if st.HourReceived == nil {
+		st.HourReceived = make(map[string]map[string]*hourStatus)
+	}
+	if st.DayReceived == nil {
+		st.DayReceived = make(map[string]map[string]*dayStatus)
+	}
+	return st.HourReceived, st.DayReceived
 }
 
-func (this *IntegrityChecker) SaveStatus() {
+//转换老格式的状态文件：[ip][hour]中除了total_lines、total_packs、total_dropped、period都是id，[ip][day]中除了period都是周期
+func oldStatus(vbytes []byte) (checkerStatus, error) {
+	st := checkerStatus{Version: statusVersion, HourReceived: make(map[string]map[string]*hourStatus), DayReceived: make(map[string]map[string]*dayStatus)}
 	m := make(map[string]map[string]map[string]map[string]int)
-	m["hour_received"] = this.hourReceived
-	m["day_received"] = this.dayReceived
-	vbytes, err := json.Marshal(m)
+	if err := json.Unmarshal(vbytes, &m); err != nil {
+		return st, err
+	}
+	for ip, hours := range m["hour_received"] {
+		st.HourReceived[ip] = make(map[string]*hourStatus)
+		for hour, m2 := range hours {
+			hs := &hourStatus{Ids: make(map[int]bool)}
+			for k, v := range m2 {
+				switch k {
+				case "total_lines":
+					hs.Lines = v
+				case "total_packs":
+					hs.Packs = v
+				case "total_dropped":
+					hs.Dropped = v
+				case periodKey:
+					hs.Period = v
+				default:
+					if id, err := strconv.Atoi(k); err == nil {
+						hs.Ids[id] = true
+					}
+				}
+			}
+			hs.Period = periodSeconds(hour, hs.Period)
+			st.HourReceived[ip][hour] = hs
+		}
+	}
+	for ip, days := range m["day_received"] {
+		st.DayReceived[ip] = make(map[string]*dayStatus)
+		for day, m2 := range days {
+			ds := &dayStatus{Hours: make(map[string]bool), Period: 3600} //更老的状态文件里没有周期
+			for k, v := range m2 {
+				if k == periodKey {
+					ds.Period = v
+				} else {
+					ds.Hours[k] = true
+				}
+			}
+			st.DayReceived[ip][day] = ds
+		}
+	}
+	return st, nil
+}
+
+func (this *IntegrityChecker) SaveStatus() {
+	vbytes, err := json.Marshal(checkerStatus{Version: statusVersion, HourReceived: this.hourReceived, DayReceived: this.dayReceived})
 	if err != nil {
 		loglib.Error("marshal log received error:" + err.Error())
 		return
@@ -86,36 +182,49 @@ func (this *IntegrityChecker) SaveStatus() {
 	}
 }
 
-func (this *IntegrityChecker) Add(ip string, hour string, packId string, lines int, isDone bool) {
+//lines为包中的行数，dropped为发送端有意丢弃（过滤、抽样）的行数，missing表示发送端没有这个周期的日志文件（done包）
+//period为周期的秒数，0表示由hour的格式推断
+func (this *IntegrityChecker) Add(ip string, hour string, packId string, lines int, dropped int, isDone bool, missing bool, period int) {
+	id, err := strconv.Atoi(packId)
+	if err != nil || id <= 0 {
+		loglib.Warning(fmt.Sprintf("%s_%s wrong pack id %q", ip, hour, packId))
+		return
+	}
 	_, ok := this.hourReceived[ip]
 	if !ok {
-		this.hourReceived[ip] = make(map[string]map[string]int)
+		this.hourReceived[ip] = make(map[string]*hourStatus)
 	}
-	_, ok = this.hourReceived[ip][hour]
+	hs, ok := this.hourReceived[ip][hour]
 	if !ok {
-		this.hourReceived[ip][hour] = map[string]int{"total_lines": 0, "total_packs": 0}
+		hs = &hourStatus{Ids: make(map[int]bool), Period: periodSeconds(hour, period)}
+		this.hourReceived[ip][hour] = hs
+	}
+	hs.Ids[id] = true
+	hs.Lines += lines
+	if dropped > 0 {
+		hs.Dropped += dropped
 	}
-	this.hourReceived[ip][hour][packId] = 1
-	this.hourReceived[ip][hour]["total_lines"] += lines
 	if isDone {
-		id, _ := strconv.Atoi(packId)
-		this.hourReceived[ip][hour]["total_packs"] = id
+		hs.Packs = id
+		hs.Missing = missing
 		//this.Check()   //改为手动调用
 	}
 }
 
-func (this *IntegrityChecker) addHour(ip string, hour string) bool {
-	if len(hour) > 8 {
+func (this *IntegrityChecker) addHour(ip string, hour string, period int) bool {
+	if len(hour) >= 8 {
 		day := hour[0:8]
 		_, ok := this.dayReceived[ip]
 		if !ok {
-			this.dayReceived[ip] = make(map[string]map[string]int)
+			this.dayReceived[ip] = make(map[string]*dayStatus)
 		}
-		_, ok = this.dayReceived[ip][day]
+		ds, ok := this.dayReceived[ip][day]
 		if !ok {
-			this.dayReceived[ip][day] = make(map[string]int)
+			ds = &dayStatus{Hours: make(map[string]bool)}
+			this.dayReceived[ip][day] = ds
 		}
-		this.dayReceived[ip][day][hour] = 1
+		ds.Hours[hour] = true
+		ds.Period = period
 		return true
 	}
 	return false
@@ -129,21 +238,18 @@ func (this *IntegrityChecker) Check() (hourFinish map[string][]string, dayFinish
 	now := time.Now().Unix()
 	//检查每小时是否完整
 	for ip, m1 := range this.hourReceived {
-		for hour, m2 := range m1 {
-			totalPacks, ok := m2["total_packs"]
-			if ok && totalPacks > 0 {
+		for hour, hs := range m1 {
+			totalPacks := hs.Packs
+			if totalPacks > 0 {
 				miss := make([]string, 0)
-				var id = ""
 				//这小时已接收到最后一个包，可以check了
 				for i := 1; i <= totalPacks; i++ {
-					id = strconv.Itoa(i)
-					_, ok = m2[id]
-					if !ok {
-						miss = append(miss, id)
+					if !hs.Ids[i] {
+						miss = append(miss, strconv.Itoa(i))
 					}
 				}
 				//if条件顺序不要错
-				if len(miss) == 0 && this.makeHourTag(ip, hour, m2["total_lines"]) && this.addHour(ip, hour) {
+				if len(miss) == 0 && this.makeHourTag(ip, hour, hs) && this.addHour(ip, hour, periodSeconds(hour, hs.Period)) {
 					_, ok1 := hourFinish[ip]
 					if !ok1 {
 						hourFinish[ip] = make([]string, 0)
@@ -159,7 +265,7 @@ func (this *IntegrityChecker) Check() (hourFinish map[string][]string, dayFinish
 				}
 			}
 
-			tm, err := time.Parse("2006010215", hour)
+			tm, err := lib.ParsePeriodKey(hour)
 			if err != nil || (now-tm.Unix()) > interval {
 				delete(this.hourReceived[ip], hour)
 				loglib.Info(fmt.Sprintf("hour integrity: %s %s overtime", ip, hour))
@@ -167,10 +273,10 @@ func (this *IntegrityChecker) Check() (hourFinish map[string][]string, dayFinish
 		}
 	}
 
-	//检查每天是否完整
+	//检查每天是否完整，一天的周期数由周期长度决定
 	for ip, m1 := range this.dayReceived {
-		for day, m2 := range m1 {
-			if len(m2) == 24 && this.makeDayTag(ip, day) {
+		for day, ds := range m1 {
+			if this.dayComplete(ip, day, ds) && this.makeDayTag(ip, day) {
 				loglib.Info(ip + "_" + day + " all received")
 
 				_, ok1 := dayFinish[ip]
@@ -195,8 +301,102 @@ func (this *IntegrityChecker) Check() (hourFinish map[string][]string, dayFinish
 	return
 }
 
+//一天的周期是否都已接收完，没有配置expected_hours时按周期数判断
+func (this *IntegrityChecker) dayComplete(ip string, day string, ds *dayStatus) bool {
+	period := ds.Period
+	if period <= 0 {
+		period = 3600
+	}
+	hours := this.expectedHours(ip)
+	if hours == nil {
+		return len(ds.Hours) >= 86400/period
+	}
+	start, err := time.ParseInLocation("20060102", day, time.Local)
+	if err != nil {
+		return false
+	}
+	p := lib.Period{Duration: time.Duration(period) * time.Second}
+	for t := start; t.Day() == start.Day(); t = p.Next(t) {
+		if !ds.Hours[p.Key(t)] && hours[t.Hour()] {
+			return false
+		}
+	}
+	return true
+}
+
+//配置一天中哪些小时应该有日志，没有日志的源（如夜里不产生日志的服务）不用等这些小时就能标记一天完成
+//expected_hours为默认值，expected_hours.源名字为某个源的，格式如 8-20,22，不配置表示全部24小时
+func (this *IntegrityChecker) SetExpectedHours(config map[string]string) {
+	this.expected = make(map[string]map[int]bool)
+	for k, v := range config {
+		source := ""
+		if k != expectedHoursKey {
+			if !strings.HasPrefix(k, expectedHoursKey+".") {
+				continue
+			}
+			source = k[len(expectedHoursKey)+1:]
+		}
+		hours, err := parseHours(v)
+		if err != nil {
+			loglib.Error("wrong " + k + " " + v + ": " + err.Error())
+			continue
+		}
+		this.expected[source] = hours
+		loglib.Info(fmt.Sprintf("integrity expected hours of source [%s]: %s", source, v))
+	}
+}
+
+//key为ip或ip_源名字，glob匹配出的源（如access.app1）没有配置时使用access的配置
+func (this *IntegrityChecker) expectedHours(key string) map[int]bool {
+	if len(this.expected) == 0 {
+		return nil
+	}
+	source := ""
+	if i := strings.Index(key, "_"); i >= 0 {
+		source = key[i+1:]
+	}
+	for source != "" {
+		if hours, ok := this.expected[source]; ok {
+			return hours
+		}
+		i := strings.LastIndex(source, ".")
+		if i < 0 {
+			break
+		}
+		source = source[:i]
+	}
+	return this.expected[""]
+}
+
+//解析 8-20,22 这样的小时列表
+func parseHours(s string) (map[int]bool, error) {
+	hours := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if i := strings.Index(part, "-"); i > 0 {
+			from, to = part[:i], part[i+1:]
+		}
+		a, err1 := strconv.Atoi(strings.TrimSpace(from))
+		b, err2 := strconv.Atoi(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil || a < 0 || b > 23 || a > b {
+			return nil, fmt.Errorf("wrong hours %s", part)
+		}
+		for h := a; h <= b; h++ {
+			hours[h] = true
+		}
+	}
+	return hours, nil
+}
+
 //touch一个文件表明某一小时接收完
-func (this *IntegrityChecker) makeHourTag(ip string, hour string, lines int) bool {
+//发送端有丢弃的行时，文件内容为丢弃的行数，收到的行数加丢弃的行数即为tail的行数
+//发送端没有这个周期的日志文件时，文件内容为missing，和文件存在但是没有日志区分开
+func (this *IntegrityChecker) makeHourTag(ip string, hour string, hs *hourStatus) bool {
+	lines, dropped := hs.Lines, hs.Dropped
 	fname := fmt.Sprintf("%s_%s_%d", ip, hour, lines)
 	filename := filepath.Join(this.dir, fname)
 	fout, err := os.Create(filename)
@@ -204,6 +404,14 @@ func (this *IntegrityChecker) makeHourTag(ip string, hour string, lines int) boo
 		loglib.Error("tag " + fname + " error: " + err.Error())
 		return false
 	} else {
+		if dropped > 0 {
+			fmt.Fprintf(fout, "dropped %d\n", dropped)
+			loglib.Info(fmt.Sprintf("%s_%s received %d lines, dropped %d lines by filter", ip, hour, lines, dropped))
+		}
+		if hs.Missing {
+			fmt.Fprintln(fout, "missing")
+			loglib.Info(fmt.Sprintf("%s_%s has no log file", ip, hour))
+		}
 		fout.Close()
 	}
 	return true
@@ -0,0 +1,182 @@
+package integrity
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"loglib"
+)
+
+func TestMain(m *testing.M) {
+	loglib.Init(map[string]string{})
+	os.Exit(m.Run())
+}
+
+func newTestChecker(t *testing.T) *IntegrityChecker {
+	dir := t.TempDir()
+	ic := &IntegrityChecker{dir: dir, statusFile: filepath.Join(dir, "status.json")}
+	ic.hourReceived, ic.dayReceived = ic.LoadStatus(ic.statusFile)
+	return ic
+}
+
+func readTag(t *testing.T, ic *IntegrityChecker, name string) (string, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(ic.dir, name))
+	if os.IsNotExist(err) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), true
+}
+
+func TestCheckHour(t *testing.T) {
+	hour := time.Now().Add(-time.Hour).Format("2006010215")
+	type pack struct {
+		id      string
+		lines   int
+		dropped int
+		done    bool
+		missing bool
+	}
+	tests := []struct {
+		name  string
+		packs []pack
+		tag   string //为空表示还没完成
+		body  string
+	}{
+		{"complete", []pack{{"1", 10, 0, false, false}, {"2", 5, 0, false, false}, {"3", 0, 0, true, false}}, "ip1_" + hour + "_15", ""},
+		{"out of order", []pack{{"3", 0, 0, true, false}, {"2", 5, 0, false, false}, {"1", 10, 0, false, false}}, "ip1_" + hour + "_15", ""},
+		{"pack missing", []pack{{"1", 10, 0, false, false}, {"3", 0, 0, true, false}}, "", ""},
+		{"no done", []pack{{"1", 10, 0, false, false}, {"2", 5, 0, false, false}}, "", ""},
+		{"dropped", []pack{{"1", 8, 2, false, false}, {"2", 0, 0, true, false}}, "ip1_" + hour + "_8", "dropped 2\n"},
+		{"file missing", []pack{{"1", 0, 0, true, true}}, "ip1_" + hour + "_0", "missing\n"},
+		{"wrong id ignored", []pack{{"period", 7, 0, false, false}, {"1", 0, 0, true, false}}, "ip1_" + hour + "_0", ""},
+	}
+	for _, tt := range tests {
+		ic := newTestChecker(t)
+		for _, p := range tt.packs {
+			ic.Add("ip1", hour, p.id, p.lines, p.dropped, p.done, p.missing, 0)
+		}
+		finish, _ := ic.Check()
+		if tt.tag == "" {
+			if len(finish) != 0 {
+				t.Errorf("%s: finished %v", tt.name, finish)
+			}
+			continue
+		}
+		if len(finish["ip1"]) != 1 || finish["ip1"][0] != hour {
+			t.Errorf("%s: finished %v", tt.name, finish)
+		}
+		body, ok := readTag(t, ic, tt.tag)
+		if !ok {
+			t.Errorf("%s: no tag %s", tt.name, tt.tag)
+		} else if body != tt.body {
+			t.Errorf("%s: tag content %q, want %q", tt.name, body, tt.body)
+		}
+		if _, ok := ic.dayReceived["ip1"][hour[:8]].Hours[hour]; !ok {
+			t.Errorf("%s: hour not added to day", tt.name)
+		}
+	}
+}
+
+//按天切割的日志一个周期就是一天
+func TestCheckDay(t *testing.T) {
+	ic := newTestChecker(t)
+	day := time.Now().AddDate(0, 0, -1).Format("20060102")
+	ic.Add("ip1_app", day, "1", 3, 0, true, false, 86400)
+	_, dayFinish := ic.Check()
+	if len(dayFinish["ip1_app"]) != 1 {
+		t.Fatalf("day not finished: %v", dayFinish)
+	}
+	if _, ok := readTag(t, ic, "ip1_app_"+day); !ok {
+		t.Error("no day tag")
+	}
+}
+
+func TestExpectedHours(t *testing.T) {
+	ic := newTestChecker(t)
+	ic.SetExpectedHours(map[string]string{"expected_hours": "0-23", "expected_hours.app": "9-10"})
+	day := time.Now().AddDate(0, 0, -1)
+	for _, h := range []int{9, 10} {
+		hour := time.Date(day.Year(), day.Month(), day.Day(), h, 0, 0, 0, time.Local).Format("2006010215")
+		ic.Add("ip1_app.web", hour, "1", 1, 0, true, false, 0)
+		ic.Add("ip2", hour, "1", 1, 0, true, false, 0)
+	}
+	_, dayFinish := ic.Check()
+	if len(dayFinish["ip1_app.web"]) != 1 {
+		t.Errorf("app.web should use the hours of app: %v", dayFinish)
+	}
+	if len(dayFinish["ip2"]) != 0 {
+		t.Errorf("ip2 needs all hours: %v", dayFinish)
+	}
+}
+
+func TestParseHours(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+		ok   bool
+	}{
+		{"8-10,22", []int{8, 9, 10, 22}, true},
+		{" 3 ", []int{3}, true},
+		{"", nil, true},
+		{"10-8", nil, false},
+		{"24", nil, false},
+		{"a-b", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseHours(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err %v", tt.in, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.in, got, tt.want)
+		}
+		for _, h := range tt.want {
+			if !got[h] {
+				t.Errorf("%q: hour %d missing", tt.in, h)
+			}
+		}
+	}
+}
+
+//老格式的状态文件中id和total_lines、period放在同一个map里
+func TestLoadOldStatus(t *testing.T) {
+	ic := newTestChecker(t)
+	old := `{"hour_received":{"ip1":{"2024010203":{"1":1,"2":1,"total_lines":30,"total_packs":0,"total_dropped":2,"period":3600}}},` +
+		`"day_received":{"ip1":{"20240101":{"2024010100":1,"2024010101":1,"period":3600}},"ip2":{"20240101":{"2024010100":1}}}}`
+	if err := ioutil.WriteFile(ic.statusFile, []byte(old), 0664); err != nil {
+		t.Fatal(err)
+	}
+	hours, days := ic.LoadStatus(ic.statusFile)
+	hs := hours["ip1"]["2024010203"]
+	if hs == nil || len(hs.Ids) != 2 || !hs.Ids[1] || !hs.Ids[2] || hs.Lines != 30 || hs.Dropped != 2 || hs.Packs != 0 || hs.Period != 3600 {
+		t.Errorf("hour status %+v", hs)
+	}
+	ds := days["ip1"]["20240101"]
+	if ds == nil || len(ds.Hours) != 2 || ds.Period != 3600 {
+		t.Errorf("day status %+v", ds)
+	}
+	if ds := days["ip2"]["20240101"]; ds == nil || ds.Period != 3600 || len(ds.Hours) != 1 {
+		t.Errorf("day status without period %+v", ds)
+	}
+
+	//保存为新格式后再读
+	ic.hourReceived, ic.dayReceived = hours, days
+	ic.SaveStatus()
+	hours, days = ic.LoadStatus(ic.statusFile)
+	if hs := hours["ip1"]["2024010203"]; hs == nil || len(hs.Ids) != 2 || hs.Lines != 30 {
+		t.Errorf("reloaded hour status %+v", hs)
+	}
+	if ds := days["ip1"]["20240101"]; ds == nil || len(ds.Hours) != 2 {
+		t.Errorf("reloaded day status %+v", ds)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+  按字节数限制排队中的数据，超过上限时Acquire、Wait阻塞，直到有数据被Release
+  max小于等于0表示不限制
+*/
+
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+type ByteBudget struct {
+	max    int64
+	used   int64
+	waited time.Duration //Acquire累计阻塞的时间
+	cond   *sync.Cond
+}
+
+func NewByteBudget(max int64) *ByteBudget {
+	return &ByteBudget{max: max, cond: sync.NewCond(&sync.Mutex{})}
+}
+
+//占用n字节，超过上限时等待，返回等待的时间
+//没有占用时总能通过，以免大于上限的单条数据一直阻塞
+func (this *ByteBudget) Acquire(n int) time.Duration {
+	if this.max <= 0 {
+		return 0
+	}
+	this.cond.L.Lock()
+	defer this.cond.L.Unlock()
+	var st time.Time
+	for this.used > 0 && this.used+int64(n) > this.max {
+		if st.IsZero() {
+			st = time.Now()
+		}
+		this.cond.Wait()
+	}
+	this.used += int64(n)
+	if st.IsZero() {
+		return 0
+	}
+	d := time.Now().Sub(st)
+	this.waited += d
+	return d
+}
+
+//等到占用的字节数低于上限，自己不占用，返回等待的时间
+//用于产生数据的一方，数据在之后（如打包后）再用Force占用
+func (this *ByteBudget) Wait() time.Duration {
+	if this.max <= 0 {
+		return 0
+	}
+	this.cond.L.Lock()
+	defer this.cond.L.Unlock()
+	var st time.Time
+	for this.used >= this.max {
+		if st.IsZero() {
+			st = time.Now()
+		}
+		this.cond.Wait()
+	}
+	if st.IsZero() {
+		return 0
+	}
+	d := time.Now().Sub(st)
+	this.waited += d
+	return d
+}
+
+//不等待直接占用，用于不能阻塞的一方
+func (this *ByteBudget) Force(n int) {
+	if this.max <= 0 {
+		return
+	}
+	this.cond.L.Lock()
+	this.used += int64(n)
+	this.cond.L.Unlock()
+}
+
+func (this *ByteBudget) Release(n int) {
+	if this.max <= 0 {
+		return
+	}
+	this.cond.L.Lock()
+	this.used -= int64(n)
+	if this.used < 0 {
+		this.used = 0
+	}
+	this.cond.L.Unlock()
+	this.cond.Broadcast()
+}
+
+//当前占用的字节数和累计等待的时间
+func (this *ByteBudget) Stat() (used int64, waited time.Duration) {
+	this.cond.L.Lock()
+	defer this.cond.L.Unlock()
+	return this.used, this.waited
+}
+
+//已经用完，用于不能等待的一方决定是否拒绝
+func (this *ByteBudget) Full() bool {
+	if this.max <= 0 {
+		return false
+	}
+	this.cond.L.Lock()
+	defer this.cond.L.Unlock()
+	return this.used >= this.max
+}
+
+func (this *ByteBudget) Max() int64 {
+	return this.max
+}
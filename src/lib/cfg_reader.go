@@ -38,7 +38,8 @@ func ReadConfig(cfgFile string) map[string]map[string]string {
 			continue
 		}
 
-		parts := strings.Split(line, "=")
+		//值里可能有=，如正则
+		parts := strings.SplitN(line, "=", 2)
 		if len(parts) == 2 {
 			key := strings.Trim(parts[0], " ")
 			val := strings.Trim(parts[1], " ")
@@ -57,3 +57,9 @@ func (gl *GlobalList) PushBack(v interface{}) {
 	gl.m.Unlock()
 
 }
+
+func (gl *GlobalList) Len() int {
+	gl.m.Lock()
+	defer gl.m.Unlock()
+	return gl.list.Len()
+}
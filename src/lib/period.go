@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+* 日志切割周期，支持分钟、小时、天
+* 包头中的hour字段为周期的key，按周期长度使用不同的格式：
+* 天 20060102，小时 2006010215，分钟 200601021504
+ */
+type Period struct {
+	Duration time.Duration
+}
+
+var Hourly = Period{time.Hour}
+var Daily = Period{24 * time.Hour}
+
+var errWrongPeriod = errors.New("wrong rotate period")
+
+//解析如10m, 1h, 1d, 30s的周期配置
+func ParsePeriod(s string) (Period, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	switch s {
+	case "minute":
+		return Period{time.Minute}, nil
+	case "hour":
+		return Hourly, nil
+	case "day":
+		return Daily, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n != 1 {
+			return Period{}, errWrongPeriod
+		}
+		return Daily, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < time.Minute || d > 24*time.Hour || (24*time.Hour)%d != 0 {
+		return Period{}, errWrongPeriod
+	}
+	return Period{d}, nil
+}
+
+//由时间格式推断周期：有分钟的按分钟，有小时的按小时，否则按天
+func PeriodOfLayout(layout string) Period {
+	if strings.Contains(layout, "04") {
+		return Period{time.Minute}
+	}
+	if strings.Contains(layout, "15") {
+		return Hourly
+	}
+	return Daily
+}
+
+func (p Period) Seconds() int {
+	return int(p.Duration / time.Second)
+}
+
+func (p Period) String() string {
+	if p.Duration == 24*time.Hour {
+		return "1d"
+	}
+	return p.Duration.String()
+}
+
+func (p Period) KeyFormat() string {
+	if p.Duration >= 24*time.Hour {
+		return "20060102"
+	}
+	if p.Duration%time.Hour == 0 {
+		return "2006010215"
+	}
+	return "200601021504"
+}
+
+//时间所在周期的开始时间，按本地时间对齐
+func (p Period) Truncate(t time.Time) time.Time {
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	if p.Duration >= 24*time.Hour {
+		return day
+	}
+	elapse := t.Sub(day)
+	return day.Add(elapse - elapse%p.Duration)
+}
+
+//下一个周期的开始时间
+func (p Period) Next(t time.Time) time.Time {
+	start := p.Truncate(t)
+	if p.Duration >= 24*time.Hour {
+		return start.AddDate(0, 0, 1)
+	}
+	next := start.Add(p.Duration)
+	//跨天时对齐到第二天零点，避免夏令时等造成的偏移
+	if next.Day() != start.Day() {
+		y, m, d := next.Date()
+		next = time.Date(y, m, d, 0, 0, 0, 0, next.Location())
+	}
+	return next
+}
+
+func (p Period) Key(t time.Time) string {
+	return t.Format(p.KeyFormat())
+}
+
+//一天有多少个周期
+func (p Period) PerDay() int {
+	if p.Duration >= 24*time.Hour {
+		return 1
+	}
+	return int(24 * time.Hour / p.Duration)
+}
+
+//解析周期的key，按长度判断格式
+func ParsePeriodKey(key string) (time.Time, error) {
+	var layout string
+	switch len(key) {
+	case 8:
+		layout = "20060102"
+	case 10:
+		layout = "2006010215"
+	case 12:
+		layout = "200601021504"
+	default:
+		return time.Time{}, errWrongPeriod
+	}
+	return time.ParseInLocation(layout, key, time.Local)
+}
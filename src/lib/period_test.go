@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePeriod(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"minute", time.Minute, true},
+		{"Hour", time.Hour, true},
+		{" day ", 24 * time.Hour, true},
+		{"1d", 24 * time.Hour, true},
+		{"10m", 10 * time.Minute, true},
+		{"1h", time.Hour, true},
+		{"6h", 6 * time.Hour, true},
+		{"24h", 24 * time.Hour, true},
+		{"2d", 0, false},
+		{"30s", 0, false},
+		{"7m", 0, false}, //一天不是7分钟的整数倍
+		{"5h", 0, false},
+		{"48h", 0, false},
+		{"", 0, false},
+		{"abc", 0, false},
+	}
+	for _, tt := range tests {
+		p, err := ParsePeriod(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err %v", tt.in, err)
+			continue
+		}
+		if tt.ok && p.Duration != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.in, p.Duration, tt.want)
+		}
+	}
+}
+
+func TestParsePeriodKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want time.Time
+		ok   bool
+	}{
+		{"20261017", time.Date(2026, 10, 17, 0, 0, 0, 0, time.Local), true},
+		{"2026101715", time.Date(2026, 10, 17, 15, 0, 0, 0, time.Local), true},
+		{"202610171530", time.Date(2026, 10, 17, 15, 30, 0, 0, time.Local), true},
+		{"2026101", time.Time{}, false},
+		{"20261017150", time.Time{}, false},
+		{"2026101725", time.Time{}, false},
+		{"2026x01715", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParsePeriodKey(tt.key)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err %v", tt.key, err)
+			continue
+		}
+		if tt.ok && !got.Equal(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestPeriodKey(t *testing.T) {
+	at := time.Date(2026, 10, 17, 23, 47, 12, 0, time.Local)
+	tests := []struct {
+		period Period
+		key    string
+		next   time.Time
+	}{
+		{Period{time.Minute}, "202610172347", time.Date(2026, 10, 17, 23, 48, 0, 0, time.Local)},
+		{Period{10 * time.Minute}, "202610172340", time.Date(2026, 10, 17, 23, 50, 0, 0, time.Local)},
+		{Hourly, "2026101723", time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)},
+		{Period{6 * time.Hour}, "2026101718", time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)},
+		{Daily, "20261017", time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		key := tt.period.Key(tt.period.Truncate(at))
+		if key != tt.key {
+			t.Errorf("%v: key %s, want %s", tt.period, key, tt.key)
+		}
+		//key解析回来就是周期的开始
+		start, err := ParsePeriodKey(key)
+		if err != nil || !start.Equal(tt.period.Truncate(at)) {
+			t.Errorf("%v: parsed key %v %v, want %v", tt.period, start, err, tt.period.Truncate(at))
+		}
+		if next := tt.period.Next(at); !next.Equal(tt.next) {
+			t.Errorf("%v: next %v, want %v", tt.period, next, tt.next)
+		}
+	}
+}
+
+func TestPeriodOfLayout(t *testing.T) {
+	tests := []struct {
+		layout string
+		want   Period
+	}{
+		{"2006010215", Hourly},
+		{"20060102", Daily},
+		{"2006-01-02 15:04", Period{time.Minute}},
+	}
+	for _, tt := range tests {
+		if got := PeriodOfLayout(tt.layout); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.layout, got, tt.want)
+		}
+	}
+}
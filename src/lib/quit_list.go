@@ -40,7 +40,7 @@ func (this *QuitList) Append(f QuitFunc) (lstLen int) {
 //也可用其他信号处理方法替代
 func (this *QuitList) HandleQuitSignal() {
 	//signal handling, for elegant quit
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGQUIT)
 	s := <-ch
 	log.Println("get signal:", s)
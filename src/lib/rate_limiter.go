@@ -0,0 +1,82 @@
+/*
+  令牌桶限速，每秒补充rate个令牌，最多攒burst个
+  rate小于等于0表示不限速
+*/
+
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+type RateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	waited time.Duration //Wait累计等待的时间
+	mutex  *sync.Mutex
+}
+
+//burst默认为一秒的量
+func NewRateLimiter(rate int, burst ...int) *RateLimiter {
+	b := rate
+	if len(burst) > 0 && burst[0] > 0 {
+		b = burst[0]
+	}
+	return &RateLimiter{rate: float64(rate), burst: float64(b), tokens: float64(b), last: time.Now(), mutex: &sync.Mutex{}}
+}
+
+//运行中调整速率，burst默认为一秒的量
+func (this *RateLimiter) SetRate(rate int, burst ...int) {
+	b := rate
+	if len(burst) > 0 && burst[0] > 0 {
+		b = burst[0]
+	}
+	this.mutex.Lock()
+	this.rate, this.burst = float64(rate), float64(b)
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.mutex.Unlock()
+}
+
+func (this *RateLimiter) Waited() time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.waited
+}
+
+func (this *RateLimiter) Rate() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return int(this.rate)
+}
+
+//取n个令牌，不够时等待，返回等待的时间
+func (this *RateLimiter) Wait(n int) time.Duration {
+	this.mutex.Lock()
+	if this.rate <= 0 {
+		this.mutex.Unlock()
+		return 0
+	}
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+	//允许欠账，超过burst的请求也能通过，只是等得久一些
+	this.tokens -= float64(n)
+	var d time.Duration
+	if this.tokens < 0 {
+		d = time.Duration(-this.tokens / this.rate * float64(time.Second))
+		this.waited += d
+	}
+	this.mutex.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return d
+}
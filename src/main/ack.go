@@ -0,0 +1,122 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"loglib"
+	"tcp_pack"
+)
+
+/*
+* 断点记录在对应的包被collector确认收到或写入sender的缓存文件后才保存，
+* 进程被kill -9时，还在receiver、sendBuffer和sender内存中的包重启后会重新读取发送，
+* 只会重发，不会丢失
+* tailer在发出凑满一个包的最后一行（或周期结束标记）之前登记这个包对应的断点，
+* sender确认后按tail的顺序保存，前面的包没确认时后面的断点不保存
+ */
+type ackTracker struct {
+	streamKey  string
+	recordPath string
+	pending    *list.List               //*ackEntry，按tail的顺序
+	index      map[string]*list.Element //hour_id
+	mutex      *sync.Mutex
+}
+
+type ackEntry struct {
+	key   string
+	cp    *Checkpoint
+	acked bool
+}
+
+//日志流（ip或ip_源名字）对应的ackTracker
+var ackTrackers = make(map[string]*ackTracker)
+var ackMutex = &sync.RWMutex{}
+
+func newAckTracker(streamKey string, recordPath string) *ackTracker {
+	t := &ackTracker{streamKey: streamKey, recordPath: recordPath, pending: list.New(), index: make(map[string]*list.Element), mutex: &sync.Mutex{}}
+	ackMutex.Lock()
+	ackTrackers[streamKey] = t
+	ackMutex.Unlock()
+	return t
+}
+
+func ackKey(hour string, id int) string {
+	return fmt.Sprintf("%s_%d", hour, id)
+}
+
+//登记id为id的包被确认后要保存的断点
+func (t *ackTracker) expect(hour string, id int, cp *Checkpoint) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := ackKey(hour, id)
+	if e, ok := t.index[key]; ok {
+		//重启后重新发送的结束包
+		e.Value.(*ackEntry).cp = cp
+		return
+	}
+	t.index[key] = t.pending.PushBack(&ackEntry{key: key, cp: cp})
+}
+
+//包被确认，保存已确认的最后一个断点
+func (t *ackTracker) ack(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	e, ok := t.index[key]
+	if !ok {
+		return
+	}
+	e.Value.(*ackEntry).acked = true
+	var cp *Checkpoint
+	for e = t.pending.Front(); e != nil && e.Value.(*ackEntry).acked; e = t.pending.Front() {
+		entry := e.Value.(*ackEntry)
+		cp = entry.cp
+		delete(t.index, entry.key)
+		t.pending.Remove(e)
+	}
+	if cp != nil {
+		saveCheckpoint(t.recordPath, cp)
+	}
+	if t.pending.Len() > 0 {
+		loglib.Info(fmt.Sprintf("pack %s acked, checkpoints pending: %d", key, t.pending.Len()))
+	}
+}
+
+//登记的断点都已保存
+func (t *ackTracker) idle() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.pending.Len() == 0
+}
+
+//日志流结束（如通配符匹配到的日志已删除），断点都保存后才能注销，否则之后的确认找不到
+func (t *ackTracker) unregister() {
+	ackMutex.Lock()
+	if ackTrackers[t.streamKey] == t {
+		delete(ackTrackers, t.streamKey)
+	}
+	ackMutex.Unlock()
+}
+
+//sender发送成功或写入缓存文件后调用
+func ackPack(data []byte) {
+	ackMutex.RLock()
+	n := len(ackTrackers)
+	ackMutex.RUnlock()
+	if n == 0 {
+		//collector等角色没有tail
+		return
+	}
+	header, _, err := tcp_pack.ExtractHeader(data)
+	if err != nil || len(header.Route) == 0 {
+		return
+	}
+	route := header.Route[0]
+	ackMutex.RLock()
+	t, ok := ackTrackers[tcp_pack.StreamKey(route)]
+	ackMutex.RUnlock()
+	if ok {
+		t.ack(route["hour"] + "_" + route["id"])
+	}
+}
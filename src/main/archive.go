@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"lib"
+)
+
+/*
+* 已经被logrotate压缩的历史日志
+* archive_suffixes为依次查找的后缀，默认.gz,.bz2,.zst,.xz，这四种直接解压，不需要外部命令
+* archive_cmd.后缀（不带点）可以指定解压到标准输出的命令（如archive_cmd.lz4 = lz4 -dc），命令的最后一个参数为归档文件名，
+* 命令退出状态不为0时按读取出错处理，这个周期不发送结束包
+ */
+var defaultArchiveSuffixes = ".gz,.bz2,.zst,.xz"
+
+//日志文件不存在时查找它的归档，没有则返回空
+func findArchive(fname string, config map[string]string) string {
+	suffixes := config["archive_suffixes"]
+	if suffixes == "" {
+		suffixes = defaultArchiveSuffixes
+	}
+	for _, suffix := range strings.Split(suffixes, ",") {
+		suffix = strings.TrimSpace(suffix)
+		if suffix != "" && lib.FileExists(fname+suffix) {
+			return fname + suffix
+		}
+	}
+	return ""
+}
+
+//打开归档，返回解压后的流，数据损坏时Read返回错误而不是io.EOF
+func openArchive(fname string, config map[string]string) (io.ReadCloser, error) {
+	ext := fname[strings.LastIndex(fname, ".")+1:]
+	if cmdline := config["archive_cmd."+ext]; cmdline != "" {
+		return openArchiveCmd(fname, cmdline)
+	}
+	fin, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	ar := &archiveReader{closers: []io.Closer{fin}}
+	switch ext {
+	case "gz":
+		gz, err := gzip.NewReader(fin)
+		if err != nil {
+			fin.Close()
+			return nil, err
+		}
+		ar.Reader = gz
+		ar.closers = append(ar.closers, gz)
+	case "bz2":
+		ar.Reader = bzip2.NewReader(fin)
+	case "zst":
+		//一次只解压一个文件，不用多个goroutine
+		dec, err := zstd.NewReader(fin, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			fin.Close()
+			return nil, err
+		}
+		rc := dec.IOReadCloser()
+		ar.Reader = rc
+		ar.closers = append(ar.closers, rc)
+	case "xz":
+		xr, err := xz.NewReader(fin)
+		if err != nil {
+			fin.Close()
+			return nil, err
+		}
+		ar.Reader = xr
+	default:
+		fin.Close()
+		return nil, errors.New("no archive_cmd." + ext + " to decompress " + fname)
+	}
+	return ar, nil
+}
+
+func openArchiveCmd(fname string, cmdline string) (io.ReadCloser, error) {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil, errors.New("no command to decompress " + fname)
+	}
+	cmd := exec.Command(args[0], append(args[1:], fname)...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &archiveReader{Reader: out, cmd: cmd}, nil
+}
+
+type archiveReader struct {
+	io.Reader
+	closers []io.Closer
+	cmd     *exec.Cmd
+	waited  bool
+}
+
+func (this *archiveReader) Read(p []byte) (int, error) {
+	n, err := this.Reader.Read(p)
+	if err == io.EOF && this.cmd != nil && !this.waited {
+		//命令出错时输出可能不完整，不能当成读完了
+		this.waited = true
+		if werr := this.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("decompress command %s: %s", strings.Join(this.cmd.Args, " "), werr.Error())
+		}
+	}
+	return n, err
+}
+
+func (this *archiveReader) Close() error {
+	for _, c := range this.closers {
+		c.Close()
+	}
+	if this.cmd != nil && !this.waited {
+		//没读完就关闭时命令可能还在等着写
+		this.waited = true
+		this.cmd.Process.Kill()
+		this.cmd.Wait()
+	}
+	return nil
+}
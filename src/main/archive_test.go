@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const archiveContent = "line 1\nline 2\nlast line without newline"
+
+func writeArchive(t *testing.T, fname string, compress func(io.Writer) io.WriteCloser) string {
+	var b bytes.Buffer
+	w := compress(&b)
+	if _, err := w.Write([]byte(archiveContent)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestOpenArchive(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		ext      string
+		compress func(io.Writer) io.WriteCloser
+	}{
+		{"gz", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{"zst", func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w)
+			return zw
+		}},
+		{"xz", func(w io.Writer) io.WriteCloser {
+			xw, _ := xz.NewWriter(w)
+			return xw
+		}},
+	}
+	for _, tt := range tests {
+		log := filepath.Join(dir, "app.log."+tt.ext)
+		fname := writeArchive(t, log+"."+tt.ext, tt.compress)
+		if got := findArchive(log, map[string]string{}); got != fname {
+			t.Errorf("%s: findArchive got %q", tt.ext, got)
+		}
+		rc, err := openArchive(fname, map[string]string{})
+		if err != nil {
+			t.Errorf("%s: %v", tt.ext, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(b) != archiveContent {
+			t.Errorf("%s: got %q, %v", tt.ext, b, err)
+		}
+
+		//截断的归档读到最后要报错，不能当成读完
+		full, _ := ioutil.ReadFile(fname)
+		ioutil.WriteFile(fname, full[:len(full)-6], 0644)
+		if rc, err = openArchive(fname, map[string]string{}); err == nil {
+			_, err = ioutil.ReadAll(rc)
+			rc.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: truncated archive read without error", tt.ext)
+		}
+	}
+}
+
+func TestOpenArchiveCmd(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "app.log.txt")
+	if err := ioutil.WriteFile(fname, []byte(archiveContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+	failing := filepath.Join(dir, "failing.sh")
+	if err := ioutil.WriteFile(failing, []byte("#!/bin/sh\ncat \"$1\"\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cmd  string
+		want string
+		ok   bool
+	}{
+		{"cat", archiveContent, true},
+		//有输出但是退出状态不为0
+		{failing, archiveContent, false},
+		{"false", "", false},
+	}
+	for _, tt := range tests {
+		rc, err := openArchive(fname, map[string]string{"archive_cmd.txt": tt.cmd})
+		if err != nil {
+			t.Errorf("%s: %v", tt.cmd, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if (err == nil) != tt.ok || string(b) != tt.want {
+			t.Errorf("%s: got %q, %v", tt.cmd, b, err)
+		}
+	}
+	if _, err := openArchive(fname, map[string]string{}); err == nil {
+		t.Error("unknown suffix without archive_cmd opened")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/transform"
+
+	"loglib"
+)
+
+/*
+* 日志字符集转换，把gbk等编码的日志转为utf-8后再发送
+* charset为日志的编码，latin1（iso-8859-1）和utf-8直接处理，其它编码（gbk、gb18030、big5、shift_jis、euc-kr、
+* windows-1251等）用golang.org/x/text转换，不需要cgo
+* charset = utf-8时只检查编码是否合法
+* charset_invalid为无法解码的字节的处理方式：
+*   replace  替换为U+FFFD（默认）
+*   drop     丢弃
+*   escape   替换为\xNN
+ */
+type charsetConverter struct {
+	charset string
+	dec     decoder
+	policy  string
+	escaped bool  //iso-2022-jp等用ascii字节和转义序列编码，不能跳过全是ascii的行
+	lines   int64 //转换过的行数
+	invalid int64 //无法解码的字节数
+}
+
+//把src从头开始转换为utf-8，遇到无法解码的字节时停止，n为转换了的字节数
+type decoder interface {
+	decode(src []byte) (out []byte, n int)
+	close()
+}
+
+//没有配置charset时返回nil
+func newCharsetConverter(config map[string]string) *charsetConverter {
+	charset := strings.ToLower(strings.TrimSpace(config["charset"]))
+	if charset == "" {
+		return nil
+	}
+	dec, err := newDecoder(charset)
+	if err != nil {
+		loglib.Error("charset " + charset + " not supported: " + err.Error() + ", send lines as they are")
+		return nil
+	}
+	policy := config["charset_invalid"]
+	switch policy {
+	case "":
+		policy = "replace"
+	case "replace", "drop", "escape":
+	default:
+		loglib.Error("wrong charset_invalid " + policy + ", use replace")
+		policy = "replace"
+	}
+	escaped := charset == "iso-2022-jp" || charset == "hz-gb-2312"
+	return &charsetConverter{charset: charset, dec: dec, policy: policy, escaped: escaped}
+}
+
+func newDecoder(charset string) (decoder, error) {
+	switch charset {
+	case "utf-8", "utf8":
+		return utf8Decoder{}, nil
+	case "latin1", "latin-1", "iso-8859-1", "iso8859-1":
+		return latin1Decoder{}, nil
+	}
+	if enc, ok := textEncodings[charset]; ok {
+		return newTextDecoder(enc), nil
+	}
+	return nil, fmt.Errorf("unknown charset")
+}
+
+func (this *charsetConverter) Convert(line string) string {
+	if !this.escaped && isASCII(line) {
+		return line
+	}
+	atomic.AddInt64(&this.lines, 1)
+	src := []byte(line)
+	buf := make([]byte, 0, len(src)*2)
+	for len(src) > 0 {
+		out, n := this.dec.decode(src)
+		buf = append(buf, out...)
+		src = src[n:]
+		if len(src) == 0 {
+			break
+		}
+		atomic.AddInt64(&this.invalid, 1)
+		switch this.policy {
+		case "replace":
+			buf = append(buf, "�"...)
+		case "escape":
+			buf = append(buf, fmt.Sprintf("\\x%02X", src[0])...)
+		}
+		src = src[1:]
+	}
+	return string(buf)
+}
+
+func (this *charsetConverter) String() string {
+	return fmt.Sprintf("charset %s, converted lines: %d, invalid bytes: %d (%s)", this.charset, atomic.LoadInt64(&this.lines), atomic.LoadInt64(&this.invalid), this.policy)
+}
+
+func (this *charsetConverter) Close() {
+	this.dec.close()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+type utf8Decoder struct{}
+
+func (utf8Decoder) decode(src []byte) ([]byte, int) {
+	n := 0
+	for n < len(src) {
+		r, size := utf8.DecodeRune(src[n:])
+		if r == utf8.RuneError && size <= 1 {
+			break
+		}
+		n += size
+	}
+	return src[:n], n
+}
+
+func (utf8Decoder) close() {}
+
+type latin1Decoder struct{}
+
+func (latin1Decoder) decode(src []byte) ([]byte, int) {
+	out := make([]byte, 0, len(src)*2)
+	for _, c := range src {
+		out = append(out, string(rune(c))...)
+	}
+	return out, len(src)
+}
+
+func (latin1Decoder) close() {}
+
+//charmap中的单字节编码按名字（如windows-1251、iso-8859-5、koi8-r）查找
+var textEncodings = map[string]encoding.Encoding{
+	"gbk":         simplifiedchinese.GBK,
+	"cp936":       simplifiedchinese.GBK,
+	"gb2312":      simplifiedchinese.GBK,
+	"gb18030":     simplifiedchinese.GB18030,
+	"hz-gb-2312":  simplifiedchinese.HZGB2312,
+	"big5":        traditionalchinese.Big5,
+	"shift_jis":   japanese.ShiftJIS,
+	"sjis":        japanese.ShiftJIS,
+	"euc-jp":      japanese.EUCJP,
+	"iso-2022-jp": japanese.ISO2022JP,
+	"euc-kr":      korean.EUCKR,
+	"cp949":       korean.EUCKR,
+}
+
+func init() {
+	for _, enc := range charmap.All {
+		if cm, ok := enc.(*charmap.Charmap); ok {
+			textEncodings[strings.Replace(strings.ToLower(cm.String()), " ", "-", -1)] = cm
+		}
+	}
+}
+
+//x/text的解码器把无法解码的字节转为U+FFFD而不报错，所以一次解一个字符，解出U+FFFD时判断原来是不是这个字符
+type textDecoder struct {
+	enc  encoding.Encoding
+	fffd []byte //U+FFFD在这个编码中的字节，不能编码时为nil
+}
+
+func newTextDecoder(enc encoding.Encoding) *textDecoder {
+	fffd, err := enc.NewEncoder().Bytes([]byte("\uFFFD"))
+	if err != nil {
+		fffd = nil
+	}
+	return &textDecoder{enc: enc, fffd: fffd}
+}
+
+//每次用新的Decoder，可以并发使用，iso-2022-jp等有状态的编码每行从初始状态开始
+func (this *textDecoder) decode(src []byte) ([]byte, int) {
+	t := this.enc.NewDecoder()
+	out := make([]byte, 0, len(src)*2)
+	buf := make([]byte, utf8.UTFMax)
+	n := 0
+	for n < len(src) {
+		//dst从1字节开始加大，正好放下一个字符，没有进展时解码器的状态不变
+		var nDst, nSrc int
+		for l := 1; l <= len(buf); l++ {
+			var err error
+			if nDst, nSrc, err = t.Transform(buf[:l], src[n:], true); nSrc > 0 || err != transform.ErrShortDst {
+				break
+			}
+		}
+		if nSrc == 0 {
+			break
+		}
+		if r, _ := utf8.DecodeRune(buf[:nDst]); nDst > 0 && r == utf8.RuneError && !bytes.Equal(src[n:n+nSrc], this.fffd) {
+			break
+		}
+		out = append(out, buf[:nDst]...)
+		n += nSrc
+	}
+	return out, n
+}
+
+func (this *textDecoder) close() {}
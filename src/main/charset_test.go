@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestCharsetConvert(t *testing.T) {
+	tests := []struct {
+		charset string
+		policy  string
+		in      string
+		want    string
+		invalid int64
+	}{
+		{"gbk", "", "ascii only", "ascii only", 0},
+		{"gbk", "", "a\xd6\xd0\xce\xc4b", "a中文b", 0},
+		{"GBK", "replace", "\xd6\xd0\xff\xce\xc4", "中�文", 1},
+		{"gbk", "drop", "\xd6\xd0\xff\xce\xc4", "中文", 1},
+		{"gbk", "escape", "\xd6\xd0\xff\xce\xc4", `中\xFF文`, 1},
+		//最后一个字符不完整
+		{"gbk", "escape", "\xd6\xd0\xce", `中\xCE`, 1},
+		//gb18030中的U+FFFD不算无法解码
+		{"gb18030", "", "\x84\x31\xa4\x37\x81\x30\x81\x30", "�\u0080", 0},
+		{"big5", "", "\xa4\xa4\xa4\xe5", "中文", 0},
+		{"shift_jis", "", "\x93\xfa\x96\x7b", "日本", 0},
+		{"iso-2022-jp", "", "a\x1b$B\x46\x7c\x4b\x5c\x1b(Bb", "a日本b", 0},
+		{"euc-kr", "", "\xc7\xd1", "한", 0},
+		{"windows-1251", "", "\xc6", "Ж", 0},
+		{"koi8-r", "", "\xf6", "Ж", 0},
+		{"latin1", "", "caf\xe9", "café", 0},
+		{"utf-8", "escape", "ok\xe4\xb8\xad\xc3", `ok中\xC3`, 1},
+	}
+	for _, tt := range tests {
+		c := newCharsetConverter(map[string]string{"charset": tt.charset, "charset_invalid": tt.policy})
+		if c == nil {
+			t.Errorf("%s: not supported", tt.charset)
+			continue
+		}
+		if got := c.Convert(tt.in); got != tt.want {
+			t.Errorf("%s %s %q: got %q, want %q", tt.charset, tt.policy, tt.in, got, tt.want)
+		}
+		if c.invalid != tt.invalid {
+			t.Errorf("%s %q: invalid %d, want %d", tt.charset, tt.in, c.invalid, tt.invalid)
+		}
+		c.Close()
+	}
+}
+
+func TestCharsetUnknown(t *testing.T) {
+	if c := newCharsetConverter(map[string]string{"charset": "no-such-charset"}); c != nil {
+		t.Error("unknown charset accepted")
+	}
+	if c := newCharsetConverter(map[string]string{}); c != nil {
+		t.Error("converter without charset")
+	}
+}
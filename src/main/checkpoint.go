@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"loglib"
+)
+
+/*
+* tail进度的断点记录，替代原来"文件名 行数"格式的line.rec
+* 记录文件的设备号、inode、已tail的字节偏移和行数，
+* 以及文件头部若干字节的md5，用于重启时发现文件被截断或被同名文件替换
+ */
+const checkpointVersion = 2
+const fingerprintSize = 1024 //计算指纹的文件头部字节数
+
+type Checkpoint struct {
+	Version     int    `json:"version"`
+	File        string `json:"file"`
+	Dev         uint64 `json:"dev"`
+	Inode       uint64 `json:"inode"`
+	Offset      int64  `json:"offset"`            //小于0表示从文件末尾开始
+	Line        int    `json:"line"`              //已tail的行数
+	NextId      int    `json:"next_id,omitempty"` //断点之后第一个包的id，老的记录没有时按行数计算
+	Fingerprint string `json:"fingerprint"`
+	FpLen       int    `json:"fp_len"`         //计算指纹时用到的字节数，文件较小时小于fingerprintSize
+	Hour        string `json:"hour,omitempty"` //所在周期的key，路径中没有时间格式时用于重启后继续原来的周期
+}
+
+//读取断点记录，记录不存在返回nil
+//老格式的记录会被转换，此时Version为1，Offset需要由Tailler根据行数算出
+func loadCheckpoint(path string) *Checkpoint {
+	vbytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		loglib.Error(fmt.Sprintf("open checkpoint `%s` error: %s", path, err.Error()))
+		return nil
+	}
+	cp := &Checkpoint{}
+	if err = json.Unmarshal(vbytes, cp); err == nil {
+		return cp
+	}
+	//兼容老格式："文件名 行数"或"行数"，只读第一行
+	var txt string
+	scanner := bufio.NewScanner(strings.NewReader(string(vbytes)))
+	for scanner.Scan() {
+		txt = strings.Trim(scanner.Text(), " ")
+		break
+	}
+	parts := strings.Split(txt, " ")
+	lineStr := parts[0]
+	if len(parts) == 2 {
+		cp.File = parts[0]
+		lineStr = parts[1]
+	}
+	cp.Line, err = strconv.Atoi(lineStr)
+	if err != nil {
+		loglib.Error("convert line record error:" + err.Error())
+		return nil
+	}
+	cp.Version = 1
+	cp.Offset = -1
+	loglib.Info(fmt.Sprintf("old line record found: %s %d", cp.File, cp.Line))
+	return cp
+}
+
+//重启后第一个包的id，提前打包后包的行数不满bufSize，不能再按行数计算
+func (cp *Checkpoint) nextId(bufSize int) int {
+	if cp.NextId > 0 {
+		return cp.NextId
+	}
+	if bufSize <= 0 {
+		return 1
+	}
+	return cp.Line/bufSize + 1
+}
+
+//写临时文件再改名，避免进程被kill时留下半个记录
+func saveCheckpoint(path string, cp *Checkpoint) {
+	cp.Version = checkpointVersion
+	vbytes, err := json.Marshal(cp)
+	if err != nil {
+		loglib.Error("marshal checkpoint error: " + err.Error())
+		return
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, vbytes, 0664)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		loglib.Error("save checkpoint error: " + err.Error())
+		return
+	}
+	loglib.Info(fmt.Sprintf("save checkpoint success! %s offset:%d line:%d", cp.File, cp.Offset, cp.Line))
+}
+
+func fingerprint(head []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(head))
+}
+
+//计算前n字节的指纹，用于和记录中的指纹比较
+func fileFingerprintN(fname string, n int) string {
+	fin, err := os.Open(fname)
+	if err != nil {
+		return ""
+	}
+	defer fin.Close()
+	buf := make([]byte, n)
+	m, _ := io.ReadFull(fin, buf)
+	if m < n {
+		return ""
+	}
+	return fingerprint(buf)
+}
+
+func fileInode(fname string) (dev uint64, ino uint64, size int64, err error) {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		dev, ino = uint64(st.Dev), uint64(st.Ino)
+	}
+	return dev, ino, fi.Size(), nil
+}
+
+//检查记录对应的文件是否还是原来那个文件，是则返回可以继续的偏移和行数
+//文件被截断或被替换时从头开始；文件不存在时原样返回，由tail过程处理
+func (cp *Checkpoint) resume() (offset int64, line int) {
+	dev, ino, size, err := fileInode(cp.File)
+	if err != nil {
+		return cp.Offset, cp.Line
+	}
+	if size < cp.Offset {
+		loglib.Warning(fmt.Sprintf("%s truncated, size %d < offset %d, tail from the beginning", cp.File, size, cp.Offset))
+		return 0, 0
+	}
+	if cp.FpLen > 0 && fileFingerprintN(cp.File, cp.FpLen) != cp.Fingerprint {
+		loglib.Warning(fmt.Sprintf("%s replaced, fingerprint changed (inode %d -> %d), tail from the beginning", cp.File, cp.Inode, ino))
+		return 0, 0
+	}
+	if cp.Inode != 0 && (dev != cp.Dev || ino != cp.Inode) {
+		//inode变了但是内容一样，可能是拷贝或者移动过来的，按原偏移继续
+		loglib.Info(fmt.Sprintf("%s inode changed %d -> %d, fingerprint matched", cp.File, cp.Inode, ino))
+	}
+	return cp.Offset, cp.Line
+}
+
+//在目录中按设备号和inode找文件，用于找到被logrotate改名的日志
+func findByInode(dir string, dev uint64, ino uint64) string {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		loglib.Error("read dir " + dir + " error: " + err.Error())
+		return ""
+	}
+	for _, fi := range fis {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && uint64(st.Dev) == dev && uint64(st.Ino) == ino {
+			return filepath.Join(dir, fi.Name())
+		}
+	}
+	return ""
+}
+
+//根据行数算出字节偏移，用于老格式记录的迁移
+func offsetOfLine(fname string, line int) int64 {
+	fin, err := os.Open(fname)
+	if err != nil {
+		return 0
+	}
+	defer fin.Close()
+	rd := bufio.NewReaderSize(fin, 64*1024)
+	var offset int64 = 0
+	for i := 0; i < line; i++ {
+		s, err := rd.ReadSlice('\n')
+		for err == bufio.ErrBufferFull {
+			offset += int64(len(s))
+			s, err = rd.ReadSlice('\n')
+		}
+		if err != nil {
+			break
+		}
+		offset += int64(len(s))
+	}
+	return offset
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCheckpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *Checkpoint //nil表示读不出记录
+	}{
+		{"v1 file and line", "/data/access.log.2026101715 120\n", &Checkpoint{Version: 1, File: "/data/access.log.2026101715", Line: 120, Offset: -1}},
+		{"v1 line only", " 35 \nignored\n", &Checkpoint{Version: 1, Line: 35, Offset: -1}},
+		{"v2", `{"version":2,"file":"/data/a.log","dev":1,"inode":2,"offset":300,"line":10,"next_id":4,"fingerprint":"ff","fp_len":1024,"hour":"2026101715"}`,
+			&Checkpoint{Version: 2, File: "/data/a.log", Dev: 1, Inode: 2, Offset: 300, Line: 10, NextId: 4, Fingerprint: "ff", FpLen: 1024, Hour: "2026101715"}},
+		{"wrong line", "/data/a.log abc", nil},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "line.rec")
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0664); err != nil {
+			t.Fatal(err)
+		}
+		got := loadCheckpoint(path)
+		if tt.want == nil {
+			if got != nil {
+				t.Errorf("%s: got %+v, want nil", tt.name, got)
+			}
+			continue
+		}
+		if got == nil || *got != *tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if cp := loadCheckpoint(filepath.Join(t.TempDir(), "none.rec")); cp != nil {
+		t.Errorf("missing record: got %+v", cp)
+	}
+}
+
+//老记录按行数算出偏移后保存为新格式
+func TestCheckpointMigrate(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "access.log")
+	long := strings.Repeat("x", 70*1024) + "\n" //超过读缓冲
+	content := "a\n" + long + "bb\nccc\n"
+	if err := ioutil.WriteFile(logFile, []byte(content), 0664); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		line int
+		want int64
+	}{
+		{0, 0},
+		{1, 2},
+		{2, int64(2 + len(long))},
+		{3, int64(5 + len(long))},
+		{4, int64(len(content))},
+		{10, int64(len(content))}, //行数超过文件时停在末尾
+	}
+	for _, tt := range tests {
+		if got := offsetOfLine(logFile, tt.line); got != tt.want {
+			t.Errorf("offsetOfLine(%d) = %d, want %d", tt.line, got, tt.want)
+		}
+	}
+
+	rec := filepath.Join(dir, "line.rec")
+	if err := ioutil.WriteFile(rec, []byte(logFile+" 3\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	cp := loadCheckpoint(rec)
+	if cp == nil || cp.Version != 1 {
+		t.Fatalf("old record: %+v", cp)
+	}
+	cp.Offset = offsetOfLine(cp.File, cp.Line)
+	saveCheckpoint(rec, cp)
+	cp = loadCheckpoint(rec)
+	if cp == nil || cp.Version != checkpointVersion || cp.File != logFile || cp.Line != 3 || cp.Offset != int64(5+len(long)) {
+		t.Errorf("migrated record: %+v", cp)
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	content := strings.Repeat("line\n", 300)
+	tests := []struct {
+		name    string
+		modify  func(path string) error
+		offset  int64
+		wantOff int64
+	}{
+		{"unchanged", nil, 500, 500},
+		{"appended", func(path string) error { return ioutil.WriteFile(path, []byte(content+"more\n"), 0664) }, 500, 500},
+		{"truncated", func(path string) error { return ioutil.WriteFile(path, []byte("line\n"), 0664) }, 500, 0},
+		{"replaced", func(path string) error { return ioutil.WriteFile(path, []byte(strings.Repeat("LINE\n", 300)), 0664) }, 500, 0},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "access.log")
+		if err := ioutil.WriteFile(path, []byte(content), 0664); err != nil {
+			t.Fatal(err)
+		}
+		dev, ino, _, err := fileInode(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp := &Checkpoint{File: path, Dev: dev, Inode: ino, Offset: tt.offset, Line: 100, FpLen: fingerprintSize,
+			Fingerprint: fileFingerprintN(path, fingerprintSize)}
+		if tt.modify != nil {
+			if err := tt.modify(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		offset, line := cp.resume()
+		if offset != tt.wantOff {
+			t.Errorf("%s: offset %d, want %d", tt.name, offset, tt.wantOff)
+		}
+		if tt.wantOff == 0 && line != 0 || tt.wantOff != 0 && line != 100 {
+			t.Errorf("%s: line %d", tt.name, line)
+		}
+	}
+}
+
+func TestCheckpointNextId(t *testing.T) {
+	tests := []struct {
+		cp      Checkpoint
+		bufSize int
+		want    int
+	}{
+		{Checkpoint{NextId: 7, Line: 1000}, 100, 7},
+		{Checkpoint{Line: 1000}, 100, 11},
+		{Checkpoint{Line: 1050}, 100, 11},
+		{Checkpoint{Line: 1000}, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.cp.nextId(tt.bufSize); got != tt.want {
+			t.Errorf("%+v nextId(%d) = %d, want %d", tt.cp, tt.bufSize, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"loglib"
+)
+
+/*
+* 容器日志：container = docker 或 cri
+*   docker  json-file格式，每行 {"log":"...","stream":"stdout","time":"..."}，默认路径/var/lib/docker/containers/<id>/<id>-json.log
+*   cri     containerd/cri-o格式，每行 时间 stream P|F 内容，默认路径/var/log/pods/<namespace>_<pod>_<uid>/<容器名>/0.log
+* 去掉外层的封装，只发送日志内容，被运行时拆开的长行（docker的log不以换行结尾，cri的P）合并后再发送，
+* 容器id、名字和stream写到包头，多个值用逗号分隔
+* 断点不越过还没结束的长行的第一段，以免一个stream的完整日志把断点推到另一个stream的半行之后，重启后丢了前面的段
+* 运行时自己切割日志（docker改名为-json.log.1，kubelet改名为0.log.时间），按路径固定的日志跟踪改名，
+* log_file的通配符只匹配正在写的文件，新的容器按discover_interval发现
+ */
+type containerLog struct {
+	format   string
+	tags     map[string]string //容器的id、名字等，每行都带
+	stream   string            //最后一条日志的stream
+	partial  map[string][]byte //各stream未结束的长行
+	startAt  map[string]int64  //各stream未结束的长行第一段在文件中的偏移
+	maxBytes int
+	lines    int64 //解出的日志条数
+	joined   int64 //由多段合并的条数
+	invalid  int64 //无法解析、原样发送的行数
+}
+
+var containerKey = "container"
+
+//docker的容器目录
+var dockerContainerRe = regexp.MustCompile(`/containers/([0-9a-f]{64})/`)
+
+var containerIdRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+//kubelet在/var/log/containers下的链接：pod_namespace_容器名-容器id.log
+var criLinkRe = regexp.MustCompile(`^([^_]+)_([^_]+)_(.+)-([0-9a-f]{64})\.log$`)
+
+func defaultContainerPath(format string) string {
+	switch format {
+	case "docker":
+		return "/var/lib/docker/containers/*/*-json.log"
+	case "cri":
+		return "/var/log/pods/*/*/*.log"
+	}
+	return ""
+}
+
+//docker的目录和文件名中都是容器id，通配符匹配到id_id，日志流用短id命名
+func dockerStreamName(part string) string {
+	if i := strings.Index(part, "_"); i > 0 && part[i+1:] == part[:i] {
+		part = part[:i]
+	}
+	if containerIdRe.MatchString(part) {
+		part = part[:12]
+	}
+	return part
+}
+
+//没有配置container时返回nil，日志原样发送
+func newContainerLog(config map[string]string) *containerLog {
+	format := config[containerKey]
+	if format == "" {
+		return nil
+	}
+	if format != "docker" && format != "cri" {
+		loglib.Error("wrong container " + format + ", need docker or cri, send lines as they are")
+		return nil
+	}
+	c := &containerLog{format: format, partial: make(map[string][]byte), startAt: make(map[string]int64), maxBytes: 1024 * 1024}
+	if n, err := strconv.Atoi(config["multiline_max_bytes"]); err == nil && n > 0 {
+		c.maxBytes = n
+	}
+	if format == "docker" {
+		c.tags = dockerTags(config[logFileKey])
+	} else {
+		c.tags = criTags(config[logFileKey])
+	}
+	return c
+}
+
+//从容器目录下的config.v2.json读名字和镜像
+func dockerTags(logPath string) map[string]string {
+	tags := make(map[string]string)
+	m := dockerContainerRe.FindStringSubmatch(logPath)
+	if m == nil {
+		return tags
+	}
+	tags["container_id"] = m[1][:12]
+	var info struct {
+		Name   string
+		Config struct {
+			Image string
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(filepath.Dir(logPath), "config.v2.json"))
+	if err != nil {
+		loglib.Warning("read container config of " + logPath + " error: " + err.Error())
+		return tags
+	}
+	if err = json.Unmarshal(b, &info); err != nil {
+		loglib.Warning("parse container config of " + logPath + " error: " + err.Error())
+		return tags
+	}
+	if name := strings.TrimPrefix(info.Name, "/"); name != "" {
+		tags["container_name"] = name
+	}
+	if info.Config.Image != "" {
+		tags["image"] = info.Config.Image
+	}
+	return tags
+}
+
+//从路径取pod、namespace和容器名，路径为/var/log/pods/namespace_pod_uid/容器名/0.log
+//或者/var/log/containers/pod_namespace_容器名-容器id.log
+func criTags(logPath string) map[string]string {
+	tags := make(map[string]string)
+	if m := criLinkRe.FindStringSubmatch(filepath.Base(logPath)); m != nil {
+		tags["pod"], tags["namespace"], tags["container_name"], tags["container_id"] = m[1], m[2], m[3], m[4][:12]
+		return tags
+	}
+	dir := filepath.Dir(logPath)
+	tags["container_name"] = filepath.Base(dir)
+	if parts := strings.Split(filepath.Base(filepath.Dir(dir)), "_"); len(parts) == 3 {
+		tags["namespace"], tags["pod"] = parts[0], parts[1]
+	}
+	return tags
+}
+
+//解出一行中的日志，长行没有结束时ok为false，start为这一行在文件中的偏移
+//解析不了的行原样返回
+func (this *containerLog) decode(line string, start int64) (string, bool) {
+	var content, stream string
+	var partial, ok bool
+	if this.format == "docker" {
+		content, stream, partial, ok = decodeDocker(line)
+	} else {
+		content, stream, partial, ok = decodeCri(line)
+	}
+	if !ok {
+		this.invalid++
+		return line, true
+	}
+	this.stream = stream
+	buf, joining := this.partial[stream]
+	if partial && len(buf)+len(content) < this.maxBytes {
+		if !joining {
+			this.startAt[stream] = start
+		}
+		this.partial[stream] = append(buf, content...)
+		return "", false
+	}
+	if joining {
+		content = string(buf) + content
+		delete(this.partial, stream)
+		delete(this.startAt, stream)
+		this.joined++
+	}
+	this.lines++
+	return strings.TrimRight(content, "\r\n") + "\n", true
+}
+
+func decodeDocker(line string) (content string, stream string, partial bool, ok bool) {
+	var entry struct {
+		Log    string `json:"log"`
+		Stream string `json:"stream"`
+	}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Stream == "" {
+		return
+	}
+	//超过16k的行被拆开，只有最后一段以换行结尾
+	return entry.Log, entry.Stream, !strings.HasSuffix(entry.Log, "\n"), true
+}
+
+func decodeCri(line string) (content string, stream string, partial bool, ok bool) {
+	line = strings.TrimRight(line, "\r\n")
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) < 3 || (parts[2] != "P" && parts[2] != "F") {
+		return
+	}
+	if len(parts) == 4 {
+		content = parts[3]
+	}
+	return content, parts[1], parts[2] == "P", true
+}
+
+//断点的偏移，有没结束的长行时退到最早的长行的开始，重启后重读
+func (this *containerLog) safeOffset(offset int64) int64 {
+	for _, start := range this.startAt {
+		if start < offset {
+			offset = start
+		}
+	}
+	return offset
+}
+
+//每条日志都带上容器的信息和stream，receiver打包时去重
+func (this *containerLog) fillTags(m map[string]string) {
+	for k, v := range this.tags {
+		m["tag."+k] = v
+	}
+	if this.stream != "" {
+		m["tag.stream"] = this.stream
+	}
+}
+
+func (this *containerLog) String() string {
+	return fmt.Sprintf("container log %s: lines %d, joined %d, invalid %d", this.format, this.lines, this.joined, this.invalid)
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -30,6 +31,8 @@ type etlOutputer struct {
 	etlFailDir    string
 	writers       map[string]*os.File //存日志的fd
 	headerWriters map[string]*os.File //存header的fd
+	byEventTime   bool                //按包头的ebuckets写到日志行时间所在周期的文件
+	closed        map[string]int64    //已经检查完整的周期，按事件时间写时迟到的行写到late目录
 	config        map[string]string
 	ic            *integrity.IntegrityChecker
 	wq            *lib.WaitQuit
@@ -57,12 +60,18 @@ func EtlOutputerInit(buffer chan bytes.Buffer, config map[string]string) (e etlO
 
 	e.writers = make(map[string]*os.File)
 	e.headerWriters = make(map[string]*os.File)
+	e.closed = make(map[string]int64)
 	e.config = config
 	e.wq = lib.NewWaitQuit("etl outputer", -1) //不限退出超时时间，以便etl能做完
 
 	return e
 }
 
+//partition = event时按日志行中的时间写文件，默认按日志文件的周期
+func (e *etlOutputer) SetPartition(config map[string]string) {
+	e.byEventTime = eventPartition(config, e.saveDir)
+}
+
 func (e *etlOutputer) Start() {
 	defer func() {
 		if err := recover(); err != nil {
@@ -128,14 +137,15 @@ func (e *etlOutputer) runEtl(spiderList string, colsFile string, hostsList strin
 			loglib.Error("zlib reader Error: " + err.Error())
 		} else {
 			lines, _ := strconv.Atoi(header["lines"])
+			period, _ := strconv.Atoi(header["period"])
+			dropped, _ := strconv.Atoi(header["dropped"])
 			done := false
 			if header["done"] == "1" {
 				done = true
 			}
-			e.ic.Add(header["ip"], header["hour"], header["id"], lines, done)
+			e.ic.Add(tcp_pack.StreamKey(header), header["hour"], header["id"], lines, dropped, done, header["missing"] == "1", period)
 
-			writerKey := header["ip"] + "_" + header["hour"]
-			fout := e.getWriter(e.writers, e.dataDir, writerKey)
+			writerKey := tcp_pack.StreamKey(header) + "_" + header["hour"]
 
 			buf = append(buf, '\n')
 			/*
@@ -145,13 +155,28 @@ func (e *etlOutputer) runEtl(spiderList string, colsFile string, hostsList strin
 			       loglib.Info(fmt.Sprintf("write %s %d %s", writerKey, n, err.Error()))
 			   }
 			*/
-			nn, err := io.Copy(fout, r)
-			if err != nil {
-				loglib.Warning(fmt.Sprintf("save %s_%s_%s error:%s, saved:%d", header["ip"], header["hour"], header["id"], err, nn))
+			if e.byEventTime {
+				//etl过的周期再收到的行写到late目录，不再etl
+				body, err := ioutil.ReadAll(r)
+				if err != nil {
+					loglib.Warning(fmt.Sprintf("save %s_%s_%s error:%s", tcp_pack.StreamKey(header), header["hour"], header["id"], err))
+				}
+				writeByEventTime(header, body, e.closed, func(late bool, key string) *os.File {
+					if late {
+						return e.getWriter(e.writers, e.saveDir, filepath.Join("late", key))
+					}
+					return e.getWriter(e.writers, e.dataDir, key)
+				})
+			} else {
+				fout := e.getWriter(e.writers, e.dataDir, writerKey)
+				nn, err := io.Copy(fout, r)
+				if err != nil {
+					loglib.Warning(fmt.Sprintf("save %s_%s_%s error:%s, saved:%d", tcp_pack.StreamKey(header), header["hour"], header["id"], err, nn))
+				}
 			}
 			//fout.Write(buf)
 			//单独存一份header便于查数
-			fout = e.getWriter(e.headerWriters, e.headerDir, writerKey)
+			fout := e.getWriter(e.headerWriters, e.headerDir, writerKey)
 			n, err := fout.Write(buf)
 			if err != nil {
 				loglib.Info(fmt.Sprintf("writer header %s %d %s", writerKey, n, err.Error()))
@@ -166,6 +191,7 @@ func (e *etlOutputer) runEtl(spiderList string, colsFile string, hostsList strin
 						fkeyChan <- writerKey
 					}
 				}
+				markClosed(e.closed, hourFinish)
 				e.closeWriters(e.writers)
 				e.closeWriters(e.headerWriters)
 				e.ic.SaveStatus()
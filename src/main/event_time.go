@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"lib"
+	"loglib"
+	"tcp_pack"
+)
+
+/*
+* 按日志行中的时间（事件时间）划分周期
+* tail端配置event_time = true后，receiver按time_pattern和time_layout解析每行的时间，
+* 在包头中写入：
+*   et_min、et_max  本包中事件时间的范围
+*   ebuckets        按行的顺序，各行事件时间所在周期的key及行数，如2026101723:120,2026101800:80
+*   late            事件时间早于文件周期的行数，即迟到的行
+* 解析不出时间的行跟随上一行，第一行解析不出时按文件的周期
+* 收集端配置partition = event时按ebuckets把包拆开，写到事件时间所在周期的文件，
+* 已经检查完整的周期再收到迟到的行时写到late目录，不混进已经完成的文件
+ */
+type eventBuckets struct {
+	parser *timeParser
+	period lib.Period
+	keys   []string
+	counts []int
+	min    time.Time
+	max    time.Time
+	late   int
+}
+
+var etLayout = "2006-01-02 15:04:05"
+
+//没有配置event_time时返回nil
+func newEventBuckets(config map[string]string, period lib.Period) *eventBuckets {
+	if v := config["event_time"]; v != "true" && v != "on" {
+		return nil
+	}
+	return &eventBuckets{parser: newTimeParser(config), period: period}
+}
+
+//hour为这一行所在文件的周期
+func (this *eventBuckets) add(line string, hour string) {
+	key := hour
+	if len(this.keys) > 0 {
+		key = this.keys[len(this.keys)-1]
+	}
+	if t, ok := this.parser.parse(line); ok {
+		key = this.period.Key(t)
+		if this.min.IsZero() || t.Before(this.min) {
+			this.min = t
+		}
+		if t.After(this.max) {
+			this.max = t
+		}
+	}
+	//多行合并的日志按其中的换行符计数，收集端按换行符拆分
+	w := strings.Count(line, "\n")
+	if w == 0 {
+		w = 1
+	}
+	if periodBefore(key, hour) {
+		this.late += w
+	}
+	if n := len(this.keys); n > 0 && this.keys[n-1] == key {
+		this.counts[n-1] += w
+		return
+	}
+	this.keys = append(this.keys, key)
+	this.counts = append(this.counts, w)
+}
+
+//a的周期是否早于b，key的长度随周期不同，按开始时间比较
+func periodBefore(a string, b string) bool {
+	if a == b {
+		return false
+	}
+	ta, err := lib.ParsePeriodKey(a)
+	if err != nil {
+		return false
+	}
+	tb, err := lib.ParsePeriodKey(b)
+	if err != nil {
+		return false
+	}
+	return ta.Before(tb)
+}
+
+//写入包头并清空
+func (this *eventBuckets) fill(m map[string]string) {
+	if len(this.keys) > 0 {
+		parts := make([]string, len(this.keys))
+		for i, k := range this.keys {
+			parts[i] = fmt.Sprintf("%s:%d", k, this.counts[i])
+		}
+		m["ebuckets"] = strings.Join(parts, ",")
+	}
+	if !this.min.IsZero() {
+		m["et_min"] = this.min.Format(etLayout)
+		m["et_max"] = this.max.Format(etLayout)
+	}
+	if this.late > 0 {
+		m["late"] = strconv.Itoa(this.late)
+	}
+	this.keys = this.keys[:0]
+	this.counts = this.counts[:0]
+	this.min, this.max = time.Time{}, time.Time{}
+	this.late = 0
+}
+
+type eventPart struct {
+	hour string
+	data []byte
+}
+
+//按包头的ebuckets把包体按行拆开，没有ebuckets或者与行数对不上时整个包属于文件的周期
+func splitByEventTime(header map[string]string, body []byte) []eventPart {
+	whole := []eventPart{{header["hour"], body}}
+	if header["ebuckets"] == "" {
+		return whole
+	}
+	parts := make([]eventPart, 0)
+	pos := 0
+	for _, b := range strings.Split(header["ebuckets"], ",") {
+		i := strings.LastIndex(b, ":")
+		if i < 0 {
+			return whole
+		}
+		n, err := strconv.Atoi(b[i+1:])
+		if err != nil {
+			return whole
+		}
+		//与包头的行数对不上时不拆
+		end := pos
+		for j := 0; j < n; j++ {
+			k := bytes.IndexByte(body[end:], '\n')
+			if k < 0 && j == n-1 {
+				//文件末尾没有换行符的半行
+				end = len(body)
+				break
+			} else if k < 0 {
+				return whole
+			}
+			end += k + 1
+		}
+		parts = append(parts, eventPart{b[:i], body[pos:end]})
+		pos = end
+	}
+	if pos != len(body) {
+		return whole
+	}
+	return parts
+}
+
+//按事件时间写包体，closed为已经检查完整的周期（ip_hour），迟到的行写到late目录
+func writeByEventTime(header map[string]string, body []byte, closed map[string]int64, getWriter func(late bool, key string) *os.File) {
+	streamKey := tcp_pack.StreamKey(header)
+	for _, p := range splitByEventTime(header, body) {
+		key := streamKey + "_" + p.hour
+		_, late := closed[key]
+		if late {
+			loglib.Info(fmt.Sprintf("pack %s_%s_%s has %d bytes late for closed %s", streamKey, header["hour"], header["id"], len(p.data), key))
+		}
+		fout := getWriter(late, key)
+		if _, err := fout.Write(p.data); err != nil {
+			loglib.Warning(fmt.Sprintf("save %s_%s_%s to %s error:%s", streamKey, header["hour"], header["id"], key, err))
+		}
+	}
+}
+
+//收集端的partition配置，按事件时间写时建好late目录
+func eventPartition(config map[string]string, saveDir string) bool {
+	if config["partition"] != "event" {
+		return false
+	}
+	os.MkdirAll(filepath.Join(saveDir, "late"), 0775)
+	return true
+}
+
+//记录检查完整的周期，清理4天前的
+func markClosed(closed map[string]int64, hourFinish map[string][]string) {
+	now := time.Now().Unix()
+	for ip, hours := range hourFinish {
+		for _, hour := range hours {
+			closed[ip+"_"+hour] = now
+		}
+	}
+	for k, t := range closed {
+		if now-t > 86400*4 {
+			delete(closed, k)
+		}
+	}
+}
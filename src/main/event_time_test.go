@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"lib"
+)
+
+func TestPeriodBefore(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2026101722", "2026101723", true},
+		{"2026101723", "2026101723", false},
+		{"2026101800", "2026101723", false},
+		//长度不同时不能按字符串比较
+		{"20261017", "2026101723", true},
+		{"2026101723", "20261018", true},
+		{"202610172359", "2026101800", true},
+		{"20261018", "2026101723", false},
+		{"bad", "2026101723", false},
+		{"2026101723", "bad", false},
+	}
+	for _, tt := range tests {
+		if got := periodBefore(tt.a, tt.b); got != tt.want {
+			t.Errorf("periodBefore(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestEventBuckets(t *testing.T) {
+	config := map[string]string{"event_time": "true", "time_layout": etLayout}
+	tests := []struct {
+		name   string
+		period lib.Period
+		hour   string
+		lines  []string
+		want   map[string]string
+	}{
+		{"in period", lib.Hourly, "2026101723", []string{"2026-10-17 23:00:01 a", "2026-10-17 23:59:59 b"},
+			map[string]string{"ebuckets": "2026101723:2", "et_min": "2026-10-17 23:00:01", "et_max": "2026-10-17 23:59:59"}},
+		{"late and next", lib.Hourly, "2026101723", []string{"2026-10-17 22:59:59 a", "no time", "2026-10-18 00:00:00 b"},
+			map[string]string{"ebuckets": "2026101722:2,2026101800:1", "et_min": "2026-10-17 22:59:59", "et_max": "2026-10-18 00:00:00", "late": "2"}},
+		{"no time", lib.Hourly, "2026101723", []string{"x", "y\nz\n"},
+			map[string]string{"ebuckets": "2026101723:3"}},
+		{"daily", lib.Daily, "20261018", []string{"2026-10-17 23:00:00 a", "2026-10-18 01:00:00 b"},
+			map[string]string{"ebuckets": "20261017:1,20261018:1", "et_min": "2026-10-17 23:00:00", "et_max": "2026-10-18 01:00:00", "late": "1"}},
+	}
+	for _, tt := range tests {
+		eb := newEventBuckets(config, tt.period)
+		for _, l := range tt.lines {
+			eb.add(l, tt.hour)
+		}
+		got := make(map[string]string)
+		eb.fill(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if newEventBuckets(map[string]string{}, lib.Hourly) != nil {
+		t.Error("event_time not configured: want nil")
+	}
+}
+
+func TestSplitByEventTime(t *testing.T) {
+	body := []byte("a\nb\nc\nd")
+	tests := []struct {
+		name     string
+		ebuckets string
+		want     []eventPart
+	}{
+		{"no ebuckets", "", []eventPart{{"2026101723", body}}},
+		{"split", "2026101722:1,2026101723:2,2026101800:1", []eventPart{{"2026101722", []byte("a\n")}, {"2026101723", []byte("b\nc\n")}, {"2026101800", []byte("d")}}},
+		{"too few lines", "2026101722:2", []eventPart{{"2026101723", body}}},
+		{"too many lines", "2026101722:5", []eventPart{{"2026101723", body}}},
+		{"wrong count", "2026101722:x", []eventPart{{"2026101723", body}}},
+	}
+	for _, tt := range tests {
+		got := splitByEventTime(map[string]string{"hour": "2026101723", "ebuckets": tt.ebuckets}, body)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -25,6 +26,8 @@ type fileOutputer struct {
 	icDir         string
 	writers       map[string]*os.File //存日志的fd
 	headerWriters map[string]*os.File //存header的fd
+	byEventTime   bool                //按包头的ebuckets写到日志行时间所在周期的文件
+	closed        map[string]int64    //已经检查完整的周期，按事件时间写时迟到的行写到late目录
 	ic            *integrity.IntegrityChecker
 	checkTime     time.Time
 
@@ -46,6 +49,7 @@ func FileOutputerInit(buffer chan bytes.Buffer, saveDir string) (f fileOutputer)
 
 	f.writers = make(map[string]*os.File)
 	f.headerWriters = make(map[string]*os.File)
+	f.closed = make(map[string]int64)
 	f.checkTime = time.Now().Add(2 * time.Minute)
 
 	f.wq = lib.NewWaitQuit("file outputer", -1)
@@ -90,26 +94,41 @@ func (f *fileOutputer) extract(bp *bytes.Buffer) {
 		loglib.Error("zlib reader Error: " + err.Error())
 	} else {
 		lines, _ := strconv.Atoi(header["lines"])
+		period, _ := strconv.Atoi(header["period"])
+		dropped, _ := strconv.Atoi(header["dropped"])
 		done := false
 		if header["done"] == "1" {
 			done = true
 		}
-		f.ic.Add(header["ip"], header["hour"], header["id"], lines, done)
+		f.ic.Add(tcp_pack.StreamKey(header), header["hour"], header["id"], lines, dropped, done, header["missing"] == "1", period)
 
-		writerKey := header["ip"] + "_" + header["hour"]
-		fout := f.getWriter(f.writers, f.dataDir, writerKey)
+		writerKey := tcp_pack.StreamKey(header) + "_" + header["hour"]
 
 		//一头一尾写头信息，节省硬盘
 		buf = append(buf, '\n')
 		//fout.Write(buf)
-		nn, err := io.Copy(fout, r)
-		if err != nil {
-			loglib.Warning(fmt.Sprintf("save %s_%s_%s error:%s, saved:%d", header["ip"], header["hour"], header["id"], err, nn))
+		if f.byEventTime {
+			body, err := ioutil.ReadAll(r)
+			if err != nil {
+				loglib.Warning(fmt.Sprintf("save %s_%s_%s error:%s", tcp_pack.StreamKey(header), header["hour"], header["id"], err))
+			}
+			writeByEventTime(header, body, f.closed, func(late bool, key string) *os.File {
+				if late {
+					return f.getWriter(f.writers, f.saveDir, filepath.Join("late", key))
+				}
+				return f.getWriter(f.writers, f.dataDir, key)
+			})
+		} else {
+			fout := f.getWriter(f.writers, f.dataDir, writerKey)
+			nn, err := io.Copy(fout, r)
+			if err != nil {
+				loglib.Warning(fmt.Sprintf("save %s_%s_%s error:%s, saved:%d", tcp_pack.StreamKey(header), header["hour"], header["id"], err, nn))
+			}
 		}
 		//fout.Write(buf)
 
 		//单独存一份header便于查数
-		fout = f.getWriter(f.headerWriters, f.headerDir, writerKey)
+		fout := f.getWriter(f.headerWriters, f.headerDir, writerKey)
 		n, err := fout.Write(buf)
 		if err != nil {
 			loglib.Info(fmt.Sprintf("writer header %s %d %s", writerKey, n, err.Error()))
@@ -122,6 +141,7 @@ func (f *fileOutputer) extract(bp *bytes.Buffer) {
 					writerKey = ip + "_" + hour
 				}
 			}
+			markClosed(f.closed, hourFinish)
 			f.closeWriters(f.writers)
 			f.closeWriters(f.headerWriters)
 			f.checkTime.Add(2 * time.Minute)
@@ -131,6 +151,11 @@ func (f *fileOutputer) extract(bp *bytes.Buffer) {
 	}
 }
 
+//partition = event时按日志行中的时间写文件，默认按日志文件的周期
+func (f *fileOutputer) SetPartition(config map[string]string) {
+	f.byEventTime = eventPartition(config, f.saveDir)
+}
+
 func (f *fileOutputer) getWriter(writers map[string]*os.File, parentDir string, key string) *os.File {
 	w, ok := writers[key]
 	if !ok || w == nil {
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"loglib"
+)
+
+/*
+* fluentd/fluent bit的forward协议：logd forward config.ini
+* [forward]中配置tcp（监听地址，fluent的默认端口为24224）、unix至少一个，
+* 支持Message、Forward、PackedForward和CompressedPackedForward四种模式，option中带chunk时在收下后应答ack
+* 每个事件的record转为一行json，配置message_key（如fluent bit tail的log）时只发送这个字段的值，
+* 按事件的时间划分周期，包头的tag为包中各事件的tag，et_min、et_max为事件时间的范围，没有时间的事件按收到的时间
+* 一条消息（CompressedPackedForward按解压后的）超过max_message_bytes时断开连接，发送方会重发
+* 不支持shared key认证
+ */
+type forwardServer struct {
+	sink       *lineSink
+	messageKey string
+	maxMessage int64 //一条消息最多的字节数
+	srv        *connServer
+}
+
+var errForward = errors.New("wrong forward message")
+
+const defaultMaxMessage = 64 << 20
+
+func forwardGo(cfg map[string]map[string]string) {
+	config := inputConfig(cfg, "forward")
+	name := config["source"]
+	if name == "" {
+		name = "forward"
+	}
+	sink := newLineSink(name, config)
+	maxMessage := int64(defaultMaxMessage)
+	if val := config["max_message_bytes"]; val != "" {
+		if n, err := parseBytes(val); err == nil && n > 0 {
+			maxMessage = n
+		} else {
+			loglib.Error("[forward] wrong max_message_bytes " + val)
+		}
+	}
+	servers := make([]inputServer, 0)
+	for _, network := range []string{"unix", "tcp"} {
+		if addr := config[network]; addr != "" {
+			fs := &forwardServer{sink: sink, messageKey: config["message_key"], maxMessage: maxMessage}
+			fs.srv = newConnServer("forward", network, addr, fs.handleConn)
+			servers = append(servers, fs.srv)
+		}
+	}
+	if len(servers) == 0 {
+		loglib.Error("[forward] need tcp or unix!")
+		os.Exit(1)
+	}
+	runInput("forward", cfg, config, sink, servers)
+}
+
+func (this *forwardServer) handleConn(conn net.Conn) {
+	rd := newMsgpackReader(conn, this.maxMessage)
+	for {
+		rd.Reset()
+		msg, err := rd.Read()
+		if err == nil {
+			err = this.handleMessage(conn, msg)
+		}
+		if err != nil {
+			if err != io.EOF && !this.srv.quitting() {
+				loglib.Warning(fmt.Sprintf("forward conn %s error: %s", conn.RemoteAddr(), err.Error()))
+			}
+			return
+		}
+	}
+}
+
+//[tag, time, record, option]、[tag, [[time, record], ...], option]、[tag, entries, option]
+func (this *forwardServer) handleMessage(conn net.Conn, msg interface{}) error {
+	arr, ok := msg.([]interface{})
+	if !ok || len(arr) < 2 {
+		return errForward
+	}
+	tag, ok := arr[0].(string)
+	if !ok {
+		return errForward
+	}
+	var option map[string]interface{}
+	var lines []inputLine
+	var err error
+	switch entries := arr[1].(type) {
+	case []interface{}:
+		//Forward
+		if len(arr) > 2 {
+			option, _ = arr[2].(map[string]interface{})
+		}
+		for _, e := range entries {
+			l, err := this.entryLine(tag, e)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, l)
+		}
+	case string:
+		//PackedForward，entries是连在一起的msgpack编码的[time, record]
+		if len(arr) > 2 {
+			option, _ = arr[2].(map[string]interface{})
+		}
+		var rd io.Reader = strings.NewReader(entries)
+		if c, _ := option["compressed"].(string); c == "gzip" {
+			gz, err := gzip.NewReader(rd)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			//解压后的大小也受max_message_bytes限制
+			rd = &capReader{gz, this.maxMessage}
+		}
+		if lines, err = this.packedLines(tag, rd); err != nil {
+			return err
+		}
+	default:
+		//Message
+		if len(arr) < 3 {
+			return errForward
+		}
+		if len(arr) > 3 {
+			option, _ = arr[3].(map[string]interface{})
+		}
+		l, err := this.entryLine(tag, []interface{}{arr[1], arr[2]})
+		if err != nil {
+			return err
+		}
+		lines = append(lines, l)
+	}
+	//整个消息解析成功后才接收，出错时发送方重发不会重复
+	for _, l := range lines {
+		this.sink.Add(l.t, l.line, l.tags)
+	}
+	//事件交给lineSink后才应答，发送方收到ack前断开会重发
+	if chunk, ok := option["chunk"].(string); ok && chunk != "" {
+		_, err = conn.Write(msgpackAck(chunk))
+	}
+	return err
+}
+
+func (this *forwardServer) packedLines(tag string, rd io.Reader) ([]inputLine, error) {
+	lines := make([]inputLine, 0)
+	//不按entry重置，所有entry加起来不超过maxMsgpackElems个值、max_message_bytes字节
+	mr := newMsgpackReader(rd, this.maxMessage)
+	for {
+		e, err := mr.Read()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		l, err := this.entryLine(tag, e)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+}
+
+//[time, record]
+func (this *forwardServer) entryLine(tag string, entry interface{}) (inputLine, error) {
+	e, ok := entry.([]interface{})
+	if !ok || len(e) < 2 {
+		return inputLine{}, errForward
+	}
+	record, ok := e[1].(map[string]interface{})
+	if !ok {
+		return inputLine{}, errForward
+	}
+	var line string
+	if msg, ok := record[this.messageKey].(string); ok && this.messageKey != "" {
+		line = msg
+	} else {
+		b, err := json.Marshal(record)
+		if err != nil {
+			//NaN等无法转为json的值
+			b = []byte(fmt.Sprintf("%v", record))
+		}
+		line = string(b)
+	}
+	line = escapeNewline(strings.TrimRight(line, "\r\n")) + "\n"
+	return inputLine{t: forwardTime(e[0]), line: line, tags: map[string]string{"tag": tag}}, nil
+}
+
+//时间为整数秒、浮点数或者EventTime（ext类型0，4字节秒和4字节纳秒），没有时间或者不大于0时用当前时间
+func forwardTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case int64:
+		if t > 0 {
+			return time.Unix(t, 0)
+		}
+	case uint64:
+		if t <= math.MaxInt64 {
+			return time.Unix(int64(t), 0)
+		}
+	case float64:
+		if t > 0 && t < math.MaxInt64/1e9 {
+			return time.Unix(0, int64(t*1e9))
+		}
+	case msgpackExt:
+		if t.typ == 0 && len(t.data) == 8 {
+			if sec := binary.BigEndian.Uint32(t.data); sec > 0 {
+				return time.Unix(int64(sec), int64(binary.BigEndian.Uint32(t.data[4:])))
+			}
+		}
+	}
+	return time.Now()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//只记录写出的应答
+type fakeConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (this *fakeConn) Write(b []byte) (int, error) {
+	return this.out.Write(b)
+}
+
+func newTestForward(t *testing.T, maxMessage int64) *forwardServer {
+	config := map[string]string{recordFileKey: filepath.Join(t.TempDir(), "forward.rec")}
+	return &forwardServer{sink: newLineSink("forward_test", config), messageKey: "log", maxMessage: maxMessage}
+}
+
+//sink中排队的行
+func sinkLines(s *lineSink) []map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lines := make([]map[string]string, 0)
+	for _, item := range s.queue {
+		if item.line {
+			lines = append(lines, item.m)
+		}
+	}
+	return lines
+}
+
+func eventTime(sec uint32) msgpackExt {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, sec)
+	return msgpackExt{0, b}
+}
+
+func gzipString(t *testing.T, s []byte) string {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write(s)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestForwardModes(t *testing.T) {
+	now := time.Now()
+	sec := int(now.Add(-time.Minute).Unix())
+	rec1 := map[string]interface{}{"log": "first\n"}
+	rec2 := map[string]interface{}{"a": 1}
+	entries := append(mpEncode([]interface{}{sec, rec1}), mpEncode([]interface{}{eventTime(uint32(sec)), rec2})...)
+	tests := []struct {
+		name  string
+		msg   []interface{}
+		lines []string
+		ack   string
+	}{
+		{"Message", []interface{}{"app", sec, rec1}, []string{"first\n"}, ""},
+		{"Message with chunk", []interface{}{"app", sec, rec2, map[string]interface{}{"chunk": "c1"}}, []string{`{"a":1}` + "\n"}, "c1"},
+		{"Forward", []interface{}{"app", []interface{}{[]interface{}{sec, rec1}, []interface{}{sec, rec2}}, map[string]interface{}{"chunk": "c2"}}, []string{"first\n", `{"a":1}` + "\n"}, "c2"},
+		{"PackedForward", []interface{}{"app", string(entries)}, []string{"first\n", `{"a":1}` + "\n"}, ""},
+		{"CompressedPackedForward", []interface{}{"app", gzipString(t, entries), map[string]interface{}{"compressed": "gzip", "chunk": "c3"}}, []string{"first\n", `{"a":1}` + "\n"}, "c3"},
+	}
+	for _, tt := range tests {
+		fs := newTestForward(t, 1<<20)
+		conn := &fakeConn{}
+		rd := newMsgpackReader(bytes.NewReader(mpEncode(tt.msg)), fs.maxMessage)
+		msg, err := rd.Read()
+		if err == nil {
+			err = fs.handleMessage(conn, msg)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := sinkLines(fs.sink)
+		if len(got) != len(tt.lines) {
+			t.Errorf("%s: got %d lines, want %d", tt.name, len(got), len(tt.lines))
+			continue
+		}
+		for i, m := range got {
+			if m["line"] != tt.lines[i] || m["tag.tag"] != "app" {
+				t.Errorf("%s: line %d got %q tag %q", tt.name, i, m["line"], m["tag.tag"])
+			}
+			if want := time.Unix(int64(sec), 0).Format(etLayout); m["time"] != want {
+				t.Errorf("%s: line %d time %q, want %q", tt.name, i, m["time"], want)
+			}
+		}
+		var ack []byte
+		if tt.ack != "" {
+			ack = msgpackAck(tt.ack)
+		}
+		if !bytes.Equal(conn.out.Bytes(), ack) {
+			t.Errorf("%s: ack %q, want %q", tt.name, conn.out.Bytes(), ack)
+		}
+	}
+}
+
+func TestForwardWrongMessage(t *testing.T) {
+	big := string(bytes.Repeat([]byte{'x'}, 4096))
+	packed := mpEncode([]interface{}{1, map[string]interface{}{"log": big}})
+	tests := []struct {
+		name string
+		msg  []interface{}
+	}{
+		{"no entries", []interface{}{"app"}},
+		{"tag not string", []interface{}{1, 2, map[string]interface{}{}}},
+		{"Message without record", []interface{}{"app", 1}},
+		{"record not map", []interface{}{"app", 1, "x"}},
+		{"entry not array", []interface{}{"app", []interface{}{1}}},
+		{"packed garbage", []interface{}{"app", "\xc1"}},
+		{"packed truncated", []interface{}{"app", string(packed[:len(packed)-1])}},
+		//解压后超过max_message_bytes
+		{"compressed too large", []interface{}{"app", gzipString(t, bytes.Repeat(packed, 2)), map[string]interface{}{"compressed": "gzip"}}},
+	}
+	for _, tt := range tests {
+		fs := newTestForward(t, 8000)
+		msg, err := newMsgpackReader(bytes.NewReader(mpEncode(tt.msg)), fs.maxMessage).Read()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := fs.handleMessage(&fakeConn{}, msg); err == nil {
+			t.Errorf("%s: want error", tt.name)
+		}
+		//出错的消息一行也不接收
+		if n := len(sinkLines(fs.sink)); n != 0 {
+			t.Errorf("%s: %d lines added", tt.name, n)
+		}
+	}
+}
+
+func TestForwardTime(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want time.Time
+	}{
+		{"int", int64(1500000000), time.Unix(1500000000, 0)},
+		{"uint", uint64(1500000000), time.Unix(1500000000, 0)},
+		{"float", 1500000000.5, time.Unix(1500000000, 5e8)},
+		{"EventTime", msgpackExt{0, []byte{0x59, 0x68, 0x2f, 0x00, 0, 0, 0, 10}}, time.Unix(1500000000, 10)},
+		{"missing", nil, time.Time{}},
+		{"zero", int64(0), time.Time{}},
+		{"negative", int64(-5), time.Time{}},
+		{"negative float", -1.5, time.Time{}},
+		{"zero EventTime", eventTime(0), time.Time{}},
+		{"other ext", msgpackExt{1, make([]byte, 8)}, time.Time{}},
+		{"string", "1500000000", time.Time{}},
+	}
+	for _, tt := range tests {
+		before := time.Now()
+		got := forwardTime(tt.v)
+		if tt.want.IsZero() {
+			//用当前时间
+			if got.Before(before) || got.After(time.Now()) {
+				t.Errorf("%s: got %v, want now", tt.name, got)
+			}
+		} else if !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"lib"
+	"loglib"
+)
+
+/*
+* agent的资源限制，配置在[tail]中，避免和所在机器上的服务抢资源
+*   max_procs         最多使用的cpu核数，默认全部
+*   nice              进程的nice值，如10，默认不调整
+*   max_queued_bytes  打好的包还没有发送（或写入缓存文件）时最多占用的字节数，支持k、m、g后缀，
+*                     超过时tail暂停读取，默认不限制，不能小于一个包（recv_buffer_size行，每行按1k估算）
+* receiver打包后按包的大小占用，sender发送成功或写入缓存文件后释放；还没凑满一个包的行不占用，
+* 否则上限小于各日志源不满的包之和时，tailer等不到打包，整个流程停住
+* 每分钟打印一次排队的字节数和因各种限制暂停的累计时间
+ */
+var queueBudget = lib.NewByteBudget(0)
+
+//检查max_queued_bytes时每行按这么多字节估算一个包的大小
+const minQueuedLineBytes = 1024
+
+func initGovernor(config map[string]string) {
+	if n := atoiDefault(config["max_procs"], 0); n > 0 {
+		runtime.GOMAXPROCS(n)
+		loglib.Info(fmt.Sprintf("max procs: %d", n))
+	}
+	if val := config["nice"]; val != "" {
+		if n, err := strconv.Atoi(val); err != nil {
+			loglib.Error("wrong nice " + val)
+		} else {
+			setNice(n)
+		}
+	}
+	if val := config["max_queued_bytes"]; val != "" {
+		n, err := parseBytes(val)
+		if err != nil {
+			loglib.Error("wrong max_queued_bytes " + val)
+		} else {
+			if least := int64(atoiDefault(config["recv_buffer_size"], 2000)) * minQueuedLineBytes; n < least {
+				loglib.Error(fmt.Sprintf("max_queued_bytes %s is less than one pack, use %d", val, least))
+				n = least
+			}
+			queueBudget = lib.NewByteBudget(n)
+			loglib.Info(fmt.Sprintf("max queued bytes: %d", n))
+		}
+	}
+	go reportThrottled()
+}
+
+//linux下nice值是按线程的，对已有的每个线程都设置，之后创建的线程会继承
+func setNice(n int) {
+	tids := []int{os.Getpid()}
+	if fis, err := ioutil.ReadDir("/proc/self/task"); err == nil {
+		tids = tids[:0]
+		for _, fi := range fis {
+			if tid, err := strconv.Atoi(fi.Name()); err == nil {
+				tids = append(tids, tid)
+			}
+		}
+	}
+	for _, tid := range tids {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, n); err != nil {
+			loglib.Error(fmt.Sprintf("set nice %d of thread %d error: %s", n, tid, err.Error()))
+			return
+		}
+	}
+	loglib.Info(fmt.Sprintf("nice: %d", n))
+}
+
+//如64m、1g、4096
+func parseBytes(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * unit, nil
+}
+
+//goroutine
+func reportThrottled() {
+	for range time.Tick(time.Minute) {
+		used, waited := queueBudget.Stat()
+		loglib.Info(fmt.Sprintf("governor: queued bytes %d/%d, throttled by queue %s, tail rate %s, catch-up rate %s, send rate %s", used, queueBudget.Max(), waited, liveLimiter.Waited(), catchupLimiter.Waited(), sendLimiter.Waited()))
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"loglib"
+)
+
+/*
+* http输入：logd http config.ini
+* POST到[http]的path（默认/），body为按换行分隔的文本，Content-Type为application/json时为json数组，
+* 数组元素为字符串时作为一行，否则把元素的json作为一行，行中的换行转为\n
+* Content-Encoding: gzip时先解压
+* 配置了token时需要带Authorization: Bearer <token>或X-Log-Token，多个token用逗号分隔；
+* 配置了basic_auth（user:password）时需要basic认证，两者都配置时满足一个即可
+* 排队的日志放不下整个请求的行时返回429，客户端稍后重试；body（gzip时为解压后的）超过max_body_bytes或者行数超过10000时返回413
+ */
+type httpInput struct {
+	addr      string
+	path      string
+	tokens    []string
+	basicUser string
+	basicPass string
+	maxBody   int64
+	config    map[string]string
+	sink      *lineSink
+	decode    func(req *http.Request, body io.Reader) ([]inputLine, error) //解析请求body
+	respond   func(w http.ResponseWriter, req *http.Request, n int)        //接收成功后的应答，n为接收的条数
+	srv       *http.Server
+	accepted  int64
+	rejected  int64
+	wq        *serverWaitQuit
+}
+
+//一条日志，t为0时按收到的时间，tags写到包头
+type inputLine struct {
+	t    time.Time
+	line string
+	tags map[string]string
+}
+
+func httpGo(cfg map[string]map[string]string) {
+	h := newHttpInput(cfg, "http", "/")
+	h.decode = decodeLines
+	h.respond = func(w http.ResponseWriter, req *http.Request, n int) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{\"accepted\":%d}\n", n)
+	}
+	runInput("http", cfg, h.config, h.sink, []inputServer{h})
+}
+
+//section为配置的段名，也是默认的source
+func newHttpInput(cfg map[string]map[string]string, section string, path string) *httpInput {
+	config := inputConfig(cfg, section)
+	name := config["source"]
+	if name == "" {
+		name = section
+	}
+	if config["listen"] == "" {
+		loglib.Error("[" + section + "] need listen!")
+		os.Exit(1)
+	}
+	sink := newLineSink(name, config)
+	h := &httpInput{addr: config["listen"], path: config["path"], config: config, sink: sink, maxBody: 10 << 20, wq: newServerWaitQuit(section + " input")}
+	if h.path == "" {
+		h.path = path
+	}
+	for _, t := range strings.Split(config["token"], ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			h.tokens = append(h.tokens, t)
+		}
+	}
+	if val := config["basic_auth"]; val != "" {
+		i := strings.Index(val, ":")
+		if i < 0 {
+			loglib.Error("wrong basic_auth, need user:password")
+			os.Exit(1)
+		}
+		h.basicUser, h.basicPass = val[:i], val[i+1:]
+	}
+	if val := config["max_body_bytes"]; val != "" {
+		if n, err := parseBytes(val); err == nil && n > 0 {
+			h.maxBody = n
+		}
+	}
+	return h
+}
+
+func (this *httpInput) Start() {
+	defer this.wq.done()
+	ln, err := net.Listen("tcp", this.addr)
+	if err != nil {
+		loglib.Error(this.sink.name + " input listen " + this.addr + " error: " + err.Error())
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(this.path, this.handle)
+	this.srv = &http.Server{Handler: mux, ReadTimeout: time.Minute, WriteTimeout: time.Minute}
+	if !this.wq.started(httpCloser{this.srv}) {
+		ln.Close()
+		return
+	}
+	loglib.Info(this.sink.name + " input listen " + this.addr + this.path)
+	if err = this.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		loglib.Error(this.sink.name + " input serve error: " + err.Error())
+	}
+	loglib.Info(fmt.Sprintf("%s input accepted lines: %d, rejected requests: %d", this.sink.name, atomic.LoadInt64(&this.accepted), atomic.LoadInt64(&this.rejected)))
+}
+
+func (this *httpInput) Quit() bool {
+	return this.wq.quit()
+}
+
+//退出时等正在处理的请求结束
+type httpCloser struct {
+	srv *http.Server
+}
+
+func (this httpCloser) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return this.srv.Shutdown(ctx)
+}
+
+func (this *httpInput) handle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !this.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="logd"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if this.sink.Busy() {
+		atomic.AddInt64(&this.rejected, 1)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many logs queued, retry later", http.StatusTooManyRequests)
+		return
+	}
+	var body io.Reader = http.MaxBytesReader(w, req.Body, this.maxBody)
+	if strings.Contains(req.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, "bad gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	//解压后的大小同样限制，多读一个字节判断是否超过，超过时返回413而不是截断
+	b, err := ioutil.ReadAll(io.LimitReader(body, this.maxBody+1))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || int64(len(b)) > this.maxBody {
+		http.Error(w, fmt.Sprintf("body larger than %d bytes", this.maxBody), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "bad body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	lines, err := this.decode(req, bytes.NewReader(b))
+	if err != nil {
+		http.Error(w, "bad body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(lines) > this.sink.Capacity() {
+		http.Error(w, fmt.Sprintf("more than %d lines in one request", this.sink.Capacity()), http.StatusRequestEntityTooLarge)
+		return
+	}
+	//整个请求解析成功后才接收，客户端出错重试时不会重复；放不下时整个请求返回429，不能在请求中阻塞
+	if !this.sink.TryAdd(lines) {
+		atomic.AddInt64(&this.rejected, 1)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many logs queued, retry later", http.StatusTooManyRequests)
+		return
+	}
+	atomic.AddInt64(&this.accepted, int64(len(lines)))
+	this.respond(w, req, len(lines))
+}
+
+func (this *httpInput) authorized(req *http.Request) bool {
+	if len(this.tokens) == 0 && this.basicUser == "" {
+		return true
+	}
+	token := req.Header.Get("X-Log-Token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimSpace(auth[7:])
+	}
+	for _, t := range this.tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	if this.basicUser != "" {
+		user, pass, ok := req.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(user), []byte(this.basicUser)) == 1 && subtle.ConstantTimeCompare([]byte(pass), []byte(this.basicPass)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+//按换行分隔的文本或者json数组
+func decodeLines(req *http.Request, body io.Reader) ([]inputLine, error) {
+	var lines []string
+	var err error
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		lines, err = jsonLines(body)
+	} else {
+		lines, err = textLines(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make([]inputLine, len(lines))
+	for i, line := range lines {
+		result[i].line = line
+	}
+	return result, nil
+}
+
+func textLines(body io.Reader) ([]string, error) {
+	lines := make([]string, 0)
+	rd := bufio.NewReaderSize(body, 64*1024)
+	for {
+		line, err := rd.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			lines = append(lines, line+"\n")
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func jsonLines(body io.Reader) ([]string, error) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(body).Decode(&items); err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0, len(items))
+	for _, item := range items {
+		var s string
+		if err := json.Unmarshal(item, &s); err != nil {
+			//不是字符串，整个元素作为一行
+			var buf bytes.Buffer
+			if err = json.Compact(&buf, item); err != nil {
+				return nil, err
+			}
+			s = buf.String()
+		}
+		if s = strings.TrimRight(s, "\r\n"); s != "" {
+			lines = append(lines, escapeNewline(s)+"\n")
+		}
+	}
+	return lines, nil
+}
+
+//一条日志占一行
+func escapeNewline(s string) string {
+	return strings.Replace(s, "\n", "\\n", -1)
+}
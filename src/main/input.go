@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"heart_beat"
+	"lib"
+	"loglib"
+)
+
+/*
+* 网络输入的角色（syslog等）共用的流程：
+* server -> lineSink -> receiver -> sender
+* 退出时server先停止接收，lineSink把剩下的日志打包，receiver退出后关闭sendBuffer，sender最后退出
+ */
+type inputServer interface {
+	Start()
+	Quit() bool
+}
+
+//server的退出：关闭监听让Start返回，Start返回前调用done
+type serverWaitQuit struct {
+	closer  io.Closer
+	closing bool
+	mutex   *sync.Mutex
+	wq      *lib.WaitQuit
+}
+
+func newServerWaitQuit(name string) *serverWaitQuit {
+	return &serverWaitQuit{mutex: &sync.Mutex{}, wq: lib.NewWaitQuit(name, -1)}
+}
+
+//监听成功后调用，已经在退出时关闭c并返回false
+func (this *serverWaitQuit) started(c io.Closer) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closing {
+		c.Close()
+		return false
+	}
+	this.closer = c
+	return true
+}
+
+func (this *serverWaitQuit) quitting() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.closing
+}
+
+func (this *serverWaitQuit) quit() bool {
+	this.mutex.Lock()
+	if !this.closing {
+		this.closing = true
+		if this.closer != nil {
+			this.closer.Close()
+		}
+	}
+	this.mutex.Unlock()
+	return this.wq.Quit()
+}
+
+func (this *serverWaitQuit) done() {
+	this.wq.AllDone()
+}
+
+//tcp、unix的流式连接，每个连接一个goroutine调用handle，handle返回后关闭连接
+//退出时先停止accept，再关闭所有连接，等各个handle处理完已经收到的数据
+type connServer struct {
+	name    string
+	network string
+	addr    string
+	handle  func(conn net.Conn)
+	conns   map[net.Conn]bool
+	wg      sync.WaitGroup
+	mutex   *sync.Mutex
+	wq      *serverWaitQuit
+}
+
+func newConnServer(name string, network string, addr string, handle func(conn net.Conn)) *connServer {
+	return &connServer{name: name, network: network, addr: addr, handle: handle, conns: make(map[net.Conn]bool), mutex: &sync.Mutex{}, wq: newServerWaitQuit(name + " " + network)}
+}
+
+func (this *connServer) Start() {
+	defer this.wq.done()
+	if this.network == "unix" {
+		os.Remove(this.addr)
+	}
+	ln, err := net.Listen(this.network, this.addr)
+	if err != nil {
+		loglib.Error(fmt.Sprintf("%s listen %s %s error: %s", this.name, this.network, this.addr, err.Error()))
+		return
+	}
+	if this.network == "unix" {
+		os.Chmod(this.addr, 0666)
+	}
+	if !this.wq.started(ln) {
+		return
+	}
+	loglib.Info(fmt.Sprintf("%s listen %s %s", this.name, this.network, this.addr))
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !this.wq.quitting() {
+				loglib.Error(this.name + " accept error: " + err.Error())
+				time.Sleep(time.Second)
+				continue
+			}
+			break
+		}
+		this.mutex.Lock()
+		this.conns[conn] = true
+		this.mutex.Unlock()
+		this.wg.Add(1)
+		go this.serve(conn)
+	}
+	//连接上已经收到的数据处理完再退出
+	this.mutex.Lock()
+	for conn := range this.conns {
+		conn.Close()
+	}
+	this.mutex.Unlock()
+	this.wg.Wait()
+	if this.network == "unix" {
+		os.Remove(this.addr)
+	}
+}
+
+func (this *connServer) serve(conn net.Conn) {
+	defer func() {
+		if err := recover(); err != nil {
+			loglib.Error(fmt.Sprintf("%s conn %s panic:%v", this.name, conn.RemoteAddr(), err))
+		}
+		conn.Close()
+		this.mutex.Lock()
+		delete(this.conns, conn)
+		this.mutex.Unlock()
+		this.wg.Done()
+	}()
+	this.handle(conn)
+}
+
+//连接出错时，退出引起的错误不用打日志
+func (this *connServer) quitting() bool {
+	return this.wq.quitting()
+}
+
+func (this *connServer) Quit() bool {
+	return this.wq.quit()
+}
+
+//输入角色的段中没有配置时使用[tail]中的值
+var inputInheritKeys = []string{"send_to", "senders", "recv_buffer_size", "send_rate", "max_procs", "nice", "max_queued_bytes", "flush_interval", "done_timeout"}
+
+func inputConfig(cfg map[string]map[string]string, section string) map[string]string {
+	config := make(map[string]string)
+	for _, k := range inputInheritKeys {
+		if v, ok := cfg["tail"][k]; ok {
+			config[k] = v
+		}
+	}
+	for k, v := range cfg[section] {
+		config[k] = v
+	}
+	return config
+}
+
+func runInput(role string, cfg map[string]map[string]string, config map[string]string, sink *lineSink, servers []inputServer) {
+	qlst := lib.NewQuitList()
+	initGovernor(config)
+	setSendRate(config)
+	go reloadLimitsOnHup(func(cfg map[string]map[string]string) {
+		setSendRate(inputConfig(cfg, role))
+	})
+
+	sendBuffer := make(chan bytes.Buffer, 500)
+	bufSize, _ := strconv.Atoi(config["recv_buffer_size"])
+	r := ReceiverInit(sendBuffer, sink.ch, bufSize, sink.NextId())
+	r.source = sink.name
+	r.period = sink.period
+	r.filter = NewLineFilter(config)
+	go r.Start()
+	go sink.Start()
+
+	for _, srv := range servers {
+		go srv.Start()
+		qlst.Append(srv.Quit)
+	}
+	qlst.Append(sink.Quit)
+	qlst.Append(r.Quit)
+
+	// heart beat
+	port, _ := cfg["monitor"]["hb_port"]
+	monAddr, _ := cfg["monitor"]["mon_addr"]
+	if port != "" && monAddr != "" {
+		hb := heart_beat.NewHeartBeat(port, monAddr, role)
+		go hb.Run()
+		qlst.Append(hb.Quit)
+	}
+
+	startSenders(qlst, sendBuffer, config, nil)
+
+	qlst.HandleQuitSignal()
+	qlst.ExecQuit()
+}
+
+//按send_to、senders启动sender，setup不为nil时在启动前修改sender的设置
+func startSenders(qlst *lib.QuitList, sendBuffer chan bytes.Buffer, config map[string]string, setup func(*Sender)) []*Sender {
+	addrs := strings.Split(config["send_to"], ",")
+	addr := strings.Trim(addrs[0], " ")
+	bakAddr := addr
+	//有备用地址?
+	if len(addrs) > 1 {
+		bakAddr = strings.Trim(addrs[1], " ")
+	}
+
+	//加大发送并发，sender阻塞会影响tail的进度
+	nSenders := 2
+	senders, ok := config["senders"]
+	if ok {
+		tmp, err := strconv.Atoi(senders)
+		if err == nil {
+			nSenders = tmp
+		}
+	}
+	started := make([]*Sender, 0, nSenders)
+	for i := 1; i <= nSenders; i++ {
+		s := SenderInit(sendBuffer, addr, bakAddr, i)
+		if setup != nil {
+			setup(&s)
+		}
+		go s.Start()
+		qlst.Append(s.Quit)
+		started = append(started, &s)
+	}
+	loglib.Info(fmt.Sprintf("total senders %d", nSenders))
+	return started
+}
+
+//pipe、repull的sender：发送失败的包缓存在单独的目录，包都被确认后才退出，
+//输入读完后连续done_timeout秒（默认600，0表示一直等）没有发出包也退出，没发出的包留在目录中下次运行时再发
+func spoolUntilDone(cacheDir string, config map[string]string) func(*Sender) {
+	timeout := time.Duration(atoiDefault(config["done_timeout"], 600)) * time.Second
+	return func(s *Sender) {
+		s.file_mem_folder_name = cacheDir
+		s.untilDone = true
+		s.doneTimeout = timeout
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"loglib"
+)
+
+/*
+* tailer和receiver之间的日志处理，依次为：
+* include  只保留匹配的行
+* exclude  丢弃匹配的行，如健康检查、静态文件
+* redact   按正则替换敏感信息，如BDUSS、token，可以配置多个
+* sample   按行（或sample_key匹配到的部分）的hash抽样，同样的内容总是同样的结果
+* 被丢弃的行数随包发送（包头的dropped），用于区分有意丢弃和丢失
+ */
+type LineFilter struct {
+	include    *regexp.Regexp
+	exclude    *regexp.Regexp
+	redacts    []redactRule
+	sampleRate uint32 //万分之几，10000表示不抽样
+	sampleKey  *regexp.Regexp
+	counters   filterCounters
+}
+
+type redactRule struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+//各阶段的计数
+type filterCounters struct {
+	In       int64
+	Included int64 //include没匹配而丢弃的
+	Excluded int64
+	Redacted int64
+	Sampled  int64 //抽样丢弃的
+	Out      int64
+}
+
+var redactKeyPrefix = "redact" //redact、redact.xxx都是替换规则，格式为：正则 => 替换成的内容
+
+//没有配置任何处理时返回nil
+func NewLineFilter(config map[string]string) *LineFilter {
+	f := &LineFilter{sampleRate: 10000}
+	has := false
+	if expr := config["include"]; expr != "" {
+		f.include = compileFilter("include", expr)
+		has = has || f.include != nil
+	}
+	if expr := config["exclude"]; expr != "" {
+		f.exclude = compileFilter("exclude", expr)
+		has = has || f.exclude != nil
+	}
+	keys := make([]string, 0)
+	for k := range config {
+		if k == redactKeyPrefix || strings.HasPrefix(k, redactKeyPrefix+".") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts := strings.SplitN(config[k], "=>", 2)
+		if len(parts) != 2 {
+			loglib.Error("wrong " + k + " " + config[k] + ", need `regexp => replacement`")
+			continue
+		}
+		re := compileFilter(k, strings.TrimSpace(parts[0]))
+		if re != nil {
+			f.redacts = append(f.redacts, redactRule{re, strings.TrimSpace(parts[1])})
+			has = true
+		}
+	}
+	if val := config["sample_rate"]; val != "" {
+		rate, err := strconv.ParseFloat(val, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			loglib.Error("wrong sample_rate " + val + ", need a number between 0 and 1")
+		} else if rate < 1 {
+			f.sampleRate = uint32(rate * 10000)
+			has = true
+		}
+	}
+	if expr := config["sample_key"]; expr != "" {
+		f.sampleKey = compileFilter("sample_key", expr)
+	}
+	if !has {
+		return nil
+	}
+	return f
+}
+
+func compileFilter(name string, expr string) *regexp.Regexp {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		loglib.Error(fmt.Sprintf("wrong %s %s: %s, ignored", name, expr, err.Error()))
+		return nil
+	}
+	return re
+}
+
+//处理一行日志，返回处理后的日志，false表示丢弃
+func (f *LineFilter) Process(line string) (string, bool) {
+	atomic.AddInt64(&f.counters.In, 1)
+	if f.include != nil && !f.include.MatchString(line) {
+		atomic.AddInt64(&f.counters.Included, 1)
+		return "", false
+	}
+	if f.exclude != nil && f.exclude.MatchString(line) {
+		atomic.AddInt64(&f.counters.Excluded, 1)
+		return "", false
+	}
+	redacted := false
+	for _, r := range f.redacts {
+		if r.re.MatchString(line) {
+			line = r.re.ReplaceAllString(line, r.repl)
+			redacted = true
+		}
+	}
+	if redacted {
+		atomic.AddInt64(&f.counters.Redacted, 1)
+	}
+	if f.sampleRate < 10000 && !f.sampled(line) {
+		atomic.AddInt64(&f.counters.Sampled, 1)
+		return "", false
+	}
+	atomic.AddInt64(&f.counters.Out, 1)
+	return line, true
+}
+
+//按hash抽样，配置了sample_key时对匹配到的部分（有分组时取第一个分组）做hash，
+//没匹配到的行保留
+func (f *LineFilter) sampled(line string) bool {
+	key := line
+	if f.sampleKey != nil {
+		m := f.sampleKey.FindStringSubmatch(line)
+		if m == nil {
+			return true
+		}
+		key = m[0]
+		if len(m) > 1 {
+			key = m[1]
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()%10000 < f.sampleRate
+}
+
+func (f *LineFilter) Counters() filterCounters {
+	return filterCounters{
+		In:       atomic.LoadInt64(&f.counters.In),
+		Included: atomic.LoadInt64(&f.counters.Included),
+		Excluded: atomic.LoadInt64(&f.counters.Excluded),
+		Redacted: atomic.LoadInt64(&f.counters.Redacted),
+		Sampled:  atomic.LoadInt64(&f.counters.Sampled),
+		Out:      atomic.LoadInt64(&f.counters.Out),
+	}
+}
+
+func (c filterCounters) String() string {
+	return fmt.Sprintf("in:%d, include dropped:%d, exclude dropped:%d, redacted:%d, sample dropped:%d, out:%d", c.In, c.Included, c.Excluded, c.Redacted, c.Sampled, c.Out)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLineFilter(t *testing.T) {
+	type result struct {
+		line string
+		ok   bool
+	}
+	tests := []struct {
+		name   string
+		config map[string]string
+		lines  []string
+		want   []result
+		counts filterCounters
+	}{
+		{"include", map[string]string{"include": "GET|POST"},
+			[]string{"GET /a", "HEAD /b", "POST /c"},
+			[]result{{"GET /a", true}, {"", false}, {"POST /c", true}},
+			filterCounters{In: 3, Included: 1, Out: 2}},
+		{"exclude", map[string]string{"exclude": `/health|\.png`},
+			[]string{"GET /health", "GET /a.png", "GET /api"},
+			[]result{{"", false}, {"", false}, {"GET /api", true}},
+			filterCounters{In: 3, Excluded: 2, Out: 1}},
+		{"include then exclude", map[string]string{"include": "GET", "exclude": "health"},
+			[]string{"GET /health", "POST /x", "GET /x"},
+			[]result{{"", false}, {"", false}, {"GET /x", true}},
+			filterCounters{In: 3, Included: 1, Excluded: 1, Out: 1}},
+		//多条规则按key的顺序执行
+		{"redact", map[string]string{"redact": `BDUSS=[^;& ]+ => BDUSS=***`, "redact.token": `token=\w+ => token=***`},
+			[]string{"a BDUSS=abc; token=t1 x", "plain"},
+			[]result{{"a BDUSS=***; token=*** x", true}, {"plain", true}},
+			filterCounters{In: 2, Redacted: 1, Out: 2}},
+		{"redact group", map[string]string{"redact": `(\d{3})\d{4}(\d{4}) => ${1}****${2}`},
+			[]string{"phone 13812345678"},
+			[]result{{"phone 138****5678", true}},
+			filterCounters{In: 1, Redacted: 1, Out: 1}},
+		{"sample none", map[string]string{"sample_rate": "0"},
+			[]string{"a", "b"},
+			[]result{{"", false}, {"", false}},
+			filterCounters{In: 2, Sampled: 2}},
+		//没匹配到sample_key的行保留
+		{"sample key not matched", map[string]string{"sample_rate": "0", "sample_key": `uid=(\d+)`},
+			[]string{"uid=1 a", "no uid"},
+			[]result{{"", false}, {"no uid", true}},
+			filterCounters{In: 2, Sampled: 1, Out: 1}},
+	}
+	for _, tt := range tests {
+		f := NewLineFilter(tt.config)
+		if f == nil {
+			t.Errorf("%s: filter not created", tt.name)
+			continue
+		}
+		for i, l := range tt.lines {
+			line, ok := f.Process(l)
+			if line != tt.want[i].line || ok != tt.want[i].ok {
+				t.Errorf("%s: %q got %q %v, want %q %v", tt.name, l, line, ok, tt.want[i].line, tt.want[i].ok)
+			}
+		}
+		if c := f.Counters(); c != tt.counts {
+			t.Errorf("%s: counters %s, want %s", tt.name, c, tt.counts)
+		}
+	}
+}
+
+func TestNewLineFilterNil(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+	}{
+		{"empty", map[string]string{}},
+		{"wrong include", map[string]string{"include": "("}},
+		{"redact without replacement", map[string]string{"redact": "token"}},
+		{"sample rate 1", map[string]string{"sample_rate": "1"}},
+		{"wrong sample rate", map[string]string{"sample_rate": "2"}},
+		{"sample key only", map[string]string{"sample_key": "uid"}},
+	}
+	for _, tt := range tests {
+		if f := NewLineFilter(tt.config); f != nil {
+			t.Errorf("%s: want nil filter", tt.name)
+		}
+	}
+}
+
+//同样的key总是同样的结果，比例接近sample_rate
+func TestLineFilterSample(t *testing.T) {
+	f := NewLineFilter(map[string]string{"sample_rate": "0.3", "sample_key": `uid=(\d+)`})
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		line := fmt.Sprintf("uid=%d page=%d", i, i%7)
+		_, ok := f.Process(line)
+		_, again := f.Process(fmt.Sprintf("uid=%d page=other", i))
+		if ok != again {
+			t.Fatalf("uid=%d sampled differently", i)
+		}
+		if ok {
+			kept++
+		}
+	}
+	if kept < 2700 || kept > 3300 {
+		t.Errorf("kept %d of 10000 with rate 0.3", kept)
+	}
+}
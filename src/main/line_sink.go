@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lib"
+	"loglib"
+	"tcp_pack"
+)
+
+/*
+* 网络输入（syslog等）收到的日志交给lineSink，按日志自带的时间分周期后发给receiver
+* 日志不能重读，所以：
+*   周期按日志的时间划分，早于当前周期的算到当前周期，当前周期结束close_wait秒后没有新周期的日志也关闭，
+*   没有日志的周期也发送结束包，以便收集端判断完整
+*   和tailer一样按行数分包，断点（周期、行数和下一个包的id）在包被确认后保存，重启后id接着之前的
+*   退出时或不满一个包的日志等待超过flush_interval秒时用flushStr提前打包，包的id仍然连续
+* 持有mutex时不能阻塞（否则Quit和定时的关闭、打包都会卡住），行和标记按顺序放到queue，由forward发给receiver，
+* 排队的行数超过上限或queueBudget已满时，Add在拿mutex之前等待；不能等待的输入（如http）用TryAdd，放不下时整批拒绝
+ */
+type lineSink struct {
+	name      string //日志源的名字，即包头的source
+	period    lib.Period
+	closeWait time.Duration
+	flushWait time.Duration //不满一个包的日志最多等待多久，为0时只在退出时提前打包
+	pending   time.Time     //还没打包的第一行的时间，为0表示没有
+	bufSize   int
+	start     time.Time //当前周期的开始
+	lines     int       //当前周期已发出的行数
+	nextId    int       //下一个包的id
+	packLines int       //还没打包的行数
+	ch        chan map[string]string
+	queue     []sinkItem //等待forward发给receiver的行和标记
+	slots     chan bool  //queue和ch中的行数的上限
+	closed    bool       //Quit之后forward发完queue就关闭ch
+	ready     *sync.Cond //queue有新的数据或者closed
+	acker     *ackTracker
+	late      int64 //时间早于当前周期的行数
+	received  int64
+	quitCh    chan bool
+	mutex     *sync.Mutex
+	wq        *lib.WaitQuit
+}
+
+type sinkItem struct {
+	m    map[string]string
+	line bool //是日志行，发出后释放slots
+}
+
+func newLineSink(name string, config map[string]string) *lineSink {
+	period := lib.Hourly
+	if val := config["rotate_period"]; val != "" {
+		p, err := lib.ParsePeriod(val)
+		if err != nil {
+			loglib.Error("wrong rotate_period " + val + ", use " + period.String())
+		} else {
+			period = p
+		}
+	}
+	closeWait := time.Minute
+	if n, err := strconv.Atoi(config["close_wait"]); err == nil && n >= 0 {
+		closeWait = time.Duration(n) * time.Second
+	}
+	if closeWait > period.Duration {
+		closeWait = period.Duration
+	}
+	bufSize, _ := strconv.Atoi(config["recv_buffer_size"])
+	if bufSize <= 0 {
+		bufSize = 2000
+		config["recv_buffer_size"] = "2000"
+	}
+	recordPath := config[recordFileKey]
+	if recordPath == "" {
+		recordPath = getRecordPath(name)
+	}
+	mutex := &sync.Mutex{}
+	s := &lineSink{
+		name:      name,
+		period:    period,
+		closeWait: closeWait,
+		flushWait: time.Duration(atoiDefault(config["flush_interval"], 0)) * time.Second,
+		bufSize:   bufSize,
+		start:     period.Truncate(time.Now()),
+		nextId:    1,
+		ch:        make(chan map[string]string, 10000),
+		slots:     make(chan bool, 10000),
+		acker:     newAckTracker(tcp_pack.StreamKey(map[string]string{"ip": lib.GetIp(), "source": name}), recordPath),
+		quitCh:    make(chan bool),
+		ready:     sync.NewCond(mutex),
+		mutex:     mutex,
+		wq:        lib.NewWaitQuit("line sink "+name, -1),
+	}
+	if cp := loadCheckpoint(recordPath); cp != nil && cp.Hour != "" {
+		if t, err := lib.ParsePeriodKey(cp.Hour); err == nil {
+			//上次退出时的周期，id接着发，比当前早的周期要先结束
+			s.start = t
+			s.lines = cp.Line
+			s.nextId = cp.nextId(bufSize)
+			loglib.Info(fmt.Sprintf("line sink %s continue period %s from line %d, pack %d", name, cp.Hour, s.lines, s.nextId))
+		}
+	}
+	return s
+}
+
+//receiver第一个包的id
+func (this *lineSink) NextId() int {
+	return this.nextId
+}
+
+//当前的包打包，返回它的id
+func (this *lineSink) nextPack() int {
+	id := this.nextId
+	this.nextId++
+	this.packLines = 0
+	return id
+}
+
+//t为日志的时间，为0时用当前时间，tags写到包头
+func (this *lineSink) Add(t time.Time, line string, tags map[string]string) {
+	//排队的包太多时等sender发出去一些
+	queueBudget.Wait()
+	this.slots <- true
+	this.add(t, line, tags)
+}
+
+//不等待，先占好所有行的位置，排队的日志太多放不下整批时一行也不接收，返回false
+func (this *lineSink) TryAdd(lines []inputLine) bool {
+	if queueBudget.Full() {
+		return false
+	}
+	for i := range lines {
+		select {
+		case this.slots <- true:
+		default:
+			for ; i > 0; i-- {
+				<-this.slots
+			}
+			return false
+		}
+	}
+	for _, l := range lines {
+		this.add(l.t, l.line, l.tags)
+	}
+	return true
+}
+
+//一次最多能接收的行数
+func (this *lineSink) Capacity() int {
+	return cap(this.slots)
+}
+
+//调用前已占了slots
+func (this *lineSink) add(t time.Time, line string, tags map[string]string) {
+	now := time.Now()
+	eventTime := ""
+	if t.IsZero() || t.After(now.Add(this.period.Duration)) {
+		//没有时间或者时间超前太多，按收到的时间
+		t = now
+	} else {
+		eventTime = t.Format(etLayout)
+		if t.After(now) {
+			//时钟快一点的客户端不能让当前周期提前结束，按收到的时间分周期
+			t = now
+		}
+	}
+	atomic.AddInt64(&this.received, 1)
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		<-this.slots
+		return
+	}
+	ps := this.period.Truncate(t)
+	if ps.Before(this.start) {
+		atomic.AddInt64(&this.late, 1)
+	}
+	for ps.After(this.start) {
+		this.closePeriod()
+	}
+	hour := this.period.Key(this.start)
+	this.lines++
+	this.packLines++
+	if this.packLines >= this.bufSize {
+		id := this.nextPack()
+		this.acker.expect(hour, id, &Checkpoint{Hour: hour, Line: this.lines, NextId: this.nextId})
+		this.pending = time.Time{}
+	} else if this.pending.IsZero() {
+		this.pending = now
+	}
+	m := map[string]string{"hour": hour, "line": line}
+	if eventTime != "" {
+		m["time"] = eventTime
+	}
+	for k, v := range tags {
+		m["tag."+k] = v
+	}
+	this.push(m, true)
+}
+
+//排队的日志太多，不能等待的输入（如http）在读请求之前就拒绝
+func (this *lineSink) Busy() bool {
+	return len(this.slots) >= cap(this.slots)*9/10 || queueBudget.Full()
+}
+
+//调用时持有mutex，不会阻塞
+func (this *lineSink) push(m map[string]string, line bool) {
+	this.queue = append(this.queue, sinkItem{m, line})
+	this.ready.Signal()
+}
+
+//goroutine，按顺序把queue中的行和标记发给receiver，Quit后发完就关闭ch
+func (this *lineSink) forward() {
+	for {
+		this.mutex.Lock()
+		for len(this.queue) == 0 && !this.closed {
+			this.ready.Wait()
+		}
+		items, closed := this.queue, this.closed
+		this.queue = nil
+		this.mutex.Unlock()
+		for _, item := range items {
+			this.ch <- item.m
+			if item.line {
+				<-this.slots
+			}
+		}
+		if closed && len(items) == 0 {
+			close(this.ch)
+			return
+		}
+	}
+}
+
+//结束当前周期，进入下一个周期
+func (this *lineSink) closePeriod() {
+	hour := this.period.Key(this.start)
+	next := this.period.Next(this.start)
+	loglib.Info(fmt.Sprintf("line sink %s period %s finished, lines: %d, received: %d, late: %d", this.name, hour, this.lines, atomic.LoadInt64(&this.received), atomic.LoadInt64(&this.late)))
+	this.acker.expect(hour, this.nextId, &Checkpoint{Hour: this.period.Key(next), Line: 0, NextId: 1})
+	this.push(map[string]string{"hour": hour, "line": changeStr}, false)
+	this.start = next
+	this.lines = 0
+	this.nextId = 1
+	this.packLines = 0
+	this.pending = time.Time{}
+}
+
+//不满一个包的日志提前打包，周期没有结束
+func (this *lineSink) flush() {
+	this.pending = time.Time{}
+	if this.packLines == 0 {
+		return
+	}
+	hour := this.period.Key(this.start)
+	id := this.nextPack()
+	this.acker.expect(hour, id, &Checkpoint{Hour: hour, Line: this.lines, NextId: this.nextId})
+	this.push(map[string]string{"hour": hour, "line": flushStr}, false)
+}
+
+//goroutine，周期结束close_wait后关闭，不满一个包的日志按flush_interval提前打包
+func (this *lineSink) Start() {
+	defer this.wq.AllDone()
+	forwarded := make(chan bool)
+	go func() {
+		this.forward()
+		close(forwarded)
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.quitCh:
+			//receiver的chan关闭后才算退出
+			<-forwarded
+			return
+		case <-ticker.C:
+		}
+		this.mutex.Lock()
+		if !this.closed {
+			for !time.Now().Before(this.period.Next(this.start).Add(this.closeWait)) {
+				this.closePeriod()
+			}
+			if this.flushWait > 0 && !this.pending.IsZero() && time.Now().Sub(this.pending) >= this.flushWait {
+				this.flush()
+			}
+		}
+		this.mutex.Unlock()
+	}
+}
+
+//server都退出后调用，把不满一个包的日志发出去，forward发完后关闭receiver的chan
+//等待超时后会被再次调用
+func (this *lineSink) Quit() bool {
+	this.mutex.Lock()
+	if !this.closed {
+		this.flush()
+		this.closed = true
+		close(this.quitCh)
+		this.ready.Signal()
+	}
+	this.mutex.Unlock()
+	return this.wq.Quit()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLineSinkTryAdd(t *testing.T) {
+	s := newLineSink("try_add_test", map[string]string{recordFileKey: filepath.Join(t.TempDir(), "sink.rec")})
+	s.slots = make(chan bool, 3)
+	lines := []inputLine{{line: "a\n"}, {line: "b\n"}}
+	if !s.TryAdd(lines) {
+		t.Fatal("first batch rejected")
+	}
+	//只剩一个位置，整批拒绝，已占的位置要还回去
+	if s.TryAdd(lines) {
+		t.Fatal("second batch accepted")
+	}
+	if n := len(s.slots); n != 2 {
+		t.Errorf("slots used %d, want 2", n)
+	}
+	if n := len(sinkLines(s)); n != 2 {
+		t.Errorf("queued %d lines, want 2", n)
+	}
+	if !s.TryAdd(lines[:1]) {
+		t.Error("batch that fits rejected")
+	}
+}
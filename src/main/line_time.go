@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"lib"
+	"loglib"
+)
+
+/*
+* 解析日志行中的时间
+* time_layout为go的时间格式，如02/Jan/2006:15:04:05 -0700，默认2006-01-02 15:04:05
+* time_pattern为提取时间的正则，有分组时取第一个分组，不配置时从行首按time_layout的长度截取
+ */
+type timeParser struct {
+	re     *regexp.Regexp
+	layout string
+}
+
+var defaultTimeLayout = "2006-01-02 15:04:05"
+
+func newTimeParser(config map[string]string) *timeParser {
+	p := &timeParser{layout: defaultTimeLayout}
+	if val := config["time_layout"]; val != "" {
+		p.layout = val
+	}
+	if expr := config["time_pattern"]; expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			loglib.Error("wrong time_pattern " + expr + ": " + err.Error())
+		} else {
+			p.re = re
+		}
+	}
+	return p
+}
+
+func (p *timeParser) parse(line string) (time.Time, bool) {
+	var s string
+	if p.re != nil {
+		m := p.re.FindStringSubmatch(line)
+		if m == nil {
+			return time.Time{}, false
+		}
+		s = m[0]
+		if len(m) > 1 {
+			s = m[1]
+		}
+	} else {
+		if len(line) < len(p.layout) {
+			return time.Time{}, false
+		}
+		s = line[:len(p.layout)]
+	}
+	t, err := time.ParseInLocation(p.layout, s, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+var errNoTime = errors.New("no line with time found")
+
+//二分查找第一行时间不早于t的行，返回该行的偏移和之前的行数
+//日志中的时间大致有序即可，解析不出时间的行跳过
+func (p *timeParser) seek(fname string, t time.Time) (offset int64, line int, err error) {
+	fin, err := os.Open(fname)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fin.Close()
+	fi, err := fin.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	lo, hi := int64(0), fi.Size()
+	//区间足够小后顺序查找
+	for hi-lo > 64*1024 {
+		mid := lo + (hi-lo)/2
+		start, tm, err := p.timeAfter(fin, mid, hi)
+		if err != nil {
+			//后半段没有可解析的行
+			hi = mid
+			continue
+		}
+		if tm.Before(t) {
+			lo = start
+		} else {
+			hi = mid
+		}
+	}
+	//从lo开始逐行查找，lo总是行首
+	if _, err = fin.Seek(lo, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	rd := bufio.NewReaderSize(fin, 64*1024)
+	offset = lo
+	for {
+		s, err := rd.ReadString('\n')
+		if tm, ok := p.parse(s); ok && !tm.Before(t) {
+			break
+		}
+		if err != nil {
+			//都早于t，从末尾开始
+			offset += int64(len(s))
+			break
+		}
+		offset += int64(len(s))
+	}
+	return offset, countLines(fname, offset), nil
+}
+
+//pos之后的第一个能解析出时间的完整行，返回其行首偏移和时间
+func (p *timeParser) timeAfter(fin *os.File, pos int64, end int64) (int64, time.Time, error) {
+	if _, err := fin.Seek(pos, io.SeekStart); err != nil {
+		return 0, time.Time{}, err
+	}
+	rd := bufio.NewReaderSize(fin, 64*1024)
+	//pos在某行中间，跳过这半行
+	s, err := rd.ReadString('\n')
+	if err != nil {
+		return 0, time.Time{}, errNoTime
+	}
+	start := pos + int64(len(s))
+	for start < end {
+		s, err = rd.ReadString('\n')
+		if tm, ok := p.parse(s); ok && err == nil {
+			return start, tm, nil
+		}
+		if err != nil {
+			break
+		}
+		start += int64(len(s))
+	}
+	return 0, time.Time{}, errNoTime
+}
+
+//offset之前的行数
+func countLines(fname string, offset int64) int {
+	fin, err := os.Open(fname)
+	if err != nil {
+		return 0
+	}
+	defer fin.Close()
+	rd := bufio.NewReaderSize(io.LimitReader(fin, offset), 64*1024)
+	n := 0
+	buf := make([]byte, 64*1024)
+	for {
+		m, err := rd.Read(buf)
+		for _, c := range buf[:m] {
+			if c == '\n' {
+				n++
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return n
+}
+
+//解析start_position中的时间，支持：
+//2006-01-02 15:04:05、2006-01-02 15:04、15:04:05、15:04（今天）、周期的key（如2026101710）、unix时间戳
+func parseStartTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	now := time.Now()
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			y, m, d := now.Date()
+			return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+		}
+	}
+	if t, err := lib.ParsePeriodKey(s); err == nil {
+		return t, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Time{}, errors.New("wrong time " + s)
+}
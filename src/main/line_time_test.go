@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//每秒一行，每10行一行没有时间的续行，超过二分查找的区间
+func writeTimedLog(t *testing.T, start time.Time, n int) (string, []int64) {
+	var b bytes.Buffer
+	offsets := make([]int64, n) //第i秒那一行的偏移
+	for i := 0; i < n; i++ {
+		offsets[i] = int64(b.Len())
+		fmt.Fprintf(&b, "%s GET /page/%d\n", start.Add(time.Duration(i)*time.Second).Format(defaultTimeLayout), i)
+		if i%10 == 0 {
+			b.WriteString("\tcontinued line\n")
+		}
+	}
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0664); err != nil {
+		t.Fatal(err)
+	}
+	return path, offsets
+}
+
+func TestTimeParserSeek(t *testing.T) {
+	start := time.Date(2026, 10, 17, 10, 0, 0, 0, time.Local)
+	n := 5000
+	path, offsets := writeTimedLog(t, start, n)
+	content, _ := ioutil.ReadFile(path)
+	size := int64(len(content))
+	tests := []struct {
+		name   string
+		at     time.Time
+		offset int64
+	}{
+		{"before first", start.Add(-time.Hour), 0},
+		{"first", start, 0},
+		{"middle", start.Add(2500 * time.Second), offsets[2500]},
+		{"between lines", start.Add(1234*time.Second + 500*time.Millisecond), offsets[1235]},
+		{"last", start.Add(time.Duration(n-1) * time.Second), offsets[n-1]},
+		{"after last", start.Add(2 * time.Hour), size},
+	}
+	p := newTimeParser(map[string]string{})
+	for _, tt := range tests {
+		offset, line, err := p.seek(path, tt.at)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if offset != tt.offset {
+			t.Errorf("%s: offset %d, want %d", tt.name, offset, tt.offset)
+		}
+		if want := bytes.Count(content[:tt.offset], []byte("\n")); line != want {
+			t.Errorf("%s: line %d, want %d", tt.name, line, want)
+		}
+	}
+	if _, _, err := p.seek(filepath.Join(t.TempDir(), "none.log"), start); err == nil {
+		t.Error("missing file: want error")
+	}
+}
+
+func TestSeekStart(t *testing.T) {
+	start := time.Date(2026, 10, 17, 10, 0, 0, 0, time.Local)
+	path, offsets := writeTimedLog(t, start, 100)
+	content, _ := ioutil.ReadFile(path)
+	tests := []struct {
+		pos    string
+		offset int64
+		line   int
+	}{
+		{"end", -1, -1},
+		{"beginning", 0, 0},
+		{"line:2", offsets[1], 2},
+		{"time: 2026-10-17 10:00:30", offsets[30], 33},
+		{"time:2026101711", int64(len(content)), 110},
+		{"wrong:1", -1, -1},
+		{"line:x", -1, -1},
+	}
+	for _, tt := range tests {
+		tl := &Tailler{logPath: path, config: map[string]string{}, offset: -1, lineNum: -1}
+		tl.seekStart(tt.pos)
+		if tl.offset != tt.offset || tl.lineNum != tt.line {
+			t.Errorf("%q: offset %d line %d, want %d %d", tt.pos, tl.offset, tl.lineNum, tt.offset, tt.line)
+		}
+	}
+}
+
+func TestParseStartTime(t *testing.T) {
+	now := time.Now()
+	today := func(h, m, s int) time.Time {
+		return time.Date(now.Year(), now.Month(), now.Day(), h, m, s, 0, time.Local)
+	}
+	tests := []struct {
+		in   string
+		want time.Time
+		ok   bool
+	}{
+		{"2026-10-17 10:20:30", time.Date(2026, 10, 17, 10, 20, 30, 0, time.Local), true},
+		{"2026-10-17 10:20", time.Date(2026, 10, 17, 10, 20, 0, 0, time.Local), true},
+		{"2026-10-17T10:20:30", time.Date(2026, 10, 17, 10, 20, 30, 0, time.Local), true},
+		{" 10:20:30 ", today(10, 20, 30), true},
+		{"10:20", today(10, 20, 0), true},
+		{"2026101710", time.Date(2026, 10, 17, 10, 0, 0, 0, time.Local), true},
+		{"20261017", time.Date(2026, 10, 17, 0, 0, 0, 0, time.Local), true},
+		{"1792224000", time.Unix(1792224000, 0), true},
+		{"yesterday", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseStartTime(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err %v", tt.in, err)
+			continue
+		}
+		if tt.ok && !got.Equal(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loglib"
+)
+
+/*
+* 本机应用直接写日志：logd logd config.ini
+* [logd]中配置unix（流式socket的路径）、tcp（监听地址，一般只监听127.0.0.1）至少一个，连接可以一直保持
+* framing为line（默认）时每行一条日志，为length时每条日志前是4字节大端的长度，日志中的换行转为\n
+* 按客户端统计连接数、行数、字节数和丢弃的行数，每分钟和退出时打到日志，配置stats_listen时可以用http查看（json）
+* 客户端：tcp按对方ip，unix按对方进程名和uid
+ */
+type logdServer struct {
+	framing string
+	maxLine int
+	sink    *lineSink
+	stats   *clientStats
+	srv     *connServer
+}
+
+type clientCounter struct {
+	Conns     int64  `json:"conns"` //当前的连接数
+	Total     int64  `json:"total_conns"`
+	Lines     int64  `json:"lines"`
+	Bytes     int64  `json:"bytes"`
+	Dropped   int64  `json:"dropped"` //超长或格式错误丢弃的
+	LastSeen  string `json:"last_seen"`
+	lastNanos int64
+}
+
+type clientStats struct {
+	clients map[string]*clientCounter
+	mutex   *sync.Mutex
+}
+
+func logdGo(cfg map[string]map[string]string) {
+	config := inputConfig(cfg, "logd")
+	name := config["source"]
+	if name == "" {
+		name = "logd"
+	}
+	framing := config["framing"]
+	if framing == "" {
+		framing = "line"
+	}
+	if framing != "line" && framing != "length" {
+		loglib.Error("wrong framing " + framing + ", need line or length")
+		os.Exit(1)
+	}
+	maxLine := 1 << 20
+	if val := config["max_line_bytes"]; val != "" {
+		if n, err := parseBytes(val); err == nil && n > 0 {
+			maxLine = int(n)
+		}
+	}
+	sink := newLineSink(name, config)
+	stats := &clientStats{clients: make(map[string]*clientCounter), mutex: &sync.Mutex{}}
+	servers := make([]inputServer, 0)
+	for _, network := range []string{"unix", "tcp"} {
+		if addr := config[network]; addr != "" {
+			ls := &logdServer{framing: framing, maxLine: maxLine, sink: sink, stats: stats}
+			ls.srv = newConnServer("logd", network, addr, ls.handleConn)
+			servers = append(servers, ls.srv)
+		}
+	}
+	if len(servers) == 0 {
+		loglib.Error("[logd] need unix or tcp!")
+		os.Exit(1)
+	}
+	if addr := config["stats_listen"]; addr != "" {
+		servers = append(servers, &statsServer{addr: addr, stats: stats, wq: newServerWaitQuit("logd stats")})
+	}
+	loglib.Info("logd framing: " + framing)
+	go stats.report()
+	runInput("logd", cfg, config, sink, servers)
+	stats.log()
+}
+
+func (this *logdServer) handleConn(conn net.Conn) {
+	client := clientName(conn)
+	c := this.stats.connect(client)
+	defer atomic.AddInt64(&c.Conns, -1)
+	rd := bufio.NewReaderSize(conn, 64*1024)
+	var err error
+	if this.framing == "length" {
+		err = this.readFrames(rd, c)
+	} else {
+		err = this.readLines(rd, c)
+	}
+	if err != nil && err != io.EOF && !this.srv.quitting() {
+		loglib.Warning(fmt.Sprintf("logd conn %s error: %s", client, err.Error()))
+	}
+}
+
+//超过maxLine的行整行丢弃
+func (this *logdServer) readLines(rd *bufio.Reader, c *clientCounter) error {
+	buf := make([]byte, 0, 1024)
+	tooLong := false
+	for {
+		b, err := rd.ReadSlice('\n')
+		if !tooLong {
+			buf = append(buf, b...)
+			if len(buf) > this.maxLine {
+				tooLong = true
+				buf = buf[:0]
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong {
+			atomic.AddInt64(&c.Dropped, 1)
+			tooLong = false
+		} else if line := strings.TrimRight(string(buf), "\r\n"); line != "" {
+			this.add(c, line+"\n")
+		}
+		buf = buf[:0]
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (this *logdServer) readFrames(rd *bufio.Reader, c *clientCounter) error {
+	head := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(rd, head); err != nil {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint32(head))
+		if n > int64(this.maxLine) {
+			//跳过这一条，后面的还能接着读
+			atomic.AddInt64(&c.Dropped, 1)
+			if _, err := io.CopyN(ioutil.Discard, rd, n); err != nil {
+				return err
+			}
+			continue
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return err
+		}
+		if line := strings.TrimRight(string(buf), "\r\n"); line != "" {
+			this.add(c, escapeNewline(line)+"\n")
+		}
+	}
+}
+
+func (this *logdServer) add(c *clientCounter, line string) {
+	this.sink.Add(time.Time{}, line, nil)
+	atomic.AddInt64(&c.Lines, 1)
+	atomic.AddInt64(&c.Bytes, int64(len(line)))
+	atomic.StoreInt64(&c.lastNanos, time.Now().UnixNano())
+}
+
+//tcp按ip，unix按对方的进程名和uid，同一个应用的多个连接算在一起
+func clientName(conn net.Conn) string {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return conn.RemoteAddr().String()
+		}
+		return host
+	}
+	return unixPeerName(uc)
+}
+
+func (this *clientStats) connect(client string) *clientCounter {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	c, ok := this.clients[client]
+	if !ok {
+		c = &clientCounter{}
+		this.clients[client] = c
+	}
+	atomic.AddInt64(&c.Conns, 1)
+	atomic.AddInt64(&c.Total, 1)
+	atomic.StoreInt64(&c.lastNanos, time.Now().UnixNano())
+	return c
+}
+
+func (this *clientStats) snapshot() map[string]clientCounter {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	m := make(map[string]clientCounter, len(this.clients))
+	for k, c := range this.clients {
+		m[k] = clientCounter{
+			Conns:    atomic.LoadInt64(&c.Conns),
+			Total:    atomic.LoadInt64(&c.Total),
+			Lines:    atomic.LoadInt64(&c.Lines),
+			Bytes:    atomic.LoadInt64(&c.Bytes),
+			Dropped:  atomic.LoadInt64(&c.Dropped),
+			LastSeen: time.Unix(0, atomic.LoadInt64(&c.lastNanos)).Format("2006-01-02 15:04:05"),
+		}
+	}
+	return m
+}
+
+func (this *clientStats) log() {
+	m := this.snapshot()
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		c := m[k]
+		loglib.Info(fmt.Sprintf("logd client %s: conns %d, total conns %d, lines %d, bytes %d, dropped %d, last seen %s", k, c.Conns, c.Total, c.Lines, c.Bytes, c.Dropped, c.LastSeen))
+	}
+}
+
+func (this *clientStats) report() {
+	for range time.Tick(time.Minute) {
+		this.log()
+	}
+}
+
+//http查看各客户端的计数
+type statsServer struct {
+	addr  string
+	stats *clientStats
+	wq    *serverWaitQuit
+}
+
+func (this *statsServer) Start() {
+	defer this.wq.done()
+	ln, err := net.Listen("tcp", this.addr)
+	if err != nil {
+		loglib.Error("logd stats listen " + this.addr + " error: " + err.Error())
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(this.stats.snapshot())
+	})
+	srv := &http.Server{Handler: mux}
+	if !this.wq.started(httpCloser{srv}) {
+		ln.Close()
+		return
+	}
+	loglib.Info("logd stats listen " + this.addr)
+	if err = srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		loglib.Error("logd stats serve error: " + err.Error())
+	}
+}
+
+func (this *statsServer) Quit() bool {
+	return this.wq.quit()
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//用SO_PEERCRED取对方的pid和uid，进程名从/proc读
+func unixPeerName(uc *net.UnixConn) string {
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return "unix"
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return "unix"
+	}
+	comm, err := ioutil.ReadFile("/proc/" + strconv.Itoa(int(cred.Pid)) + "/comm")
+	if err != nil {
+		return fmt.Sprintf("pid%d(uid %d)", cred.Pid, cred.Uid)
+	}
+	return fmt.Sprintf("%s(uid %d)", strings.TrimSpace(string(comm)), cred.Uid)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+)
+
+//没有SO_PEERCRED，unix的客户端都算在一起
+func unixPeerName(uc *net.UnixConn) string {
+	return "unix"
+}
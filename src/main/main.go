@@ -35,14 +35,28 @@ func main() {
 	}
 
 	cfgFile := flag.Arg(1)
+	var repullOpt *repullOptions
+	if flag.Arg(0) == "repull" {
+		repullOpt = parseRepullArgs(flag.Args()[1:])
+		cfgFile = repullOpt.config
+	}
+	var pipeOpt *pipeOptions
+	if flag.Arg(0) == "pipe" {
+		pipeOpt = parsePipeArgs(flag.Args()[1:])
+		cfgFile = pipeOpt.config
+	}
 	cfg := lib.ReadConfig(cfgFile)
+	configFile = cfgFile
 	loglib.Init(cfg["logAgent"])
 	hbPort, ok := cfg["monitor"]["hb_port"]
 	if ok {
 		loglib.HeartBeatPort = hbPort
 	}
 
-	savePid()
+	//补拉、pipe和tail可能同时运行，不能覆盖tail的pid
+	if repullOpt == nil && pipeOpt == nil {
+		savePid()
+	}
 
 	switch flag.Arg(0) {
 	case "logd":
@@ -51,6 +65,24 @@ func main() {
 	case "tail":
 		tailerGo(cfg)
 
+	case "repull":
+		repullGo(cfg, repullOpt)
+
+	case "pipe":
+		pipeGo(cfg, pipeOpt)
+
+	case "syslog":
+		syslogGo(cfg)
+
+	case "http":
+		httpGo(cfg)
+
+	case "otlp":
+		otlpGo(cfg)
+
+	case "forward":
+		forwardGo(cfg)
+
 	case "client":
 		testClient2()
 	case "collector":
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"loglib"
+)
+
+//测试时不写日志文件，loglib没有初始化时调用会panic
+func TestMain(m *testing.M) {
+	loglib.Init(map[string]string{})
+	os.Exit(m.Run())
+}
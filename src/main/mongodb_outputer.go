@@ -299,7 +299,7 @@ func (this *MongoDbOutputer) extract(bp *bytes.Buffer) (r io.ReadCloser, packId
 		loglib.Error("zlib reader Error: " + err.Error())
 	}
 	date = header["hour"][0:8] //用于按天分库
-	packId = fmt.Sprintf("%s_%s_%s", header["ip"], header["hour"], header["id"])
+	packId = fmt.Sprintf("%s_%s_%s", tcp_pack.StreamKey(header), header["hour"], header["id"])
 	return
 }
 
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+/*
+* msgpack的解码，用于fluent的forward协议
+* str和bin都解为string，map的key不是字符串时转为字符串，ext解为msgpackExt
+ */
+type msgpackExt struct {
+	typ  int8
+	data []byte
+}
+
+//单个str、bin、array、map的上限，避免错误的数据导致分配过多内存
+const maxMsgpackLen = 64 << 20
+
+//array、map嵌套的最大层数，每层只要一个字节，不限制时恶意数据会递归耗尽栈
+const maxMsgpackDepth = 32
+
+//一条消息最多包含的值的个数
+const maxMsgpackElems = 1 << 20
+
+var errMsgpackLen = errors.New("msgpack length too large")
+var errMsgpackDepth = errors.New("msgpack nested too deep")
+var errMsgpackElems = errors.New("msgpack message has too many elements")
+var errMsgpackMessage = errors.New("msgpack message too large")
+
+type msgpackReader struct {
+	rd    *bufio.Reader
+	elems int   //这条消息还能读多少个值，由调用方在每条消息前用Reset重置
+	max   int64 //一条消息最多的字节数
+	left  int64 //这条消息还能读多少字节，和elems一起重置
+}
+
+//max为一条消息的字节数上限，单个str、bin仍受maxMsgpackLen限制
+func newMsgpackReader(rd io.Reader, max int64) *msgpackReader {
+	br, ok := rd.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(rd, 64*1024)
+	}
+	return &msgpackReader{rd: br, elems: maxMsgpackElems, max: max, left: max}
+}
+
+//开始读一条新的消息
+func (this *msgpackReader) Reset() {
+	this.elems = maxMsgpackElems
+	this.left = this.max
+}
+
+//读数据前先扣掉这条消息剩余的字节数
+func (this *msgpackReader) take(n uint64) error {
+	if n > uint64(this.left) {
+		this.left = -1
+		return errMsgpackMessage
+	}
+	this.left -= int64(n)
+	return nil
+}
+
+func (this *msgpackReader) n(size int) (uint64, error) {
+	if err := this.take(uint64(size)); err != nil {
+		return 0, err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(this.rd, b); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (this *msgpackReader) bytes(n uint64) ([]byte, error) {
+	if n > maxMsgpackLen {
+		return nil, errMsgpackLen
+	}
+	if err := this.take(n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(this.rd, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+//读一个值，数据读完时返回io.EOF
+func (this *msgpackReader) Read() (interface{}, error) {
+	return this.read(0)
+}
+
+//depth为所在的array、map的层数
+func (this *msgpackReader) read(depth int) (interface{}, error) {
+	c, err := this.rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if this.elems--; this.elems < 0 {
+		return nil, errMsgpackElems
+	}
+	if err := this.take(1); err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return this.readMap(uint64(c&0x0f), depth)
+	case c >= 0x90 && c <= 0x9f:
+		return this.readArray(uint64(c&0x0f), depth)
+	case c >= 0xa0 && c <= 0xbf:
+		b, err := this.bytes(uint64(c & 0x1f))
+		return string(b), err
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		//bin8/16/32、str8/16/32
+		size := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}[c]
+		n, err := this.n(size)
+		if err != nil {
+			return nil, err
+		}
+		b, err := this.bytes(n)
+		return string(b), err
+	case 0xc7, 0xc8, 0xc9:
+		//ext8/16/32
+		n, err := this.n(map[byte]int{0xc7: 1, 0xc8: 2, 0xc9: 4}[c])
+		if err != nil {
+			return nil, err
+		}
+		return this.readExt(n)
+	case 0xca:
+		n, err := this.n(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := this.n(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := this.n(1 << (c - 0xcc))
+		if n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err := this.n(size)
+		//符号扩展
+		shift := uint(64 - 8*size)
+		return int64(n<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		//fixext1/2/4/8/16
+		return this.readExt(1 << (c - 0xd4))
+	case 0xdc, 0xdd:
+		n, err := this.n(map[byte]int{0xdc: 2, 0xdd: 4}[c])
+		if err != nil {
+			return nil, err
+		}
+		return this.readArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := this.n(map[byte]int{0xde: 2, 0xdf: 4}[c])
+		if err != nil {
+			return nil, err
+		}
+		return this.readMap(n, depth)
+	}
+	return nil, fmt.Errorf("wrong msgpack type 0x%x", c)
+}
+
+//数据中间出错时不能返回io.EOF，否则会被当成正常结束
+func (this *msgpackReader) next(depth int) (interface{}, error) {
+	v, err := this.read(depth)
+	return v, unexpectedEOF(err)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (this *msgpackReader) readArray(n uint64, depth int) (interface{}, error) {
+	if n > maxMsgpackLen {
+		return nil, errMsgpackLen
+	}
+	if depth >= maxMsgpackDepth {
+		return nil, errMsgpackDepth
+	}
+	//长度来自数据，先不按它分配
+	arr := make([]interface{}, 0, minLen(n))
+	for i := uint64(0); i < n; i++ {
+		v, err := this.next(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (this *msgpackReader) readMap(n uint64, depth int) (interface{}, error) {
+	if n > maxMsgpackLen {
+		return nil, errMsgpackLen
+	}
+	if depth >= maxMsgpackDepth {
+		return nil, errMsgpackDepth
+	}
+	m := make(map[string]interface{}, minLen(n))
+	for i := uint64(0); i < n; i++ {
+		k, err := this.next(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := this.next(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := k.(string); ok {
+			m[s] = v
+		} else {
+			m[fmt.Sprint(k)] = v
+		}
+	}
+	return m, nil
+}
+
+func minLen(n uint64) int {
+	if n > 1024 {
+		return 1024
+	}
+	return int(n)
+}
+
+func (this *msgpackReader) readExt(n uint64) (interface{}, error) {
+	if err := this.take(1); err != nil {
+		return nil, err
+	}
+	typ, err := this.rd.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	b, err := this.bytes(n)
+	return msgpackExt{int8(typ), b}, err
+}
+
+//超过n字节时返回errMsgpackLen，用于限制解压后的大小，不能像io.LimitReader那样当成正常结束
+type capReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (this *capReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > this.n+1 {
+		p = p[:this.n+1]
+	}
+	n, err := this.rd.Read(p)
+	if this.n -= int64(n); this.n < 0 {
+		return 0, errMsgpackLen
+	}
+	return n, err
+}
+
+//应答只需要{"ack": chunk}
+func msgpackAck(chunk string) []byte {
+	b := []byte{0x81, 0xa3, 'a', 'c', 'k'}
+	switch n := len(chunk); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 256:
+		b = append(b, 0xd9, byte(n))
+	default:
+		b = append(b, 0xda, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(n))
+	}
+	return append(b, chunk...)
+}
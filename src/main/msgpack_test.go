@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+//测试用的编码，长度都用最长的格式，解码时各种格式由下面的表覆盖
+func mpEncode(v interface{}) []byte {
+	var b bytes.Buffer
+	mpWrite(&b, v)
+	return b.Bytes()
+}
+
+func mpWrite(b *bytes.Buffer, v interface{}) {
+	n := make([]byte, 8)
+	switch t := v.(type) {
+	case nil:
+		b.WriteByte(0xc0)
+	case bool:
+		if t {
+			b.WriteByte(0xc3)
+		} else {
+			b.WriteByte(0xc2)
+		}
+	case int:
+		b.WriteByte(0xd3)
+		binary.BigEndian.PutUint64(n, uint64(t))
+		b.Write(n)
+	case string:
+		b.WriteByte(0xdb)
+		binary.BigEndian.PutUint32(n, uint32(len(t)))
+		b.Write(n[:4])
+		b.WriteString(t)
+	case msgpackExt:
+		b.WriteByte(0xc7)
+		b.WriteByte(byte(len(t.data)))
+		b.WriteByte(byte(t.typ))
+		b.Write(t.data)
+	case []interface{}:
+		b.WriteByte(0xdd)
+		binary.BigEndian.PutUint32(n, uint32(len(t)))
+		b.Write(n[:4])
+		for _, e := range t {
+			mpWrite(b, e)
+		}
+	case map[string]interface{}:
+		b.WriteByte(0xdf)
+		binary.BigEndian.PutUint32(n, uint32(len(t)))
+		b.Write(n[:4])
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			mpWrite(b, k)
+			mpWrite(b, t[k])
+		}
+	default:
+		panic("mpEncode: unsupported type")
+	}
+}
+
+func TestMsgpackRead(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want interface{}
+	}{
+		{"positive fixint", []byte{0x05}, int64(5)},
+		{"negative fixint", []byte{0xff}, int64(-1)},
+		{"nil", []byte{0xc0}, nil},
+		{"false", []byte{0xc2}, false},
+		{"true", []byte{0xc3}, true},
+		{"uint8", []byte{0xcc, 0xc8}, int64(200)},
+		{"uint16", []byte{0xcd, 0x01, 0x00}, int64(256)},
+		{"uint64 over int64", []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint64(1<<64 - 1)},
+		{"int8", []byte{0xd0, 0x80}, int64(-128)},
+		{"int16", []byte{0xd1, 0xff, 0x00}, int64(-256)},
+		{"int32", []byte{0xd2, 0xff, 0xff, 0xff, 0xfe}, int64(-2)},
+		{"float32", []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, float64(1.5)},
+		{"float64", []byte{0xcb, 0x40, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, float64(2.5)},
+		{"fixstr", []byte{0xa3, 'a', 'b', 'c'}, "abc"},
+		{"str8", []byte{0xd9, 0x02, 'h', 'i'}, "hi"},
+		{"bin8", []byte{0xc4, 0x02, 0x00, 0x01}, "\x00\x01"},
+		{"fixarray", []byte{0x92, 0x01, 0xa1, 'x'}, []interface{}{int64(1), "x"}},
+		{"fixmap", []byte{0x81, 0xa1, 'k', 0x02}, map[string]interface{}{"k": int64(2)}},
+		{"map int key", []byte{0x81, 0x07, 0xc3}, map[string]interface{}{"7": true}},
+		{"fixext4", []byte{0xd6, 0x00, 1, 2, 3, 4}, msgpackExt{0, []byte{1, 2, 3, 4}}},
+		{"ext8", []byte{0xc7, 0x02, 0x05, 9, 9}, msgpackExt{5, []byte{9, 9}}},
+		{"encoded", mpEncode(map[string]interface{}{"a": []interface{}{1, "b", nil}}), map[string]interface{}{"a": []interface{}{int64(1), "b", nil}}},
+	}
+	for _, tt := range tests {
+		rd := newMsgpackReader(bytes.NewReader(tt.in), 1<<20)
+		got, err := rd.Read()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+		if _, err := rd.Read(); err != io.EOF {
+			t.Errorf("%s: trailing read got %v, want EOF", tt.name, err)
+		}
+	}
+}
+
+func TestMsgpackReadErrors(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x91}, maxMsgpackDepth+1)
+	deep = append(deep, 0x01)
+	tests := []struct {
+		name string
+		in   []byte
+		max  int64
+		want error
+	}{
+		{"truncated str", []byte{0xa3, 'a'}, 1 << 20, io.ErrUnexpectedEOF},
+		{"truncated array", []byte{0x92, 0x01}, 1 << 20, io.ErrUnexpectedEOF},
+		{"str too long", []byte{0xdb, 0x7f, 0xff, 0xff, 0xff}, 1 << 40, errMsgpackLen},
+		{"array too long", []byte{0xdd, 0x7f, 0xff, 0xff, 0xff}, 1 << 40, errMsgpackLen},
+		{"too deep", deep, 1 << 20, errMsgpackDepth},
+		{"message too large", mpEncode([]interface{}{"0123456789", "0123456789"}), 20, errMsgpackMessage},
+		{"str over message", []byte{0xd9, 0x10}, 8, errMsgpackMessage},
+	}
+	for _, tt := range tests {
+		rd := newMsgpackReader(bytes.NewReader(tt.in), tt.max)
+		if _, err := rd.Read(); err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if _, err := newMsgpackReader(bytes.NewReader([]byte{0xc1}), 1<<20).Read(); err == nil {
+		t.Errorf("never used type 0xc1: want error")
+	}
+}
+
+//上限按每条消息计，Reset后重新计算
+func TestMsgpackReset(t *testing.T) {
+	msg := mpEncode([]interface{}{"0123456789"})
+	in := append(append([]byte{}, msg...), msg...)
+	rd := newMsgpackReader(bytes.NewReader(in), int64(len(msg)))
+	for i := 0; i < 2; i++ {
+		rd.Reset()
+		if _, err := rd.Read(); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	rd = newMsgpackReader(bytes.NewReader(in), int64(len(msg)))
+	if _, err := rd.Read(); err != nil {
+		t.Fatalf("first message: %v", err)
+	}
+	if _, err := rd.Read(); err != errMsgpackMessage {
+		t.Errorf("without Reset: got %v, want %v", err, errMsgpackMessage)
+	}
+}
+
+func TestMsgpackAck(t *testing.T) {
+	for _, n := range []int{0, 31, 32, 255, 256, 1000} {
+		chunk := string(bytes.Repeat([]byte{'c'}, n))
+		v, err := newMsgpackReader(bytes.NewReader(msgpackAck(chunk)), 1<<20).Read()
+		if err != nil {
+			t.Fatalf("chunk of %d: %v", n, err)
+		}
+		if !reflect.DeepEqual(v, map[string]interface{}{"ack": chunk}) {
+			t.Errorf("chunk of %d: got %#v", n, v)
+		}
+	}
+}
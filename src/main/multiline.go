@@ -0,0 +1,88 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"loglib"
+)
+
+/*
+* 多行日志的合并，如java的异常堆栈
+* line_pattern默认匹配一条日志的第一行，line_pattern_type = continue时匹配续行，
+* 合并后的多行作为一条日志发给receiver，断点只记录在完整的一条日志之后
+ */
+type multiline struct {
+	pattern    *regexp.Regexp
+	isContinue bool //pattern匹配的是续行
+	maxLines   int
+	maxBytes   int
+	timeout    time.Duration //最后一行之后这么久没有新行，就认为这条日志结束了
+	buf        []byte
+	nLines     int
+	offset     int64     //已合并的最后一行的末尾偏移
+	last       time.Time //最后一次合并行的时间
+}
+
+//没有配置line_pattern时返回nil，按行发送
+func newMultiline(config map[string]string) *multiline {
+	expr := config["line_pattern"]
+	if expr == "" {
+		return nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		loglib.Error("wrong line_pattern " + expr + ": " + err.Error() + ", multiline disabled")
+		return nil
+	}
+	m := &multiline{pattern: re, isContinue: config["line_pattern_type"] == "continue", maxLines: 500, maxBytes: 1024 * 1024, timeout: 3 * time.Second}
+	if n, err := strconv.Atoi(config["multiline_max_lines"]); err == nil && n > 0 {
+		m.maxLines = n
+	}
+	if n, err := strconv.Atoi(config["multiline_max_bytes"]); err == nil && n > 0 {
+		m.maxBytes = n
+	}
+	if n, err := strconv.Atoi(config["multiline_timeout"]); err == nil && n > 0 {
+		m.timeout = time.Duration(n) * time.Second
+	}
+	return m
+}
+
+//是否是一条新日志的开始
+func (m *multiline) isStart(line string) bool {
+	return m.pattern.MatchString(line) != m.isContinue
+}
+
+//加入一行，offset为该行的末尾偏移
+//遇到新日志的开始或者超过限制时，返回之前合并好的日志及其末尾偏移
+func (m *multiline) add(line string, offset int64) (record string, end int64, ok bool) {
+	if m.nLines > 0 && (m.isStart(line) || m.nLines >= m.maxLines || len(m.buf)+len(line) > m.maxBytes) {
+		record, end, ok = m.flush()
+	}
+	m.buf = append(m.buf, line...)
+	m.nLines++
+	m.offset = offset
+	m.last = time.Now()
+	return
+}
+
+func (m *multiline) pending() bool {
+	return m.nLines > 0
+}
+
+//距离超时还有多久，小于等于0表示已超时
+func (m *multiline) timeLeft() time.Duration {
+	return m.timeout - time.Now().Sub(m.last)
+}
+
+//返回正在合并的日志
+func (m *multiline) flush() (record string, end int64, ok bool) {
+	if m.nLines == 0 {
+		return "", 0, false
+	}
+	record, end = string(m.buf), m.offset
+	m.buf = m.buf[:0]
+	m.nLines = 0
+	return record, end, true
+}
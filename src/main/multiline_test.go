@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMultiline(t *testing.T) {
+	type record struct {
+		s   string
+		end int64
+	}
+	tests := []struct {
+		name   string
+		config map[string]string
+		lines  []string
+		want   []record //最后flush得到的也算在内
+	}{
+		{"java stack", map[string]string{"line_pattern": `^\d{4}-`},
+			[]string{"2026-10-17 a\n", "\tat x\n", "\tat y\n", "2026-10-17 b\n", "2026-10-17 c\n", "\tat z\n"},
+			[]record{{"2026-10-17 a\n\tat x\n\tat y\n", 3}, {"2026-10-17 b\n", 4}, {"2026-10-17 c\n\tat z\n", 6}}},
+		{"continue pattern", map[string]string{"line_pattern": `^\s`, "line_pattern_type": "continue"},
+			[]string{"a\n", " a1\n", "b\n", "c\n", " c1\n", " c2\n"},
+			[]record{{"a\n a1\n", 2}, {"b\n", 3}, {"c\n c1\n c2\n", 6}}},
+		{"leading continuation", map[string]string{"line_pattern": `^\d`},
+			[]string{"  orphan\n", "1 a\n"},
+			[]record{{"  orphan\n", 1}, {"1 a\n", 2}}},
+		{"max lines", map[string]string{"line_pattern": `^\d`, "multiline_max_lines": "2"},
+			[]string{"1\n", "x\n", "y\n", "z\n"},
+			[]record{{"1\nx\n", 2}, {"y\nz\n", 4}}},
+		{"max bytes", map[string]string{"line_pattern": `^\d`, "multiline_max_bytes": "6"},
+			[]string{"1 a\n", "bb\n", "cc\n"},
+			[]record{{"1 a\n", 1}, {"bb\ncc\n", 3}}},
+	}
+	for _, tt := range tests {
+		m := newMultiline(tt.config)
+		got := make([]record, 0)
+		for i, l := range tt.lines {
+			if s, end, ok := m.add(l, int64(i+1)); ok {
+				got = append(got, record{s, end})
+			}
+		}
+		if !m.pending() {
+			t.Errorf("%s: nothing pending at the end", tt.name)
+		}
+		if s, end, ok := m.flush(); ok {
+			got = append(got, record{s, end})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+		if m.pending() {
+			t.Errorf("%s: pending after flush", tt.name)
+		}
+	}
+}
+
+func TestNewMultiline(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		enabled bool
+		timeout time.Duration
+	}{
+		{"not configured", map[string]string{}, false, 0},
+		{"wrong pattern", map[string]string{"line_pattern": "("}, false, 0},
+		{"default timeout", map[string]string{"line_pattern": "^a"}, true, 3 * time.Second},
+		{"timeout", map[string]string{"line_pattern": "^a", "multiline_timeout": "10"}, true, 10 * time.Second},
+		{"wrong timeout", map[string]string{"line_pattern": "^a", "multiline_timeout": "-1"}, true, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		m := newMultiline(tt.config)
+		if (m != nil) != tt.enabled {
+			t.Errorf("%s: got %v", tt.name, m)
+			continue
+		}
+		if m != nil && m.timeout != tt.timeout {
+			t.Errorf("%s: timeout %v, want %v", tt.name, m.timeout, tt.timeout)
+		}
+	}
+}
+
+func TestMultilineTimeLeft(t *testing.T) {
+	m := newMultiline(map[string]string{"line_pattern": "^a", "multiline_timeout": "1"})
+	m.add("a\n", 2)
+	if left := m.timeLeft(); left <= 0 || left > time.Second {
+		t.Errorf("time left %v just after add", left)
+	}
+	m.last = time.Now().Add(-2 * time.Second)
+	if left := m.timeLeft(); left > 0 {
+		t.Errorf("time left %v after timeout", left)
+	}
+}
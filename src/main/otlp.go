@@ -0,0 +1,627 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+* OpenTelemetry的日志：logd otlp config.ini
+* 按OTLP/HTTP接收日志，默认path为/v1/logs，body为protobuf（application/x-protobuf）或json（application/json），支持gzip
+* line_format为json（默认）时每条LogRecord转为一行json，带上时间、级别、body、属性、resource属性、scope和trace；
+* 为text时只发送body
+* 按LogRecord的时间划分周期，route_attributes中的resource属性（默认service.name）写到包头，属性名中的.换成_
+* 认证、限流、排队太多时返回429与[http]相同
+ */
+type otlpResourceLogs struct {
+	resource map[string]interface{}
+	scopes   []otlpScopeLogs
+}
+
+type otlpScopeLogs struct {
+	name    string
+	records []otlpLogRecord
+}
+
+type otlpLogRecord struct {
+	time           uint64
+	observedTime   uint64
+	severityNumber int64
+	severityText   string
+	body           interface{}
+	attributes     map[string]interface{}
+	traceId        []byte
+	spanId         []byte
+}
+
+var errProtobuf = errors.New("malformed protobuf")
+var errOtlpDepth = errors.New("otlp value nested too deep")
+
+//AnyValue中array、kvlist嵌套的最大层数，过深的嵌套会递归耗尽栈
+const otlpMaxDepth = 64
+
+func otlpGo(cfg map[string]map[string]string) {
+	h := newHttpInput(cfg, "otlp", "/v1/logs")
+	textFormat := h.config["line_format"] == "text"
+	routeAttrs := []string{"service.name"}
+	if val, ok := h.config["route_attributes"]; ok {
+		routeAttrs = routeAttrs[:0]
+		for _, k := range strings.Split(val, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				routeAttrs = append(routeAttrs, k)
+			}
+		}
+	}
+	h.decode = func(req *http.Request, body io.Reader) ([]inputLine, error) {
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		var logs []otlpResourceLogs
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			logs, err = decodeOtlpJson(b)
+		} else {
+			logs, err = decodeOtlpProto(b)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return otlpLines(logs, textFormat, routeAttrs), nil
+	}
+	//应答为空的ExportLogsServiceResponse
+	h.respond = func(w http.ResponseWriter, req *http.Request, n int) {
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		} else {
+			w.Header().Set("Content-Type", "application/x-protobuf")
+		}
+	}
+	runInput("otlp", cfg, h.config, h.sink, []inputServer{h})
+}
+
+func otlpLines(logs []otlpResourceLogs, textFormat bool, routeAttrs []string) []inputLine {
+	lines := make([]inputLine, 0)
+	for _, rl := range logs {
+		tags := make(map[string]string)
+		for _, k := range routeAttrs {
+			if v, ok := rl.resource[k]; ok {
+				tags[strings.Replace(k, ".", "_", -1)] = anyToString(v)
+			}
+		}
+		for _, sl := range rl.scopes {
+			for _, r := range sl.records {
+				ts := r.time
+				if ts == 0 {
+					ts = r.observedTime
+				}
+				var t time.Time
+				if ts > 0 {
+					t = time.Unix(0, int64(ts))
+				}
+				var line string
+				if textFormat {
+					line = anyToString(r.body)
+				} else {
+					line = otlpJsonLine(rl.resource, sl.name, r, t)
+				}
+				lines = append(lines, inputLine{t: t, line: escapeNewline(strings.TrimRight(line, "\r\n")) + "\n", tags: tags})
+			}
+		}
+	}
+	return lines
+}
+
+func otlpJsonLine(resource map[string]interface{}, scope string, r otlpLogRecord, t time.Time) string {
+	m := make(map[string]interface{})
+	if !t.IsZero() {
+		m["time"] = t.Format(time.RFC3339Nano)
+	}
+	if r.severityText != "" {
+		m["severity"] = r.severityText
+	}
+	if r.severityNumber != 0 {
+		m["severity_number"] = r.severityNumber
+	}
+	m["body"] = r.body
+	if len(r.attributes) > 0 {
+		m["attributes"] = r.attributes
+	}
+	if len(resource) > 0 {
+		m["resource"] = resource
+	}
+	if scope != "" {
+		m["scope"] = scope
+	}
+	if len(r.traceId) > 0 {
+		m["trace_id"] = hex.EncodeToString(r.traceId)
+	}
+	if len(r.spanId) > 0 {
+		m["span_id"] = hex.EncodeToString(r.spanId)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		//NaN等无法转为json的值
+		return fmt.Sprintf("%v", m)
+	}
+	return string(b)
+}
+
+func anyToString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []byte:
+		return base64.StdEncoding.EncodeToString(val)
+	case bool, int64, float64:
+		return fmt.Sprintf("%v", val)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+//---------- protobuf ----------
+
+//protobuf的编码，只处理用到的几种类型
+type pbReader struct {
+	b []byte
+}
+
+func (this *pbReader) more() bool {
+	return len(this.b) > 0
+}
+
+func (this *pbReader) varint() (uint64, error) {
+	n, size := binary.Uvarint(this.b)
+	if size <= 0 {
+		return 0, errProtobuf
+	}
+	this.b = this.b[size:]
+	return n, nil
+}
+
+//返回字段号和wire type
+func (this *pbReader) key() (int, int, error) {
+	k, err := this.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(k >> 3), int(k & 7), nil
+}
+
+func (this *pbReader) bytes() ([]byte, error) {
+	n, err := this.varint()
+	if err != nil || n > uint64(len(this.b)) {
+		return nil, errProtobuf
+	}
+	b := this.b[:n]
+	this.b = this.b[n:]
+	return b, nil
+}
+
+func (this *pbReader) fixed64() (uint64, error) {
+	if len(this.b) < 8 {
+		return 0, errProtobuf
+	}
+	n := binary.LittleEndian.Uint64(this.b)
+	this.b = this.b[8:]
+	return n, nil
+}
+
+//跳过不关心的字段
+func (this *pbReader) skip(wt int) error {
+	var err error
+	switch wt {
+	case 0:
+		_, err = this.varint()
+	case 1:
+		_, err = this.fixed64()
+	case 2:
+		_, err = this.bytes()
+	case 5:
+		if len(this.b) < 4 {
+			return errProtobuf
+		}
+		this.b = this.b[4:]
+	default:
+		return errProtobuf
+	}
+	return err
+}
+
+//遍历一个消息的字段，f处理关心的字段，返回false的字段被跳过
+func pbFields(b []byte, f func(field int, wt int, r *pbReader) (bool, error)) error {
+	r := &pbReader{b}
+	for r.more() {
+		field, wt, err := r.key()
+		if err != nil {
+			return err
+		}
+		handled, err := f(field, wt, r)
+		if err != nil {
+			return err
+		}
+		if !handled {
+			if err = r.skip(wt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//length-delimited的字段
+func pbMessage(wt int, r *pbReader) ([]byte, error) {
+	if wt != 2 {
+		return nil, errProtobuf
+	}
+	return r.bytes()
+}
+
+//ExportLogsServiceRequest: 1 resource_logs
+func decodeOtlpProto(b []byte) ([]otlpResourceLogs, error) {
+	logs := make([]otlpResourceLogs, 0)
+	err := pbFields(b, func(field int, wt int, r *pbReader) (bool, error) {
+		if field != 1 {
+			return false, nil
+		}
+		msg, err := pbMessage(wt, r)
+		if err != nil {
+			return true, err
+		}
+		rl, err := decodeResourceLogs(msg)
+		logs = append(logs, rl)
+		return true, err
+	})
+	return logs, err
+}
+
+//ResourceLogs: 1 resource, 2 scope_logs
+func decodeResourceLogs(b []byte) (otlpResourceLogs, error) {
+	rl := otlpResourceLogs{resource: make(map[string]interface{})}
+	err := pbFields(b, func(field int, wt int, r *pbReader) (bool, error) {
+		if field != 1 && field != 2 {
+			return false, nil
+		}
+		msg, err := pbMessage(wt, r)
+		if err != nil {
+			return true, err
+		}
+		if field == 1 {
+			//Resource: 1 attributes
+			return true, pbFields(msg, func(field int, wt int, r *pbReader) (bool, error) {
+				if field != 1 {
+					return false, nil
+				}
+				return true, decodeKeyValueField(wt, r, rl.resource, 0)
+			})
+		}
+		sl, err := decodeScopeLogs(msg)
+		rl.scopes = append(rl.scopes, sl)
+		return true, err
+	})
+	return rl, err
+}
+
+//ScopeLogs: 1 scope（InstrumentationScope: 1 name），2 log_records
+func decodeScopeLogs(b []byte) (otlpScopeLogs, error) {
+	var sl otlpScopeLogs
+	err := pbFields(b, func(field int, wt int, r *pbReader) (bool, error) {
+		if field != 1 && field != 2 {
+			return false, nil
+		}
+		msg, err := pbMessage(wt, r)
+		if err != nil {
+			return true, err
+		}
+		if field == 1 {
+			return true, pbFields(msg, func(field int, wt int, r *pbReader) (bool, error) {
+				if field != 1 {
+					return false, nil
+				}
+				name, err := pbMessage(wt, r)
+				sl.name = string(name)
+				return true, err
+			})
+		}
+		rec, err := decodeLogRecord(msg)
+		sl.records = append(sl.records, rec)
+		return true, err
+	})
+	return sl, err
+}
+
+//LogRecord: 1 time_unix_nano，11 observed_time_unix_nano，2 severity_number，3 severity_text，
+//5 body，6 attributes，9 trace_id，10 span_id
+func decodeLogRecord(b []byte) (otlpLogRecord, error) {
+	rec := otlpLogRecord{attributes: make(map[string]interface{})}
+	err := pbFields(b, func(field int, wt int, r *pbReader) (bool, error) {
+		var err error
+		var msg []byte
+		switch field {
+		case 1, 11:
+			if wt != 1 {
+				return true, errProtobuf
+			}
+			var n uint64
+			n, err = r.fixed64()
+			if field == 1 {
+				rec.time = n
+			} else {
+				rec.observedTime = n
+			}
+		case 2:
+			if wt != 0 {
+				return true, errProtobuf
+			}
+			var n uint64
+			n, err = r.varint()
+			rec.severityNumber = int64(n)
+		case 3, 5, 9, 10:
+			if msg, err = pbMessage(wt, r); err != nil {
+				return true, err
+			}
+			switch field {
+			case 3:
+				rec.severityText = string(msg)
+			case 5:
+				rec.body, err = decodeAnyValue(msg, 0)
+			case 9:
+				rec.traceId = msg
+			case 10:
+				rec.spanId = msg
+			}
+		case 6:
+			err = decodeKeyValueField(wt, r, rec.attributes, 0)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return rec, err
+}
+
+//KeyValue: 1 key，2 value，depth为value的嵌套层数
+func decodeKeyValueField(wt int, r *pbReader, m map[string]interface{}, depth int) error {
+	msg, err := pbMessage(wt, r)
+	if err != nil {
+		return err
+	}
+	var key string
+	var value interface{}
+	err = pbFields(msg, func(field int, wt int, r *pbReader) (bool, error) {
+		if field != 1 && field != 2 {
+			return false, nil
+		}
+		b, err := pbMessage(wt, r)
+		if err != nil {
+			return true, err
+		}
+		if field == 1 {
+			key = string(b)
+		} else {
+			value, err = decodeAnyValue(b, depth)
+		}
+		return true, err
+	})
+	if err == nil && key != "" {
+		m[key] = value
+	}
+	return err
+}
+
+//AnyValue: 1 string，2 bool，3 int，4 double，5 array，6 kvlist，7 bytes
+func decodeAnyValue(b []byte, depth int) (interface{}, error) {
+	if depth > otlpMaxDepth {
+		return nil, errProtobuf
+	}
+	var value interface{}
+	err := pbFields(b, func(field int, wt int, r *pbReader) (bool, error) {
+		switch field {
+		case 2, 3:
+			if wt != 0 {
+				return true, errProtobuf
+			}
+			n, err := r.varint()
+			if field == 2 {
+				value = n != 0
+			} else {
+				value = int64(n)
+			}
+			return true, err
+		case 4:
+			if wt != 1 {
+				return true, errProtobuf
+			}
+			n, err := r.fixed64()
+			value = math.Float64frombits(n)
+			return true, err
+		case 1, 5, 6, 7:
+		default:
+			return false, nil
+		}
+		msg, err := pbMessage(wt, r)
+		if err != nil {
+			return true, err
+		}
+		switch field {
+		case 1:
+			value = string(msg)
+		case 5:
+			//ArrayValue: 1 values
+			arr := make([]interface{}, 0)
+			err = pbFields(msg, func(field int, wt int, r *pbReader) (bool, error) {
+				if field != 1 {
+					return false, nil
+				}
+				b, err := pbMessage(wt, r)
+				if err != nil {
+					return true, err
+				}
+				v, err := decodeAnyValue(b, depth+1)
+				arr = append(arr, v)
+				return true, err
+			})
+			value = arr
+		case 6:
+			//KeyValueList: 1 values
+			kv := make(map[string]interface{})
+			err = pbFields(msg, func(field int, wt int, r *pbReader) (bool, error) {
+				if field != 1 {
+					return false, nil
+				}
+				return true, decodeKeyValueField(wt, r, kv, depth+1)
+			})
+			value = kv
+		case 7:
+			value = msg
+		}
+		return true, err
+	})
+	return value, err
+}
+
+//---------- json ----------
+
+//OTLP的json编码：字段名为lowerCamelCase，64位整数为字符串，trace_id和span_id为hex
+type otlpJsonRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpJsonKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			LogRecords []struct {
+				TimeUnixNano         json.Number        `json:"timeUnixNano"`
+				ObservedTimeUnixNano json.Number        `json:"observedTimeUnixNano"`
+				SeverityNumber       int64              `json:"severityNumber"`
+				SeverityText         string             `json:"severityText"`
+				Body                 *otlpJsonAnyValue  `json:"body"`
+				Attributes           []otlpJsonKeyValue `json:"attributes"`
+				TraceId              string             `json:"traceId"`
+				SpanId               string             `json:"spanId"`
+			} `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type otlpJsonKeyValue struct {
+	Key   string            `json:"key"`
+	Value *otlpJsonAnyValue `json:"value"`
+}
+
+type otlpJsonAnyValue struct {
+	StringValue *string      `json:"stringValue"`
+	BoolValue   *bool        `json:"boolValue"`
+	IntValue    *json.Number `json:"intValue"`
+	DoubleValue *float64     `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []*otlpJsonAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpJsonKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+	BytesValue *string `json:"bytesValue"`
+}
+
+func decodeOtlpJson(b []byte) ([]otlpResourceLogs, error) {
+	var req otlpJsonRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	logs := make([]otlpResourceLogs, 0, len(req.ResourceLogs))
+	for _, jrl := range req.ResourceLogs {
+		resource, err := jsonKeyValues(jrl.Resource.Attributes, 0)
+		if err != nil {
+			return nil, err
+		}
+		rl := otlpResourceLogs{resource: resource}
+		for _, jsl := range jrl.ScopeLogs {
+			sl := otlpScopeLogs{name: jsl.Scope.Name}
+			for _, jr := range jsl.LogRecords {
+				rec := otlpLogRecord{
+					severityNumber: jr.SeverityNumber,
+					severityText:   jr.SeverityText,
+				}
+				if rec.body, err = jr.Body.value(0); err != nil {
+					return nil, err
+				}
+				if rec.attributes, err = jsonKeyValues(jr.Attributes, 0); err != nil {
+					return nil, err
+				}
+				rec.time, _ = strconv.ParseUint(jr.TimeUnixNano.String(), 10, 64)
+				rec.observedTime, _ = strconv.ParseUint(jr.ObservedTimeUnixNano.String(), 10, 64)
+				rec.traceId, _ = hex.DecodeString(jr.TraceId)
+				rec.spanId, _ = hex.DecodeString(jr.SpanId)
+				sl.records = append(sl.records, rec)
+			}
+			rl.scopes = append(rl.scopes, sl)
+		}
+		logs = append(logs, rl)
+	}
+	return logs, nil
+}
+
+func jsonKeyValues(kvs []otlpJsonKeyValue, depth int) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		if kv.Key != "" {
+			v, err := kv.Value.value(depth)
+			if err != nil {
+				return nil, err
+			}
+			m[kv.Key] = v
+		}
+	}
+	return m, nil
+}
+
+//depth为嵌套层数，与protobuf一样不超过otlpMaxDepth
+func (this *otlpJsonAnyValue) value(depth int) (interface{}, error) {
+	if depth > otlpMaxDepth {
+		return nil, errOtlpDepth
+	}
+	switch {
+	case this == nil:
+		return nil, nil
+	case this.StringValue != nil:
+		return *this.StringValue, nil
+	case this.BoolValue != nil:
+		return *this.BoolValue, nil
+	case this.IntValue != nil:
+		n, _ := strconv.ParseInt(this.IntValue.String(), 10, 64)
+		return n, nil
+	case this.DoubleValue != nil:
+		return *this.DoubleValue, nil
+	case this.ArrayValue != nil:
+		arr := make([]interface{}, len(this.ArrayValue.Values))
+		for i, v := range this.ArrayValue.Values {
+			var err error
+			if arr[i], err = v.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case this.KvlistValue != nil:
+		return jsonKeyValues(this.KvlistValue.Values, depth+1)
+	case this.BytesValue != nil:
+		b, _ := base64.StdEncoding.DecodeString(*this.BytesValue)
+		return b, nil
+	}
+	return nil, nil
+}
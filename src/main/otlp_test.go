@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//测试用的protobuf编码
+func pbTag(field int, wt int) []byte {
+	return binary.AppendUvarint(nil, uint64(field<<3|wt))
+}
+
+func pbLen(field int, parts ...[]byte) []byte {
+	b := bytes.Join(parts, nil)
+	return append(binary.AppendUvarint(pbTag(field, 2), uint64(len(b))), b...)
+}
+
+func pbStr(field int, s string) []byte {
+	return pbLen(field, []byte(s))
+}
+
+func pbUint(field int, n uint64) []byte {
+	return binary.AppendUvarint(pbTag(field, 0), n)
+}
+
+func pbFixed(field int, n uint64) []byte {
+	return binary.LittleEndian.AppendUint64(pbTag(field, 1), n)
+}
+
+//KeyValue，value为编码好的AnyValue的字段
+func pbKV(field int, key string, value ...[]byte) []byte {
+	return pbLen(field, pbStr(1, key), pbLen(2, value...))
+}
+
+const otlpTestNano = 1792224000123456789
+
+var otlpTestTime = time.Unix(0, otlpTestNano).Format(time.RFC3339Nano)
+
+//两种编码的同一个请求：一条完整的LogRecord，一条只有observed时间、body为kvlist的
+func otlpTestProto() []byte {
+	resource := pbLen(1, pbKV(1, "service.name", pbStr(1, "web")), pbKV(1, "host", pbStr(1, "h1")))
+	rec1 := bytes.Join([][]byte{
+		pbFixed(1, otlpTestNano),
+		pbUint(2, 9),
+		pbStr(3, "INFO"),
+		pbLen(5, pbStr(1, "hello\nworld")),
+		pbKV(6, "n", pbUint(3, 3)),
+		pbKV(6, "ok", pbUint(2, 1)),
+		pbKV(6, "d", pbFixed(4, math.Float64bits(1.5))),
+		pbKV(6, "arr", pbLen(5, pbLen(1, pbStr(1, "a")), pbLen(1, pbUint(3, 2)))),
+		pbKV(6, "kv", pbLen(6, pbKV(1, "x", pbStr(1, "y")))),
+		pbKV(6, "b", pbLen(7, []byte{1, 2})),
+		pbLen(9, []byte{0xab, 0xcd}),
+		pbLen(10, []byte{0xef}),
+		pbUint(15, 7), //不认识的字段跳过
+	}, nil)
+	rec2 := bytes.Join([][]byte{
+		pbFixed(11, otlpTestNano),
+		pbLen(5, pbLen(6, pbKV(1, "k", pbStr(1, "v")))),
+	}, nil)
+	scope := pbLen(2, pbLen(1, pbStr(1, "lib")), pbLen(2, rec1), pbLen(2, rec2))
+	return pbLen(1, resource, scope)
+}
+
+var otlpTestJson = `{"resourceLogs":[{
+	"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"web"}},{"key":"host","value":{"stringValue":"h1"}}]},
+	"scopeLogs":[{"scope":{"name":"lib"},"logRecords":[
+		{"timeUnixNano":"1792224000123456789","severityNumber":9,"severityText":"INFO","body":{"stringValue":"hello\nworld"},
+		 "attributes":[{"key":"n","value":{"intValue":"3"}},{"key":"ok","value":{"boolValue":true}},{"key":"d","value":{"doubleValue":1.5}},
+		   {"key":"arr","value":{"arrayValue":{"values":[{"stringValue":"a"},{"intValue":2}]}}},
+		   {"key":"kv","value":{"kvlistValue":{"values":[{"key":"x","value":{"stringValue":"y"}}]}}},
+		   {"key":"b","value":{"bytesValue":"AQI="}}],
+		 "traceId":"abcd","spanId":"ef","droppedAttributesCount":0},
+		{"observedTimeUnixNano":"1792224000123456789","body":{"kvlistValue":{"values":[{"key":"k","value":{"stringValue":"v"}}]}}}
+	]}]}]}`
+
+func TestOtlpDecode(t *testing.T) {
+	tags := map[string]string{"service_name": "web"}
+	tm := time.Unix(0, otlpTestNano)
+	resource := `"resource":{"host":"h1","service.name":"web"},"scope":"lib"`
+	wantJson := []inputLine{
+		{tm, `{"attributes":{"arr":["a",2],"b":"AQI=","d":1.5,"kv":{"x":"y"},"n":3,"ok":true},"body":"hello\nworld",` + resource +
+			`,"severity":"INFO","severity_number":9,"span_id":"ef","time":"` + otlpTestTime + `","trace_id":"abcd"}` + "\n", tags},
+		{tm, `{"body":{"k":"v"},` + resource + `,"time":"` + otlpTestTime + `"}` + "\n", tags},
+	}
+	wantText := []inputLine{
+		{tm, `hello\nworld` + "\n", tags},
+		{tm, `{"k":"v"}` + "\n", tags},
+	}
+	tests := []struct {
+		name   string
+		decode func([]byte) ([]otlpResourceLogs, error)
+		in     []byte
+	}{
+		{"protobuf", decodeOtlpProto, otlpTestProto()},
+		{"json", decodeOtlpJson, []byte(otlpTestJson)},
+	}
+	for _, tt := range tests {
+		logs, err := tt.decode(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		for _, format := range []struct {
+			text bool
+			want []inputLine
+		}{{false, wantJson}, {true, wantText}} {
+			got := otlpLines(logs, format.text, []string{"service.name", "missing"})
+			if len(got) != len(format.want) {
+				t.Errorf("%s text=%v: got %d lines", tt.name, format.text, len(got))
+				continue
+			}
+			for i, l := range got {
+				w := format.want[i]
+				if !l.t.Equal(w.t) || l.line != w.line || !reflect.DeepEqual(l.tags, w.tags) {
+					t.Errorf("%s text=%v line %d:\n got %v %q %v\nwant %v %q %v", tt.name, format.text, i, l.t, l.line, l.tags, w.t, w.line, w.tags)
+				}
+			}
+		}
+	}
+}
+
+func TestOtlpDecodeErrors(t *testing.T) {
+	deepProto := pbStr(1, "x")
+	deepJson := `{"stringValue":"x"}`
+	for i := 0; i <= otlpMaxDepth+1; i++ {
+		deepProto = pbLen(5, pbLen(1, deepProto))
+		deepJson = `{"arrayValue":{"values":[` + deepJson + `]}}`
+	}
+	wrap := func(rec []byte) []byte {
+		return pbLen(1, pbLen(2, pbLen(2, rec)))
+	}
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"truncated", otlpTestProto()[:20]},
+		{"length beyond end", []byte{0x0a, 0x10, 0x01}},
+		{"resource_logs not message", pbUint(1, 1)},
+		{"time not fixed64", wrap(pbUint(1, 5))},
+		{"severity not varint", wrap(pbStr(2, "x"))},
+		{"wrong wire type", wrap([]byte{0x0b})},
+		{"too deep", wrap(pbLen(5, deepProto))},
+	}
+	for _, tt := range tests {
+		if _, err := decodeOtlpProto(tt.in); err == nil {
+			t.Errorf("protobuf %s: want error", tt.name)
+		}
+	}
+	for _, in := range []string{
+		`{"resourceLogs":[`,
+		`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"body":` + deepJson + `}]}]}]}`,
+	} {
+		if _, err := decodeOtlpJson([]byte(in)); err == nil {
+			t.Errorf("json %.40s: want error", in)
+		}
+	}
+	//空的请求
+	for _, in := range [][]byte{nil, pbUint(2, 1)} {
+		if logs, err := decodeOtlpProto(in); err != nil || len(logs) != 0 {
+			t.Errorf("protobuf %x: got %v %v", in, logs, err)
+		}
+	}
+}
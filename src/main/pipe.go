@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"lib"
+	"loglib"
+)
+
+/*
+* 发送标准输入的日志：zcat access.log.2026101715.gz | logd pipe -config x.ini -hour 2026101715 [-repull]
+* 配置在[pipe]段，send_to等没有配置时使用[tail]中的
+* 指定-hour时所有行都属于这个周期，否则按time_layout、time_pattern解析每行的时间划分周期，
+* 解析不出时间或时间比现在超前一个周期以上的行跟随上一行，时间早于当前周期的行算到当前周期；读完后每个周期都发送结束包
+* 包的id每个周期从1开始，包头的source默认为pipe，同一周期重复发送时需要-repull，否则被收集端当成重复包
+* 发送失败的包缓存在单独的目录，等到所有包都被collector确认后退出，退出码为0；
+* 被中断或读完后连续done_timeout秒没有发出包时，没有确认的包留在缓存目录，下次运行pipe时继续发送，退出码为1
+ */
+type pipeOptions struct {
+	config  string
+	hour    string
+	repull  bool
+	source  string
+	senders int
+}
+
+var pipeCacheDir = "tempfile_pipe"
+
+//第一条带时间的行之前最多缓存多少行
+var pipeMaxPending = 10000
+
+func parsePipeArgs(args []string) *pipeOptions {
+	opt := &pipeOptions{}
+	fs := flag.NewFlagSet("pipe", flag.ExitOnError)
+	fs.StringVar(&opt.config, "config", "", "config file")
+	fs.StringVar(&opt.hour, "hour", "", "period of all lines, such as 2026101715, default by the time of each line")
+	fs.BoolVar(&opt.repull, "repull", false, "mark packs as repull, needed when the period has been sent before")
+	fs.StringVar(&opt.source, "source", "", "source in pack header, default source in [pipe] or pipe")
+	fs.IntVar(&opt.senders, "senders", 0, "number of senders, default senders in [pipe]")
+	fs.Parse(args)
+	if opt.config == "" {
+		fmt.Println("usage: logd pipe -config x.ini [-hour 2026101715] [-repull] [-source name] < logs")
+		os.Exit(1)
+	}
+	return opt
+}
+
+func pipeGo(cfg map[string]map[string]string, opt *pipeOptions) {
+	config := inputConfig(cfg, "pipe")
+	if opt.source != "" {
+		config["source"] = opt.source
+	}
+	if config["source"] == "" {
+		config["source"] = "pipe"
+	}
+	if opt.senders > 0 {
+		config["senders"] = strconv.Itoa(opt.senders)
+	}
+	p, err := newPiper(config, opt)
+	if err != nil {
+		loglib.Error("[pipe] " + err.Error())
+		os.Exit(1)
+	}
+	initGovernor(config)
+	setSendRate(config)
+	go reloadLimitsOnHup(func(cfg map[string]map[string]string) {
+		setSendRate(inputConfig(cfg, "pipe"))
+	})
+
+	os.MkdirAll(pipeCacheDir, 0775)
+	sendBuffer := make(chan bytes.Buffer, 500)
+	bufSize, _ := strconv.Atoi(config["recv_buffer_size"])
+	if bufSize <= 0 {
+		bufSize = 2000
+	}
+	r := ReceiverInit(sendBuffer, p.ch, bufSize, 1)
+	r.source = config["source"]
+	r.period = p.period
+	r.filter = NewLineFilter(config)
+	go r.Start()
+
+	qlst := lib.NewQuitList()
+	senders := startSenders(qlst, sendBuffer, config, spoolUntilDone(pipeCacheDir, config))
+
+	go lib.HandleQuitSignal(func() {
+		close(p.quitCh)
+	})
+
+	err = p.run(os.Stdin, newMultiline(config), newCharsetConverter(config))
+	close(p.ch)
+	r.Quit()
+	//等sender把包都发完，被中断时sender把没发出的包写到缓存目录
+	qlst.ExecQuit()
+	if err != nil {
+		loglib.Error("[pipe] " + err.Error())
+	}
+	if err != nil || p.isQuit() || !allSent(senders) {
+		loglib.Warning(fmt.Sprintf("pipe not finished, %d packs not acknowledged are saved in %s", len(lib.GetFilelist(pipeCacheDir)), pipeCacheDir))
+		os.Exit(1)
+	}
+	loglib.Info("pipe finished, all packs acknowledged")
+}
+
+type piper struct {
+	period  lib.Period
+	parser  *timeParser //按行中的时间划分周期，指定-hour时为nil
+	repull  bool
+	start   time.Time //当前周期的开始
+	started bool
+	pending []string //第一条带时间的行之前的行
+	lines   int      //当前周期的行数
+	late    int      //时间早于当前周期的行数
+	ch      chan map[string]string
+	quitCh  chan bool
+}
+
+func newPiper(config map[string]string, opt *pipeOptions) (*piper, error) {
+	p := &piper{period: lib.Hourly, repull: opt.repull, ch: make(chan map[string]string, 10000), quitCh: make(chan bool)}
+	if opt.hour != "" {
+		t, err := lib.ParsePeriodKey(opt.hour)
+		if err != nil {
+			return nil, fmt.Errorf("wrong -hour %s", opt.hour)
+		}
+		//周期的长度由key的格式决定
+		switch len(opt.hour) {
+		case 8:
+			p.period = lib.Daily
+		case 12:
+			p.period = lib.Period{Duration: time.Minute}
+		}
+		p.start, p.started = t, true
+	} else {
+		p.parser = newTimeParser(config)
+	}
+	if val := config["rotate_period"]; val != "" {
+		period, err := lib.ParsePeriod(val)
+		if err != nil {
+			return nil, fmt.Errorf("wrong rotate_period %s", val)
+		}
+		p.period = period
+	}
+	if p.started && p.period.Key(p.period.Truncate(p.start)) != opt.hour {
+		return nil, fmt.Errorf("-hour %s is not a period of %s", opt.hour, p.period.String())
+	}
+	return p, nil
+}
+
+func (this *piper) isQuit() bool {
+	select {
+	case <-this.quitCh:
+		return true
+	default:
+	}
+	return false
+}
+
+//读完后结束最后一个周期，被中断时只把不满一个包的日志发出去
+func (this *piper) run(rd io.Reader, ml *multiline, cs *charsetConverter) error {
+	if cs != nil {
+		defer cs.Close()
+	}
+	br := bufio.NewReaderSize(rd, 64*1024)
+	for !this.isQuit() {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			if err != nil {
+				//末尾没有换行符的半行
+				line += "\n"
+			}
+			if cs != nil {
+				line = cs.Convert(line)
+			}
+			if ml != nil {
+				var ok bool
+				if line, _, ok = ml.add(line, 0); !ok {
+					line = ""
+				}
+			}
+			if line != "" {
+				if err := this.add(line); err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				this.flush()
+				return err
+			}
+			break
+		}
+	}
+	if this.isQuit() {
+		this.flush()
+		return nil
+	}
+	if ml != nil {
+		if record, _, ok := ml.flush(); ok {
+			if err := this.add(record); err != nil {
+				return err
+			}
+		}
+	}
+	if !this.started {
+		if len(this.pending) > 0 {
+			return errNoTime
+		}
+		//没有输入
+		return nil
+	}
+	this.closePeriod()
+	return nil
+}
+
+func (this *piper) add(line string) error {
+	if this.parser != nil {
+		t, ok := this.parser.parse(line)
+		if ok && t.After(time.Now().Add(this.period.Duration)) {
+			//时间超前太多，当成解析不出时间，以免一个个地结束中间的周期
+			ok = false
+		}
+		if ok {
+			ps := this.period.Truncate(t)
+			if !this.started {
+				this.start, this.started = ps, true
+				for _, l := range this.pending {
+					this.send(l)
+				}
+				this.pending = nil
+			}
+			if ps.Before(this.start) {
+				this.late++
+			}
+			for ps.After(this.start) {
+				this.closePeriod()
+			}
+		} else if !this.started {
+			if len(this.pending) >= pipeMaxPending {
+				return errNoTime
+			}
+			this.pending = append(this.pending, line)
+			return nil
+		}
+	}
+	this.send(line)
+	return nil
+}
+
+func (this *piper) send(line string) {
+	m := map[string]string{"hour": this.period.Key(this.start), "line": line}
+	if this.repull {
+		m["repull"] = "1"
+	}
+	queueBudget.Wait()
+	this.ch <- m
+	this.lines++
+}
+
+//结束当前周期，进入下一个周期
+func (this *piper) closePeriod() {
+	hour := this.period.Key(this.start)
+	m := map[string]string{"hour": hour, "line": changeStr}
+	if this.repull {
+		m["repull"] = "1"
+	}
+	this.ch <- m
+	loglib.Info(fmt.Sprintf("pipe period %s finished, lines: %d, late: %d", hour, this.lines, this.late))
+	this.start = this.period.Next(this.start)
+	this.lines = 0
+	this.late = 0
+}
+
+//不满一个包的日志也打包，周期没有结束
+func (this *piper) flush() {
+	if this.started && this.lines > 0 {
+		this.ch <- map[string]string{"hour": this.period.Key(this.start), "line": flushStr}
+	}
+}
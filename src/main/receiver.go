@@ -5,6 +5,9 @@ import (
 	"compress/zlib"
 	"container/list"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"lib"
@@ -17,19 +20,24 @@ type Receiver struct {
 	logList        *list.List
 	listBufferSize int //多少条日志发送一次
 	receiveChan    chan map[string]string
-	nTailedLines   int //tailler重启时用于计算开始的id
+	nextId         int             //第一个包的id，tailler重启时从断点中得到
+	source         string          //日志源的名字，多个源共用sender时用于区分包的id序列
+	period         lib.Period      //日志切割周期，包头的hour字段是周期的key
+	bufferWg       *sync.WaitGroup //多个receiver共用sendBuffer时，由最后退出的一方关闭
+	filter         *LineFilter     //过滤、脱敏、抽样，nil表示不处理
+	events         *eventBuckets   //按日志行中的时间划分周期，nil表示不处理
 	wq             *lib.WaitQuit
 }
 
 //工厂初始化函数
-func ReceiverInit(buffer chan bytes.Buffer, c chan map[string]string, listBufferSize int, nTailedLines int) (r Receiver) {
+func ReceiverInit(buffer chan bytes.Buffer, c chan map[string]string, listBufferSize int, nextId int) (r Receiver) {
 	// var r Receiver
 	r.sendBuffer = buffer
 	r.logList = list.New()
 	r.receiveChan = c
 	r.listBufferSize = listBufferSize
 	r.wq = lib.NewWaitQuit("receiver")
-	r.nTailedLines = nTailedLines
+	r.nextId = nextId
 	return r
 }
 
@@ -61,29 +69,57 @@ func (r Receiver) writeList() {
 		if err := recover(); err != nil {
 			loglib.Error(fmt.Sprintf("receiver panic:%v", err))
 		}
-		close(r.sendBuffer)
+		if r.bufferWg != nil {
+			r.bufferWg.Done()
+		} else {
+			close(r.sendBuffer)
+		}
 	}()
 
 	st := time.Now()
 	var nLines = 0
+	var nDropped = 0 //本包中被filter丢弃的行数
 	var id = r.initId()
 	ip := lib.GetIp()
 	var changed = false
+	var flush = false
+	//行上带的tag.xxx，打包时把各行的值去重后写到包头的xxx
+	tags := make(map[string]map[string]bool)
+	//行上带的事件时间，打包时写到包头的et_min、et_max
+	var etMin, etMax string
 
 	for logMap := range r.receiveChan {
 		logLine := logMap["line"]
 		changed = false
+		flush = false
 
 		if logLine == "logfile changed" {
 			changed = true
+		} else if logLine == flushStr {
+			flush = true
 		} else {
-			r.logList.PushBack(logLine)
+			addTags(tags, logMap)
+			if t := logMap["time"]; t != "" {
+				if etMin == "" || t < etMin {
+					etMin = t
+				}
+				if t > etMax {
+					etMax = t
+				}
+			}
+			if r.filter == nil {
+				r.pushLine(logLine, logMap["hour"])
+			} else if line, ok := r.filter.Process(logLine); ok {
+				r.pushLine(line, logMap["hour"])
+			} else {
+				nDropped++
+			}
 		}
 		nLines = r.logList.Len()
-		//达到指定行数或发现日志rotate
-		//因此每小时只有最后一个包比listBufferSize小
-		//如果quit时包小于listBufferSize就丢弃，重启后再读
-		if nLines >= r.listBufferSize || changed {
+		//达到指定行数或发现日志rotate，丢弃的行也算在内，以便和发送方按同样的行数分包、登记断点
+		//因此每个周期只有最后一个包比listBufferSize小，除非发送方用flushStr要求提前打包
+		//quit时发送方没有要求提前打包的行丢弃，重启后再读
+		if nLines+nDropped >= r.listBufferSize || changed || (flush && nLines+nDropped > 0) {
 			hour := logMap["hour"]
 			repull, ok := logMap["repull"] //兼容补拉
 
@@ -91,14 +127,27 @@ func (r Receiver) writeList() {
 			//r.sendBuffer <- b
 			ed := time.Now()
 			elapse := ed.Sub(st)
-			loglib.Info(fmt.Sprintf("add a pack, id: %s_%d, lines:%d, elapse: %s", hour, id, nLines, elapse))
+			loglib.Info(fmt.Sprintf("add a pack, id: %s_%d, lines:%d, dropped:%d, elapse: %s", hour, id, nLines, nDropped, elapse))
 
 			//route信息
 			m := make(map[string]string)
 			m["ip"] = ip
 			m["hour"] = hour
+			if r.source != "" {
+				m["source"] = r.source
+			}
+			if r.period.Duration != 0 && r.period != lib.Hourly {
+				m["period"] = fmt.Sprintf("%d", r.period.Seconds())
+			}
 			m["id"] = fmt.Sprintf("%d", id)
 			m["lines"] = fmt.Sprintf("%d", nLines)
+			if nDropped > 0 {
+				m["dropped"] = fmt.Sprintf("%d", nDropped)
+				//行全部被丢弃的空包内容都一样，设置repull以免被当成重复包
+				if nLines == 0 {
+					m["repull"] = "1"
+				}
+			}
 			m["stage"] = "make pack"
 			m["st"] = st.Format("2006-01-02 15:04:05.000")
 			m["ed"] = ed.Format("2006-01-02 15:04:05.000")
@@ -106,27 +155,44 @@ func (r Receiver) writeList() {
 			if ok && repull == "1" {
 				m["repull"] = "1"
 			}
+			if r.events != nil {
+				r.events.fill(m)
+			} else if etMin != "" {
+				m["et_min"], m["et_max"] = etMin, etMax
+			}
+			etMin, etMax = "", ""
+			fillTags(tags, m)
 
 			if changed {
 				m["done"] = "1"
-				//这种空包用于给那些日志行数正好是listBufferSize倍数的小时标记结束
+				//这种空包用于给那些日志行数正好是listBufferSize倍数的周期标记结束
 				//设置repull为1以便空包能够不被拦截
 				if nLines == 0 {
 					m["repull"] = "1"
 				}
+				//这个周期的日志文件不存在
+				if logMap["missing"] == "1" {
+					m["missing"] = "1"
+				}
 			}
 
 			vbytes := tcp_pack.Packing(b.Bytes(), m, false)
 			b.Reset()
 			b.Write(vbytes)
+			//打包后才占用queueBudget，由sender释放；还没打包的行不占用，以免不满一个包的行等不到打包
+			queueBudget.Force(b.Len())
 			r.sendBuffer <- b
 			id++
 			st = time.Now()
 			nLines = 0
+			nDropped = 0
 		}
 
 		if changed {
-			id = 1 //每小时id刷新
+			id = 1 //每个周期id刷新
+			if r.filter != nil {
+				loglib.Info(fmt.Sprintf("receiver %s filter %s", r.source, r.filter.Counters()))
+			}
 		}
 
 	}
@@ -134,6 +200,9 @@ func (r Receiver) writeList() {
 	if nLines > 0 {
 		loglib.Info(fmt.Sprintf("receiver abandon %d lines", nLines))
 	}
+	if r.filter != nil {
+		loglib.Info(fmt.Sprintf("receiver %s filter %s", r.source, r.filter.Counters()))
+	}
 
 }
 
@@ -155,6 +224,40 @@ func (r Receiver) Quit() bool {
 	return r.wq.Quit()
 }
 
+func addTags(tags map[string]map[string]bool, logMap map[string]string) {
+	for k, v := range logMap {
+		if strings.HasPrefix(k, "tag.") && v != "" {
+			k = k[4:]
+			if tags[k] == nil {
+				tags[k] = make(map[string]bool)
+			}
+			tags[k][v] = true
+		}
+	}
+}
+
+func fillTags(tags map[string]map[string]bool, m map[string]string) {
+	for k, vals := range tags {
+		lst := make([]string, 0, len(vals))
+		for v := range vals {
+			lst = append(lst, v)
+		}
+		sort.Strings(lst)
+		m[k] = strings.Join(lst, ",")
+		delete(tags, k)
+	}
+}
+
+func (r Receiver) pushLine(line string, hour string) {
+	r.logList.PushBack(line)
+	if r.events != nil {
+		r.events.add(line, hour)
+	}
+}
+
 func (r Receiver) initId() int {
-	return (r.nTailedLines / r.listBufferSize) + 1
+	if r.nextId <= 0 {
+		return 1
+	}
+	return r.nextId
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lib"
+	"loglib"
+)
+
+/*
+* 补拉历史日志：logd repull -config x.ini -from 2026101000 -to 2026101023
+* 按[tail]、[tail.xxx]中的log_file找到这些周期的日志文件（也找.gz等压缩的归档），
+* 用自己的receiver和sender重新发送，所有包都标记repull=1，
+* 不读写tail的断点记录，发送失败的包缓存在单独的目录，读完后等这些包都被确认再退出；
+* collector一直不可用时，连续done_timeout秒没有发出包就放弃，没发出的包留在目录中，下次补拉时继续发送
+ */
+type repullOptions struct {
+	config  string
+	from    string
+	to      string
+	source  string //只补拉这个源，默认全部
+	rate    int    //每秒最多读多少行，0表示不限速
+	senders int
+}
+
+var repullCacheDir = "tempfile_repull"
+
+func parseRepullArgs(args []string) *repullOptions {
+	opt := &repullOptions{}
+	fs := flag.NewFlagSet("repull", flag.ExitOnError)
+	fs.StringVar(&opt.config, "config", "", "config file")
+	fs.StringVar(&opt.from, "from", "", "first period to repull, such as 2026101000")
+	fs.StringVar(&opt.to, "to", "", "last period to repull, default the same as -from")
+	fs.StringVar(&opt.source, "source", "", "only repull this tail source, the name of [tail.xxx], [tail] is \"\"")
+	fs.IntVar(&opt.rate, "rate", -1, "max lines read per second, default repull_rate in [tail] or 5000, 0 means no limit")
+	fs.IntVar(&opt.senders, "senders", 2, "number of senders")
+	fs.Parse(args)
+	if opt.config == "" || opt.from == "" {
+		fmt.Println("usage: logd repull -config x.ini -from 2026101000 [-to 2026101023] [-source name] [-rate lines]")
+		os.Exit(1)
+	}
+	if opt.to == "" {
+		opt.to = opt.from
+	}
+	return opt
+}
+
+func repullGo(cfg map[string]map[string]string, opt *repullOptions) {
+	from, err := lib.ParsePeriodKey(opt.from)
+	if err != nil {
+		loglib.Error("wrong -from " + opt.from)
+		os.Exit(1)
+	}
+	to, err := lib.ParsePeriodKey(opt.to)
+	if err != nil {
+		loglib.Error("wrong -to " + opt.to)
+		os.Exit(1)
+	}
+	rate := opt.rate
+	if rate < 0 {
+		rate = 5000
+		if n, err := strconv.Atoi(cfg["tail"]["repull_rate"]); err == nil && n >= 0 {
+			rate = n
+		}
+	}
+	limiter := lib.NewRateLimiter(rate)
+	//补拉和tail同样受cpu、内存和带宽的限制
+	initGovernor(cfg["tail"])
+	setSendRate(cfg["tail"])
+	go reloadLimitsOnHup(func(cfg map[string]map[string]string) {
+		setSendRate(cfg["tail"])
+		//-rate参数指定的不变
+		if opt.rate < 0 {
+			rate := atoiDefault(cfg["tail"]["repull_rate"], 5000)
+			limiter.SetRate(rate)
+			loglib.Info(fmt.Sprintf("rate limits: repull %d lines/s", rate))
+		}
+	})
+
+	sources := getTailSources(cfg)
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		if opt.source == "" || opt.source == name {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		loglib.Error("no tail source to repull")
+		os.Exit(1)
+	}
+	sort.Strings(names)
+
+	os.MkdirAll(repullCacheDir, 0775)
+	sendBuffer := make(chan bytes.Buffer, 500)
+	config := copyConfig(cfg["tail"])
+	config["senders"] = strconv.Itoa(opt.senders)
+	qlst := lib.NewQuitList()
+	senders := startSenders(qlst, sendBuffer, config, spoolUntilDone(repullCacheDir, config))
+
+	quitCh := make(chan bool)
+	go lib.HandleQuitSignal(func() {
+		close(quitCh)
+	})
+
+	rwg := &sync.WaitGroup{}
+	for _, name := range names {
+		rp := newRepuller(name, sources[name], from, to, limiter, quitCh)
+		rp.run(sendBuffer, rwg)
+	}
+	rwg.Wait()
+	close(sendBuffer)
+	//等sender把包都发完，或者超时放弃
+	qlst.ExecQuit()
+	if !allSent(senders) {
+		loglib.Warning(fmt.Sprintf("repull not finished, %d packs not acknowledged are saved in %s", len(lib.GetFilelist(repullCacheDir)), repullCacheDir))
+		os.Exit(1)
+	}
+	loglib.Info("repull finished")
+}
+
+//一个日志源的补拉
+type repuller struct {
+	name    string
+	config  map[string]string
+	from    time.Time
+	to      time.Time
+	limiter *lib.RateLimiter
+	quitCh  chan bool
+}
+
+func newRepuller(name string, config map[string]string, from time.Time, to time.Time, limiter *lib.RateLimiter, quitCh chan bool) *repuller {
+	return &repuller{name, config, from, to, limiter, quitCh}
+}
+
+func (this *repuller) isQuit() bool {
+	select {
+	case <-this.quitCh:
+		return true
+	default:
+	}
+	return false
+}
+
+func (this *repuller) run(sendBuffer chan bytes.Buffer, rwg *sync.WaitGroup) {
+	logPath := this.config[logFileKey]
+	goFmt, _ := extractTimeFmt(logPath)
+	if goFmt == "" {
+		loglib.Error(fmt.Sprintf("tail source [%s] %s has no time format, can't repull", this.name, logPath))
+		return
+	}
+	streams := map[string]string{logPath: ""}
+	if strings.ContainsAny(logPath, "*?[") {
+		streams = expandLogPath(logPath)
+	}
+	paths := make([]string, 0, len(streams))
+	for p := range streams {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if this.isQuit() {
+			return
+		}
+		stream := this.name
+		if streams[p] != "" {
+			stream = strings.Trim(stream+"."+streams[p], ".")
+		}
+		this.repullStream(stream, p, sendBuffer, rwg)
+	}
+}
+
+//补拉一个日志流，与tail时一样每个周期的id从1开始
+func (this *repuller) repullStream(stream string, logPath string, sendBuffer chan bytes.Buffer, rwg *sync.WaitGroup) {
+	goFmt, nLT := extractTimeFmt(logPath)
+	period := lib.PeriodOfLayout(goFmt)
+	if val := this.config["rotate_period"]; val != "" {
+		if p, err := lib.ParsePeriod(val); err == nil {
+			period = p
+		}
+	}
+	receiveChan := make(chan map[string]string, 10000)
+	bufSize, _ := strconv.Atoi(this.config["recv_buffer_size"])
+	r := ReceiverInit(sendBuffer, receiveChan, bufSize, 1)
+	r.source = stream
+	r.period = period
+	r.bufferWg = rwg
+	r.filter = NewLineFilter(this.config)
+	r.events = newEventBuckets(this.config, period)
+	rwg.Add(1)
+	go r.Start()
+	defer func() {
+		close(receiveChan)
+		r.Quit()
+	}()
+
+	for t := period.Truncate(this.from); !t.After(this.to) && !this.isQuit(); t = period.Next(t) {
+		fname := logFileByTime(logPath, nLT, goFmt, t)
+		hourStr := period.Key(t)
+		n, err := this.repullFile(fname, hourStr, receiveChan)
+		if err != nil {
+			loglib.Warning(fmt.Sprintf("repull [%s] %s error: %s", stream, fname, err.Error()))
+			continue
+		}
+		if this.isQuit() {
+			break
+		}
+		m := map[string]string{"hour": hourStr, "line": changeStr, "repull": "1"}
+		receiveChan <- m
+		loglib.Info(fmt.Sprintf("repull [%s] %s finished, lines: %d", stream, hourStr, n))
+	}
+}
+
+//读一个周期的日志文件，文件不存在时读压缩的归档
+func (this *repuller) repullFile(fname string, hourStr string, receiveChan chan map[string]string) (int, error) {
+	var rd io.ReadCloser
+	var err error
+	if archive := findArchive(fname, this.config); archive != "" && !lib.FileExists(fname) {
+		fname = archive
+		rd, err = openArchive(fname, this.config)
+	} else {
+		rd, err = os.Open(fname)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+	loglib.Info("repull " + fname)
+
+	send := func(line string) {
+		m := map[string]string{"hour": hourStr, "line": line, "repull": "1"}
+		queueBudget.Wait()
+		receiveChan <- m
+	}
+	ml := newMultiline(this.config)
+	cs := newCharsetConverter(this.config)
+	if cs != nil {
+		defer cs.Close()
+	}
+	br := bufio.NewReaderSize(rd, 64*1024)
+	n := 0
+	for !this.isQuit() {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			if err != nil {
+				//末尾没有换行符的半行
+				line += "\n"
+			}
+			this.limiter.Wait(1)
+			if cs != nil {
+				line = cs.Convert(line)
+			}
+			if ml == nil {
+				send(line)
+				n++
+			} else if record, _, ok := ml.add(line, 0); ok {
+				send(record)
+				n++
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				return n, err
+			}
+			break
+		}
+	}
+	if ml != nil {
+		if record, _, ok := ml.flush(); ok {
+			send(record)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -3,52 +3,45 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"heart_beat"
 	"lib"
 	"loglib"
 )
 
-func logdGo(cfg map[string]map[string]string) {
-
-	receiveChan := make(chan map[string]string)
-	sendBuffer := make(chan bytes.Buffer)
-	r := ReceiverInit(sendBuffer, receiveChan, 2000, 0)
-
-	tc := TcpClientInit(receiveChan)
-	//start tcp listener to receive log
-	go tc.StartLogAgentServer()
-	//start receiver to receive log from tcp listenser
-	go r.Start()
-
-	addr := "localhost:1306"
-	s := SenderInit(sendBuffer, addr, addr, 0)
-	go s.Start()
-	for {
-		time.Sleep(1000 * time.Second)
-	}
-
-}
 func tailerGo(cfg map[string]map[string]string) {
 	qlst := lib.NewQuitList()
 
-	receiveChan := make(chan map[string]string, 10000) //非阻塞
 	sendBuffer := make(chan bytes.Buffer, 500)
-	recvBufferSize, _ := strconv.Atoi(cfg["tail"]["recv_buffer_size"])
-	tailler := NewTailler(cfg["tail"])
-	r := ReceiverInit(sendBuffer, receiveChan, recvBufferSize, tailler.GetLineNum())
-
-	//make a new log tailler
-	go tailler.Tailling(receiveChan)
-	//start receiver to receive log
-	go r.Start()
+	initGovernor(cfg["tail"])
+	setLimits(cfg["tail"])
+	go reloadLimitsOnHup(func(cfg map[string]map[string]string) {
+		setLimits(cfg["tail"])
+	})
+	sources := getTailSources(cfg)
+	if len(sources) == 0 {
+		loglib.Error("config need log_file!")
+		os.Exit(1)
+	}
+	//所有源共用sender，所有receiver都退出后关闭sendBuffer
+	rwg := &sync.WaitGroup{}
+	for name, config := range sources {
+		rwg.Add(1)
+		src := NewTailSource(name, config, sendBuffer, rwg)
+		go src.Start()
+		//一定要发送方先退出
+		qlst.Append(src.Quit)
+	}
+	go func() {
+		rwg.Wait()
+		close(sendBuffer)
+	}()
+	loglib.Info(fmt.Sprintf("total tail sources %d", len(sources)))
 
-	//一定要发送方先退出
-	qlst.Append(tailler.Quit)
-	qlst.Append(r.Quit)
 	// heart beat
 	port, _ := cfg["monitor"]["hb_port"]
 	monAddr, _ := cfg["monitor"]["mon_addr"]
@@ -58,29 +51,7 @@ func tailerGo(cfg map[string]map[string]string) {
 		qlst.Append(hb.Quit)
 	}
 
-	addrs := strings.Split(cfg["tail"]["send_to"], ",")
-	addr := strings.Trim(addrs[0], " ")
-	bakAddr := addr
-	//有备用地址?
-	if len(addrs) > 1 {
-		bakAddr = strings.Trim(addrs[1], " ")
-	}
-
-	//加大发送并发，sender阻塞会影响tail的进度
-	nSenders := 2
-	senders, ok := cfg["tail"]["senders"]
-	if ok {
-		tmp, err := strconv.Atoi(senders)
-		if err == nil {
-			nSenders = tmp
-		}
-	}
-	for i := 1; i <= nSenders; i++ {
-		s := SenderInit(sendBuffer, addr, bakAddr, i)
-		go s.Start()
-		qlst.Append(s.Quit)
-	}
-	loglib.Info(fmt.Sprintf("total senders %d", nSenders))
+	startSenders(qlst, sendBuffer, cfg["tail"], nil)
 
 	qlst.HandleQuitSignal()
 	qlst.ExecQuit()
@@ -137,6 +108,8 @@ func fcollectorGo(cfg map[string]map[string]string) {
 	addr := cfg["fcollector"]["listen"]
 
 	fo := FileOutputerInit(bufferChan, cfg["fcollector"]["save_dir"])
+	fo.ic.SetExpectedHours(cfg["fcollector"])
+	fo.SetPartition(cfg["fcollector"])
 	go fo.Start()
 
 	tr := TcpReceiverInit(bufferChan, addr)
@@ -167,6 +140,8 @@ func etlcollectorGo(cfg map[string]map[string]string) {
 	addr := cfg["etlcollector"]["listen"]
 
 	eo := EtlOutputerInit(bufferChan, cfg["etlcollector"])
+	eo.ic.SetExpectedHours(cfg["etlcollector"])
+	eo.SetPartition(cfg["etlcollector"])
 	go eo.Start()
 
 	tr := TcpReceiverInit(bufferChan, addr)
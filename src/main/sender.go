@@ -26,6 +26,9 @@ type Sender struct {
 	connection           Connection
 	status               *int
 	sendToAddress        string
+	untilDone            bool          //sBuffer关闭且文件缓存都发送完后自行退出，用于补拉
+	doneTimeout          time.Duration //untilDone时sBuffer关闭后连续这么久没有发出包也退出，没发出的包留在缓存目录
+	allSent              bool          //untilDone的sender退出时所有包是否都已确认，Quit返回true后才能读
 
 	wq *lib.WaitQuit
 }
@@ -110,10 +113,19 @@ func (s *Sender) Start() {
 	var sendInterval = time.Duration(2000) //间隔稍大，避免发送文件缓存时因无连接或其他错误进入死循环
 
 	var timeoutChan = time.After(sendInterval * time.Millisecond)
+	var deadline time.Time
+	memBuffer := s.memBuffer
 	for !quit {
 
 		select {
-		case b := <-s.memBuffer:
+		case b, ok := <-memBuffer:
+			if !ok {
+				//sBuffer已关闭，之后只发送文件缓存
+				memBuffer = nil
+				timeoutChan = time.After(time.Millisecond)
+				deadline = time.Now().Add(s.doneTimeout)
+				break
+			}
 			//send b
 			result := s.sendBuffer(b)
 			if result == false {
@@ -123,6 +135,19 @@ func (s *Sender) Start() {
 
 		case <-timeoutChan:
 			timeoutChan = time.After(sendInterval * time.Millisecond)
+			if s.untilDone && memBuffer == nil {
+				if fileList.Len() == 0 {
+					loglib.Info(fmt.Sprintf("sender%d all packs sent", s.id))
+					s.allSent = true
+					quit = true
+					break
+				}
+				if s.doneTimeout > 0 && time.Now().After(deadline) {
+					loglib.Warning(fmt.Sprintf("sender%d no pack sent in %v, give up, %d packs left in %s", s.id, s.doneTimeout, fileList.Len(), s.file_mem_folder_name))
+					quit = true
+					break
+				}
+			}
 
 			// send from file
 			e := fileList.Remove()
@@ -147,6 +172,7 @@ func (s *Sender) Start() {
 						err = os.Remove(filename)
 						lib.CheckError(err)
 						timeoutChan = time.After(time.Millisecond) //发送成功，不用再等待
+						deadline = time.Now().Add(s.doneTimeout)
 					} else {
 						fileList.PushBack(filename)
 						// fmt.Println("sender ",s.id,": pushback file :",filename)
@@ -163,6 +189,16 @@ func (s *Sender) Quit() bool {
 	return s.wq.Quit()
 }
 
+//所有sender都退出后，是否每个都确认了全部的包
+func allSent(senders []*Sender) bool {
+	for _, s := range senders {
+		if !s.allSent {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Sender) saveBufferInChan() {
 	loglib.Info(fmt.Sprintf("sender%d begin to save pack in chan", s.id))
 	i := 0
@@ -175,7 +211,7 @@ func (s *Sender) saveBufferInChan() {
 
 func (s *Sender) writeToFile(data bytes.Buffer) {
 	//写入文件
-	filename := createFileName(s.id)
+	filename := createFileName(s.file_mem_folder_name, s.id)
 	//创建文件
 	_, err := os.Create(filename)
 	lib.CheckError(err)
@@ -192,7 +228,10 @@ func (s *Sender) writeToFile(data bytes.Buffer) {
 	} else {
 		//追加fileCacheList
 		fileList.PushBack(filename)
+		//已落盘，tail的断点可以前进
+		ackPack(d)
 	}
+	queueBudget.Release(len(d))
 }
 
 func (s *Sender) sendBuffer(data bytes.Buffer) bool {
@@ -204,6 +243,8 @@ func (s *Sender) sendBuffer(data bytes.Buffer) bool {
 		loglib.Info(fmt.Sprintf("sender%d reconnected by sendBuffer(),status:%d", s.id, *s.status))
 	} else {
 		*s.status = 1
+		ackPack(data.Bytes())
+		queueBudget.Release(data.Len())
 	}
 	return result
 }
@@ -234,6 +275,7 @@ func (s Sender) sendData(data []byte, conn *net.TCPConn) bool {
 	   data = append(lenBuf, data...)
 	*/
 
+	sendLimiter.Wait(len(data))
 	st := time.Now()
 	packId := tcp_pack.GetPackId(data)
 
@@ -273,10 +315,10 @@ func (s Sender) sendData(data []byte, conn *net.TCPConn) bool {
 	}
 	return false
 }
-func createFileName(id int) string {
+func createFileName(dir string, id int) string {
 	t := time.Now()
 	nanoSecond := strconv.FormatInt(t.UnixNano(), 10)
-	filename := "tempfile/senderBufferTempFile_" + strconv.Itoa(id) + "_" + nanoSecond
+	filename := dir + "/senderBufferTempFile_" + strconv.Itoa(id) + "_" + nanoSecond
 
 	return filename
 
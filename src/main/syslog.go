@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"loglib"
+)
+
+/*
+* syslog输入：logd syslog config.ini
+* [syslog]中配置udp、tcp、unix（unixgram，如/dev/log）监听的地址，至少一个
+* 支持RFC3164和RFC5424，tcp支持octet counting（长度 空格 消息）和按换行分隔两种分帧，
+* 每条消息原样作为一行发送（消息中的换行转为\n），按消息中的时间划分周期，
+* 包头的facility、severity为包中各条消息的值
+ */
+var facilityNames = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+var severityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+const maxSyslogSize = 64 * 1024
+
+var errSyslogTooLong = fmt.Errorf("syslog frame longer than %d bytes", maxSyslogSize)
+
+func syslogGo(cfg map[string]map[string]string) {
+	config := inputConfig(cfg, "syslog")
+	name := config["source"]
+	if name == "" {
+		name = "syslog"
+	}
+	sink := newLineSink(name, config)
+	servers := make([]inputServer, 0)
+	if addr := config["udp"]; addr != "" {
+		servers = append(servers, &syslogPacketServer{network: "udp", addr: addr, sink: sink, wq: newServerWaitQuit("syslog udp")})
+	}
+	if addr := config["unix"]; addr != "" {
+		servers = append(servers, &syslogPacketServer{network: "unixgram", addr: addr, sink: sink, wq: newServerWaitQuit("syslog unix")})
+	}
+	if addr := config["tcp"]; addr != "" {
+		srv := newConnServer("syslog", "tcp", addr, nil)
+		srv.handle = func(conn net.Conn) {
+			handleSyslogConn(sink, srv, conn)
+		}
+		servers = append(servers, srv)
+	}
+	if len(servers) == 0 {
+		loglib.Error("[syslog] need udp, tcp or unix!")
+		os.Exit(1)
+	}
+	runInput("syslog", cfg, config, sink, servers)
+}
+
+//解析PRI和时间，没有PRI时按user.notice，解析不出时间时t为0
+func parseSyslog(msg string, now time.Time) (facility int, severity int, t time.Time) {
+	facility, severity = 1, 5
+	rest := msg
+	if strings.HasPrefix(msg, "<") {
+		if i := strings.Index(msg, ">"); i > 1 && i <= 4 {
+			if pri, err := strconv.Atoi(msg[1:i]); err == nil && pri >= 0 && pri < len(facilityNames)*8 {
+				facility, severity = pri/8, pri%8
+				rest = msg[i+1:]
+			}
+		}
+	}
+	//RFC5424：版本号 空格 时间
+	if len(rest) > 2 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		rest = rest[2:]
+	}
+	if len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+		ts := rest
+		if i := strings.Index(rest, " "); i > 0 {
+			ts = rest[:i]
+		}
+		if tm, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			t = tm
+		}
+		return
+	}
+	//RFC3164：Mmm dd hh:mm:ss，没有年份
+	if len(rest) >= 15 {
+		if tm, err := time.ParseInLocation("Jan _2 15:04:05", rest[:15], time.Local); err == nil {
+			t = time.Date(now.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute(), tm.Second(), 0, time.Local)
+			if t.Sub(now) > 24*time.Hour {
+				//跨年
+				t = t.AddDate(-1, 0, 0)
+			}
+		}
+	}
+	return
+}
+
+func handleSyslog(sink *lineSink, msg string) {
+	msg = strings.TrimRight(msg, "\r\n\x00")
+	if msg == "" {
+		return
+	}
+	facility, severity, t := parseSyslog(msg, time.Now())
+	line := strings.Replace(msg, "\n", "\\n", -1) + "\n"
+	sink.Add(t, line, map[string]string{"facility": facilityNames[facility], "severity": severityNames[severity]})
+}
+
+//udp和unixgram，一个包一条消息
+type syslogPacketServer struct {
+	network string
+	addr    string
+	sink    *lineSink
+	conn    net.PacketConn
+	wq      *serverWaitQuit
+}
+
+func (this *syslogPacketServer) Start() {
+	defer this.wq.done()
+	if this.network == "unixgram" {
+		os.Remove(this.addr)
+	}
+	conn, err := net.ListenPacket(this.network, this.addr)
+	if err != nil {
+		loglib.Error(fmt.Sprintf("syslog listen %s %s error: %s", this.network, this.addr, err.Error()))
+		return
+	}
+	if this.network == "unixgram" {
+		os.Chmod(this.addr, 0666)
+	}
+	this.conn = conn
+	if !this.wq.started(conn) {
+		return
+	}
+	loglib.Info(fmt.Sprintf("syslog listen %s %s", this.network, this.addr))
+	buf := make([]byte, maxSyslogSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !this.wq.quitting() {
+				loglib.Error("syslog read " + this.addr + " error: " + err.Error())
+			}
+			break
+		}
+		handleSyslog(this.sink, string(buf[:n]))
+	}
+	if this.network == "unixgram" {
+		os.Remove(this.addr)
+	}
+}
+
+func (this *syslogPacketServer) Quit() bool {
+	return this.wq.quit()
+}
+
+func handleSyslogConn(sink *lineSink, srv *connServer, conn net.Conn) {
+	rd := bufio.NewReaderSize(conn, maxSyslogSize)
+	for {
+		msg, err := readSyslogFrame(rd)
+		if msg != "" {
+			handleSyslog(sink, msg)
+		}
+		if err != nil {
+			if err != io.EOF && !srv.quitting() {
+				loglib.Warning(fmt.Sprintf("syslog conn %s error: %s", conn.RemoteAddr(), err.Error()))
+			}
+			return
+		}
+	}
+}
+
+//以数字开头的是octet counting，否则按换行分隔
+//超过maxSyslogSize的消息返回错误，关闭连接，不会一直攒着等分隔符
+func readSyslogFrame(rd *bufio.Reader) (string, error) {
+	b, err := rd.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if b[0] >= '1' && b[0] <= '9' {
+		//长度最多len("65536 ")
+		lenStr, err := readUntil(rd, ' ', len(strconv.Itoa(maxSyslogSize))+1)
+		if err != nil {
+			return "", err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(lenStr))
+		if err != nil || n > maxSyslogSize {
+			return "", fmt.Errorf("wrong frame length %q", lenStr)
+		}
+		buf := make([]byte, n)
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+	line, err := readUntil(rd, '\n', maxSyslogSize+1)
+	if err == io.EOF && line != "" {
+		//连接关闭前的最后一条
+		return line, io.EOF
+	}
+	return line, err
+}
+
+//读到delim（含）为止，超过max字节时返回errSyslogTooLong
+func readUntil(rd *bufio.Reader, delim byte, max int) (string, error) {
+	var buf []byte
+	for {
+		b, err := rd.ReadSlice(delim)
+		if len(buf)+len(b) > max {
+			return "", errSyslogTooLong
+		}
+		buf = append(buf, b...)
+		if err != bufio.ErrBufferFull {
+			return string(buf), err
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name     string
+		msg      string
+		now      time.Time //为零时用上面的now
+		facility int
+		severity int
+		want     time.Time //为零表示解析不出时间
+	}{
+		{"rfc3164", "<34>Oct 11 22:14:15 mymachine su: 'su root' failed", time.Time{}, 4, 2, time.Date(2026, 10, 11, 22, 14, 15, 0, time.Local)},
+		{"rfc3164 space padded day", "<13>Oct  7 08:00:01 host app: hi", time.Time{}, 1, 5, time.Date(2026, 10, 7, 8, 0, 1, 0, time.Local)},
+		//12月的消息在1月收到，属于去年
+		{"rfc3164 last year", "<13>Dec 31 23:59:59 host app: hi", time.Date(2026, 1, 1, 0, 0, 10, 0, time.Local), 1, 5, time.Date(2025, 12, 31, 23, 59, 59, 0, time.Local)},
+		{"rfc5424", "<165>1 2026-10-11T22:14:15.003Z mymachine evntslog - ID47 - msg", time.Time{}, 20, 5, time.Date(2026, 10, 11, 22, 14, 15, 3e6, time.UTC)},
+		{"rfc5424 offset", "<14>1 2026-10-11T22:14:15+08:00 host app 1 - - msg", time.Time{}, 1, 6, time.Date(2026, 10, 11, 14, 14, 15, 0, time.UTC)},
+		{"rfc5424 nil time", "<14>1 - host app 1 - - msg", time.Time{}, 1, 6, time.Time{}},
+		{"no pri", "Oct 11 22:14:15 host app: hi", time.Time{}, 1, 5, time.Date(2026, 10, 11, 22, 14, 15, 0, time.Local)},
+		{"wrong pri", "<999>Oct 11 22:14:15 host", time.Time{}, 1, 5, time.Time{}},
+		{"no time", "<11>hello", time.Time{}, 1, 3, time.Time{}},
+	}
+	for _, tt := range tests {
+		n := tt.now
+		if n.IsZero() {
+			n = now
+		}
+		facility, severity, tm := parseSyslog(tt.msg, n)
+		if facility != tt.facility || severity != tt.severity {
+			t.Errorf("%s: pri %d.%d, want %d.%d", tt.name, facility, severity, tt.facility, tt.severity)
+		}
+		if !tm.Equal(tt.want) {
+			t.Errorf("%s: time %v, want %v", tt.name, tm, tt.want)
+		}
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	long := strings.Repeat("x", maxSyslogSize+1)
+	tests := []struct {
+		name   string
+		in     string
+		frames []string
+		err    error //最后一次读的错误，nil表示任意非EOF的错误
+	}{
+		{"newline", "<13>a\n<13>b\n", []string{"<13>a\n", "<13>b\n"}, io.EOF},
+		{"octet counting", "5 <13>a6 <13>bc", []string{"<13>a", "<13>bc"}, io.EOF},
+		{"octet counting with newline", "7 <13>a\nb", []string{"<13>a\nb"}, io.EOF},
+		{"mixed", "5 <13>a<13>b\n", []string{"<13>a", "<13>b\n"}, io.EOF},
+		{"last without newline", "<13>a\n<13>b", []string{"<13>a\n", "<13>b"}, io.EOF},
+		{"truncated frame", "10 <13>a", nil, io.ErrUnexpectedEOF},
+		{"frame too long", "65537 x", nil, nil},
+		{"length too long", "1234567 x", nil, errSyslogTooLong},
+		{"line too long", long + "\n", nil, errSyslogTooLong},
+	}
+	for _, tt := range tests {
+		rd := bufio.NewReaderSize(strings.NewReader(tt.in), 1024)
+		frames := make([]string, 0)
+		var err error
+		for {
+			var s string
+			s, err = readSyslogFrame(rd)
+			if s != "" && (err == nil || err == io.EOF) {
+				frames = append(frames, s)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if strings.Join(frames, "|") != strings.Join(tt.frames, "|") {
+			t.Errorf("%s: frames %q, want %q", tt.name, frames, tt.frames)
+		}
+		if tt.err == nil && (err == nil || err == io.EOF) || tt.err != nil && err != tt.err {
+			t.Errorf("%s: err %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestHandleSyslog(t *testing.T) {
+	sink := newLineSink("syslog_test", map[string]string{recordFileKey: filepath.Join(t.TempDir(), "syslog.rec")})
+	handleSyslog(sink, "<34>Oct 11 22:14:15 host su: line1\nline2\r\n")
+	handleSyslog(sink, "\x00")
+	lines := sinkLines(sink)
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(lines))
+	}
+	m := lines[0]
+	if m["line"] != `<34>Oct 11 22:14:15 host su: line1\nline2`+"\n" || m["tag.facility"] != "auth" || m["tag.severity"] != "crit" {
+		t.Errorf("line %v", m)
+	}
+}
+
+//时钟超前的客户端不能让当前周期提前结束
+func TestSyslogFutureTime(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		t    time.Time
+		time string //行中记录的事件时间，为空表示不记录
+	}{
+		{"slightly ahead", now.Add(5 * time.Minute), now.Add(5 * time.Minute).Format(etLayout)},
+		{"far ahead", now.Add(48 * time.Hour), ""},
+		{"no time", time.Time{}, ""},
+	}
+	for _, tt := range tests {
+		sink := newLineSink("syslog_test", map[string]string{recordFileKey: filepath.Join(t.TempDir(), "syslog.rec")})
+		hour := sink.period.Key(sink.period.Truncate(time.Now()))
+		sink.Add(tt.t, "x\n", nil)
+		lines := sinkLines(sink)
+		if len(lines) != 1 {
+			t.Fatalf("%s: got %d lines", tt.name, len(lines))
+		}
+		if lines[0]["hour"] != hour || lines[0]["time"] != tt.time {
+			t.Errorf("%s: hour %s time %q, want %s %q", tt.name, lines[0]["hour"], lines[0]["time"], hour, tt.time)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lib"
+	"loglib"
+	"tcp_pack"
+)
+
+/*
+* 一个日志源对应配置中的一个[tail]或[tail.xxx]段
+* log_file可以带通配符，匹配到的每个文件各自有一个Tailler和Receiver，
+* 各自的断点记录和包id序列，所有源共用sender
+* 通配符匹配到的日志文件消失后，tailler发出最后一个周期的结束包就结束，扫描时移除，之后再出现时按断点重新开始
+ */
+type TailSource struct {
+	name       string
+	config     map[string]string
+	sendBuffer chan bytes.Buffer
+	rwg        *sync.WaitGroup        //所有receiver都退出后才能关闭sendBuffer
+	streams    map[string]*tailStream //已经在tail的日志路径（带时间格式）
+	isGlob     bool
+	scanned    bool          //首次扫描后新出现的日志从头开始读
+	interval   time.Duration //通配符路径的扫描间隔
+	quitCh     chan bool
+	mutex      *sync.Mutex
+	wq         *lib.WaitQuit
+}
+
+//一个日志文件的tailler和receiver，一定要发送方先退出
+type tailStream struct {
+	name        string
+	tailler     *Tailler
+	r           Receiver
+	taillerDone bool
+	done        bool //tailler和receiver都已退出
+}
+
+func (this *tailStream) Quit() bool {
+	if this.done {
+		return true
+	}
+	if !this.taillerDone {
+		if !this.tailler.Quit() {
+			return false
+		}
+		this.taillerDone = true
+	}
+	this.done = this.r.Quit()
+	return this.done
+}
+
+var tailSectionPrefix = "tail."
+
+//从配置中找出所有日志源，[tail]中的公共配置作为各个[tail.xxx]的默认值
+func getTailSources(cfg map[string]map[string]string) map[string]map[string]string {
+	sources := make(map[string]map[string]string)
+	base := cfg["tail"]
+	if base[logFileKey] != "" || base[containerKey] != "" {
+		sources[""] = copyConfig(base)
+	}
+	for section, c := range cfg {
+		if !strings.HasPrefix(section, tailSectionPrefix) {
+			continue
+		}
+		name := section[len(tailSectionPrefix):]
+		m := copyConfig(base)
+		delete(m, recordFileKey) //断点记录不能共用
+		for k, v := range c {
+			m[k] = v
+		}
+		sources[name] = m
+	}
+	return sources
+}
+
+func copyConfig(config map[string]string) map[string]string {
+	m := make(map[string]string)
+	for k, v := range config {
+		m[k] = v
+	}
+	return m
+}
+
+func NewTailSource(name string, config map[string]string, sendBuffer chan bytes.Buffer, rwg *sync.WaitGroup) *TailSource {
+	if config[logFileKey] == "" {
+		config[logFileKey] = defaultContainerPath(config[containerKey])
+	}
+	interval := 10 * time.Second
+	if n, err := strconv.Atoi(config["discover_interval"]); err == nil && n > 0 {
+		interval = time.Duration(n) * time.Second
+	}
+	return &TailSource{
+		name:       name,
+		config:     config,
+		sendBuffer: sendBuffer,
+		rwg:        rwg,
+		streams:    make(map[string]*tailStream),
+		isGlob:     strings.ContainsAny(config[logFileKey], "*?["),
+		interval:   interval,
+		quitCh:     make(chan bool),
+		mutex:      &sync.Mutex{},
+		wq:         lib.NewWaitQuit("tail source "+name, -1),
+	}
+}
+
+func (this *TailSource) Start() {
+	defer func() {
+		if err := recover(); err != nil {
+			loglib.Error(fmt.Sprintf("tail source %s panic:%v", this.name, err))
+		}
+		this.rwg.Done()
+		this.wq.AllDone()
+	}()
+
+	go lib.HandleQuitSignal(func() {
+		//加锁，避免退出时还在启动新的tailler
+		this.mutex.Lock()
+		close(this.quitCh)
+		this.mutex.Unlock()
+	})
+
+	for {
+		this.discover()
+		if !this.isGlob {
+			<-this.quitCh
+			break
+		}
+		select {
+		case <-this.quitCh:
+			return
+		case <-time.After(this.interval):
+		}
+	}
+}
+
+//先等扫描停止，再让各个流的tailler和receiver依次退出
+func (this *TailSource) Quit() bool {
+	if !this.wq.Quit() {
+		return false
+	}
+	qlst := lib.NewQuitList()
+	for _, stream := range this.streams {
+		qlst.Append(stream.Quit)
+	}
+	qlst.ExecQuit()
+	return true
+}
+
+//移除日志文件已经消失、tailler自己结束的流，receiver把结束包打包、所有包都确认后才算结束，
+//在这之前文件重新出现也不会开始新的流，以免新的ackTracker顶替还在等确认的旧的
+func (this *TailSource) reap() {
+	for logPath, stream := range this.streams {
+		select {
+		case <-stream.tailler.ended:
+		default:
+			continue
+		}
+		if !stream.Quit() || !stream.tailler.acker.idle() {
+			//下次扫描时再等
+			continue
+		}
+		stream.tailler.acker.unregister()
+		delete(this.streams, logPath)
+		loglib.Info(fmt.Sprintf("tail stream [%s] %s removed", stream.name, logPath))
+	}
+}
+
+//找出新出现的日志，为其启动tailler和receiver
+func (this *TailSource) discover() {
+	logPath := this.config[logFileKey]
+	if !this.isGlob {
+		if this.streams[logPath] == nil {
+			this.startStream(this.name, logPath, this.config[recordFileKey])
+		}
+		return
+	}
+	this.reap()
+	paths := expandLogPath(logPath)
+	keys := make([]string, 0, len(paths))
+	for p := range paths {
+		keys = append(keys, p)
+	}
+	sort.Strings(keys)
+	for _, p := range keys {
+		if this.streams[p] != nil {
+			continue
+		}
+		part := paths[p]
+		if this.config[containerKey] == "docker" {
+			part = dockerStreamName(part)
+		}
+		stream := this.name
+		if part != "" {
+			stream = strings.Trim(stream+"."+part, ".")
+		}
+		recordPath := this.config[recordFileKey]
+		if recordPath != "" {
+			recordPath = recordPath + "." + part
+		}
+		loglib.Info(fmt.Sprintf("tail source %s found new log %s", this.name, p))
+		this.startStream(stream, p, recordPath)
+	}
+	this.scanned = true
+}
+
+func (this *TailSource) startStream(stream string, logPath string, recordPath string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	select {
+	case <-this.quitCh:
+		return
+	default:
+	}
+
+	config := copyConfig(this.config)
+	config[logFileKey] = logPath
+	if recordPath == "" {
+		recordPath = getRecordPath(stream)
+	}
+	config[recordFileKey] = recordPath
+	if this.scanned {
+		config[startPositionKey] = "beginning"
+	}
+
+	receiveChan := make(chan map[string]string, 10000) //非阻塞
+	recvBufferSize, _ := strconv.Atoi(config["recv_buffer_size"])
+	tailler := NewTailler(config, this.quitCh)
+	tailler.untilGone = this.isGlob
+	tailler.acker = newAckTracker(tcp_pack.StreamKey(map[string]string{"ip": lib.GetIp(), "source": stream}), recordPath)
+	r := ReceiverInit(this.sendBuffer, receiveChan, recvBufferSize, tailler.GetNextId())
+	r.source = stream
+	r.period = tailler.GetPeriod()
+	r.bufferWg = this.rwg
+	r.filter = NewLineFilter(config)
+	r.events = newEventBuckets(config, r.period)
+	this.rwg.Add(1)
+
+	//make a new log tailler
+	go tailler.Tailling(receiveChan)
+	//start receiver to receive log
+	go r.Start()
+
+	this.streams[logPath] = &tailStream{name: stream, tailler: tailler, r: r}
+	loglib.Info(fmt.Sprintf("start tail stream [%s] %s, record: %s", stream, logPath, recordPath))
+}
+
+//展开带通配符的日志路径，返回各个匹配的日志路径（保留时间格式）和通配符匹配到的部分
+//例如 /data/*/access.log.<%Y%m%d%H> 匹配到 /data/app1/access.log.2016101715
+//得到 /data/app1/access.log.<%Y%m%d%H> 和 app1
+func expandLogPath(pattern string) map[string]string {
+	paths := make(map[string]string)
+	goFmt, nLT := extractTimeFmt(pattern)
+	size := len(pattern)
+	prefix := pattern[:nLT[0]]
+	suffix := pattern[size-nLT[1]:]
+	fmtPart := pattern[nLT[0] : size-nLT[1]]
+
+	var re *regexp.Regexp
+	var err error
+	timeGroup := -1 //时间部分是第几个分组
+	if goFmt == "" {
+		reStr, _ := globToRegexp(pattern)
+		re, err = regexp.Compile("^" + reStr + "$")
+	} else {
+		prefixRe, n := globToRegexp(prefix)
+		suffixRe, _ := globToRegexp(suffix)
+		timeGroup = n + 1
+		re, err = regexp.Compile("^" + prefixRe + "(" + layoutToRegexp(goFmt) + ")" + suffixRe + "$")
+	}
+	if err != nil {
+		loglib.Error("convert log path " + pattern + " to regexp error: " + err.Error())
+		return paths
+	}
+	globPattern := pattern
+	if goFmt != "" {
+		globPattern = prefix + "*" + suffix
+	}
+	matches, err := filepath.Glob(globPattern)
+	if err != nil {
+		loglib.Error("glob " + globPattern + " error: " + err.Error())
+		return paths
+	}
+	for _, m := range matches {
+		loc := re.FindStringSubmatchIndex(m)
+		if loc == nil {
+			continue
+		}
+		//通配符匹配到的部分，作为日志流的名字
+		parts := make([]string, 0)
+		path := m
+		for i := 1; i < len(loc)/2; i++ {
+			if i == timeGroup {
+				path = m[:loc[2*i]] + fmtPart + m[loc[2*i+1]:]
+				continue
+			}
+			parts = append(parts, m[loc[2*i]:loc[2*i+1]])
+		}
+		name := strings.Join(parts, "_")
+		name = strings.Trim(strings.Replace(name, "/", "_", -1), "_.")
+		paths[path] = name
+	}
+	return paths
+}
+
+//filepath.Match的通配符转为正则，每个通配符作为一个分组，返回正则和分组数
+func globToRegexp(glob string) (string, int) {
+	n := 0
+	var buf bytes.Buffer
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			buf.WriteString("([^/]*)")
+			n++
+		case '?':
+			buf.WriteString("([^/])")
+			n++
+		case '[':
+			j := strings.IndexByte(glob[i:], ']')
+			if j < 0 {
+				buf.WriteString(regexp.QuoteMeta(glob[i:]))
+				i = len(glob)
+				break
+			}
+			buf.WriteString("(" + glob[i:i+j+1] + ")")
+			n++
+			i += j
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return buf.String(), n
+}
+
+//go的时间格式转为正则，数字位用\d匹配
+func layoutToRegexp(layout string) string {
+	var buf bytes.Buffer
+	for _, c := range layout {
+		if c >= '0' && c <= '9' {
+			buf.WriteString(`\d`)
+		} else {
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		n     int
+		match []string
+		miss  []string
+	}{
+		{"/data/*/access.log", 1, []string{"/data/app1/access.log", "/data//access.log"}, []string{"/data/a/b/access.log", "/data/app1/access.logx"}},
+		{"/data/app?.log", 1, []string{"/data/app1.log"}, []string{"/data/app.log", "/data/app12.log", "/data/app/.log"}},
+		{"/data/[ab]*.log", 2, []string{"/data/a1.log", "/data/b.log"}, []string{"/data/c.log"}},
+		{`/data/a\*.log`, 0, []string{"/data/a*.log"}, []string{"/data/ab.log"}},
+		{"/data/a.b(c)+.log", 0, []string{"/data/a.b(c)+.log"}, []string{"/data/aXb(c)+.log"}},
+		{"/data/[ab.log", 0, []string{"/data/[ab.log"}, []string{"/data/a.log"}},
+	}
+	for _, tt := range tests {
+		s, n := globToRegexp(tt.glob)
+		if n != tt.n {
+			t.Errorf("%s: %d groups, want %d", tt.glob, n, tt.n)
+		}
+		re, err := regexp.Compile("^" + s + "$")
+		if err != nil {
+			t.Errorf("%s: %v", tt.glob, err)
+			continue
+		}
+		for _, m := range tt.match {
+			if !re.MatchString(m) {
+				t.Errorf("%s: should match %s", tt.glob, m)
+			}
+		}
+		for _, m := range tt.miss {
+			if re.MatchString(m) {
+				t.Errorf("%s: should not match %s", tt.glob, m)
+			}
+		}
+	}
+}
+
+func TestExpandLogPath(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"app1/access.log.2026101715",
+		"app1/access.log.2026101716",
+		"app2/access.log.2026101715",
+		"app2/access.log.bak",
+		"web/a/access.log.2026101715",
+		"app3/error.log",
+		"single.log",
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, f)
+		os.MkdirAll(filepath.Dir(p), 0775)
+		if err := ioutil.WriteFile(p, nil, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		pattern string
+		want    map[string]string
+	}{
+		{dir + "/*/access.log.<%Y%m%d%H>", map[string]string{
+			dir + "/app1/access.log.<%Y%m%d%H>": "app1",
+			dir + "/app2/access.log.<%Y%m%d%H>": "app2",
+		}},
+		{dir + "/*/*/access.log.<%Y%m%d%H>", map[string]string{
+			dir + "/web/a/access.log.<%Y%m%d%H>": "web_a",
+		}},
+		{dir + "/app?/*.log", map[string]string{
+			dir + "/app3/error.log": "3_error",
+		}},
+		{dir + "/single.log", map[string]string{
+			dir + "/single.log": "",
+		}},
+		{dir + "/none/*.log", map[string]string{}},
+	}
+	for _, tt := range tests {
+		got := expandLogPath(tt.pattern)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
@@ -1,42 +1,62 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
+	"follower"
 	"lib"
 	"loglib"
 )
 
 var logFileKey = "log_file" //配置文件中的key名
 var recordFileKey = "record_file"
+var startPositionKey = "start_position" //没有断点记录时从哪开始：end（默认）、beginning、line:N、time:时间
 var recordFile = "line.rec"
 var changeStr = "logfile changed"
+var flushStr = "logfile flush" //不满listBufferSize也打包，但周期没有结束
 
 type Tailler struct {
 	logPath    string    //日志路径（带时间格式）
 	nLT        []int     //logPath中时间格式前后的字符数
 	currFile   string    //当前tail的文件
-	fileHour   time.Time //当前日志文件名上的小时
-	hourStrFmt string
-	lineNum    int    //记录已扫过的行数
-	goFmt      string //时间格式
+	fileTime   time.Time //当前日志文件名上的时间，即所在周期的开始时间
+	period     lib.Period
+	rotateWait time.Duration //到达下一周期后，等待新日志文件的最长时间
+	lineNum    int           //记录已扫过的行数
+	offset     int64         //开始tail的字节偏移，小于0表示从文件末尾开始
+	record     *Checkpoint   //启动时读到的断点记录
+	acker      *ackTracker   //包被确认后才保存断点，为nil时直接保存
+	fp         string        //当前文件的指纹，文件头部不满fingerprintSize字节时需要重新计算
+	fpLen      int
+	fpIno      uint64            //指纹对应的inode
+	ml         *multiline        //多行合并，未配置line_pattern时为nil
+	cs         *charsetConverter //转为utf-8，未配置charset时为nil
+	ct         *containerLog     //去掉容器日志的封装，未配置container时为nil
+	catchup    bool              //正在追之前周期的日志，按catchup_rate限速
+	goFmt      string            //时间格式
 	recordPath string
 	config     map[string]string
-	//receiver的buffer size，每tail这么多行就记录，不够就不记录，
-	//简化重启后包的id设置逻辑，这样只有最后一个包可能少于buffer size
+	//receiver的buffer size，每tail这么多行就登记一个断点，不够就不记录，
+	//这样只有最后一个包和提前打包的包可能少于buffer size
 	recvBufSize int
-	wq          *lib.WaitQuit
+	packId      int //下一个包的id，和receiver按同样的行数分包，记录在断点中，重启后接着用
+	packLines   int //还没打包的行数
+	//不满一个包的日志最多等待多久，到时让receiver提前打包，包的id仍然连续；为0时只在退出时提前打包
+	flushInterval time.Duration
+	pendingSince  time.Time //还没打包的第一行的发送时间，为0表示没有
+	sentOffset    int64     //最后发出的一条日志的末尾偏移
+	quitCh        chan bool //关闭时tail退出，由所属的TailSource控制
+	untilGone     bool      //通配符匹配到的日志，文件消失后发出最后一个周期的结束包就结束
+	ended         chan bool //Tailling结束时关闭
+	wq            *lib.WaitQuit
 }
 
-func NewTailler(config map[string]string) *Tailler {
+func NewTailler(config map[string]string, quitCh chan bool) *Tailler {
 	val, ok := config[logFileKey]
 	if !ok || val == "" {
 		loglib.Error("config need log_file!")
@@ -45,78 +65,123 @@ func NewTailler(config map[string]string) *Tailler {
 	logPath := val
 	val, ok = config[recordFileKey]
 	if !ok || val == "" {
-		config[recordFileKey] = getRecordPath()
+		config[recordFileKey] = getRecordPath("")
 	}
-	lineNum, fname := getLineRecord(config[recordFileKey])
+	//没有记录则按start_position开始读，默认从最后开始
+	lineNum, offset, fname := -1, int64(-1), ""
+	cp := loadCheckpoint(config[recordFileKey])
 	goFmt, nLT := extractTimeFmt(logPath)
-	if goFmt == "" {
-		loglib.Error("log path has no time format!")
-		os.Exit(1)
+	if cp != nil {
+		fname = cp.File
+		if goFmt == "" {
+			//固定路径的文件是否被改名或截断在tailFixed中检查
+			offset, lineNum = cp.Offset, cp.Line
+			if cp.Hour == "" {
+				lineNum = 0
+				cp.NextId = 1
+			}
+		} else if cp.Version >= checkpointVersion {
+			offset, lineNum = cp.resume()
+		} else {
+			lineNum = cp.Line
+		}
+	}
+	//路径中没有时间格式时，日志由logrotate等改名或截断，默认按小时生成周期的key
+	period := lib.Hourly
+	if goFmt != "" {
+		period = lib.PeriodOfLayout(goFmt)
+	}
+	if val, ok = config["rotate_period"]; ok && val != "" {
+		p, err := lib.ParsePeriod(val)
+		if err != nil {
+			loglib.Error("wrong rotate_period " + val + ", use " + period.String())
+		} else {
+			period = p
+		}
+	}
+	//默认10分钟，但不超过一个周期
+	rotateWait := 10 * time.Minute
+	if n, err := strconv.Atoi(config["rotate_wait"]); err == nil && n > 0 {
+		rotateWait = time.Duration(n) * time.Second
+	}
+	if rotateWait > period.Duration {
+		rotateWait = period.Duration
 	}
 	wq := lib.NewWaitQuit("tailler")
 	bufSize, _ := strconv.Atoi(config["recv_buffer_size"])
-
-	return &Tailler{logPath: logPath, nLT: nLT, currFile: fname, hourStrFmt: "2006010215", lineNum: lineNum, goFmt: goFmt, recordPath: config[recordFileKey], config: config, recvBufSize: bufSize, wq: wq}
-}
-
-func getRecordPath() string {
-	d, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-	d = filepath.Join(d, "var")
-	if _, err := os.Stat(d); err != nil && os.IsNotExist(err) {
-		os.MkdirAll(d, 0775)
+	flushInterval := time.Duration(atoiDefault(config["flush_interval"], 0)) * time.Second
+
+	t := &Tailler{logPath: logPath, nLT: nLT, currFile: fname, period: period, rotateWait: rotateWait, lineNum: lineNum, offset: offset, record: cp, ml: newMultiline(config), cs: newCharsetConverter(config), ct: newContainerLog(config), goFmt: goFmt, recordPath: config[recordFileKey], config: config, recvBufSize: bufSize, packId: 1, flushInterval: flushInterval, quitCh: quitCh, ended: make(chan bool), wq: wq}
+	if cp == nil {
+		t.seekStart(config[startPositionKey])
+		if t.lineNum > 0 && bufSize > 0 {
+			//从文件中间开始时id按行数算，和从头tail时一致
+			t.packId = t.lineNum/bufSize + 1
+		}
+	} else {
+		t.packId = cp.nextId(bufSize)
 	}
-	return d + "/" + recordFile
+	return t
 }
 
-/*
-* 行数为非负值表示已tail的行数
-* 行数为负值则都将从文件末尾开始
-* 自动保存的行数只可能是bufSize的倍数或者文件总行数
- */
-func getLineRecord(path string) (line int, fname string) {
-	fin, err := os.Open(path)
-	if err != nil {
-		_, f, l, _ := runtime.Caller(0)
-		loglib.Error(fmt.Sprintf("%s:%d open line record `%s` error\n", f, l, path))
-		return -1, "" //从最后开始读
-	}
-	var txt string
-	var lineStr = ""
-	//只读第一行
-	scanner := bufio.NewScanner(fin)
-	for scanner.Scan() {
-		txt = strings.Trim(scanner.Text(), " ")
-		break
-	}
-	fin.Close()
-	parts := strings.Split(txt, " ")
-	if len(parts) == 2 {
-		fname = parts[0]
-		lineStr = parts[1]
-	} else {
-		lineStr = parts[0]
+//没有断点记录时，按start_position设置开始的文件、偏移和行数
+func (this *Tailler) seekStart(pos string) {
+	mode, arg := pos, ""
+	if i := strings.Index(pos, ":"); i > 0 {
+		mode, arg = pos[:i], strings.TrimSpace(pos[i+1:])
 	}
-	line, err = strconv.Atoi(lineStr)
-	if err != nil {
-		loglib.Error("convert line record error:" + err.Error())
-		line = -1
+	fname := this.logPath
+	if this.goFmt != "" {
+		fname = this.getLogFileByTime(time.Now())
 	}
-	return line, fname
+	switch strings.TrimSpace(mode) {
+	case "", "end":
+		return
+	case "beginning":
+		this.lineNum, this.offset = 0, 0
+		return
+	case "line":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			break
+		}
+		this.currFile = fname
+		this.lineNum, this.offset = n, offsetOfLine(fname, n)
+		loglib.Info(fmt.Sprintf("start from line %d of %s, offset %d", n, fname, this.offset))
+		return
+	case "time":
+		tm, err := parseStartTime(arg)
+		if err != nil {
+			break
+		}
+		if this.goFmt != "" {
+			//从这个时间所在周期的文件开始，之后的周期依次tail
+			fname = this.getLogFileByTime(this.period.Truncate(tm))
+		}
+		this.currFile = fname
+		this.offset, this.lineNum, err = newTimeParser(this.config).seek(fname, tm)
+		if err != nil {
+			//文件不存在等，从头开始
+			loglib.Warning("seek " + fname + " to time " + arg + " error: " + err.Error())
+			this.lineNum, this.offset = 0, 0
+		}
+		loglib.Info(fmt.Sprintf("start from time %s of %s, line %d, offset %d", tm.Format(defaultTimeLayout), fname, this.lineNum, this.offset))
+		return
+	}
+	loglib.Error("wrong start_position " + pos + ", start from the end")
 }
 
-func saveLineRecord(path string, fname string, lineNum int) {
-	fout, err := os.Create(path)
-	defer fout.Close()
-	if err != nil {
-		loglib.Error("save line record error: " + err.Error())
-		return
+//name为日志源的名字，默认的[tail]为空
+func getRecordPath(name string) string {
+	d, _ := filepath.Abs(filepath.Dir(os.Args[0]))
+	d = filepath.Join(d, "var")
+	if _, err := os.Stat(d); err != nil && os.IsNotExist(err) {
+		os.MkdirAll(d, 0775)
 	}
-	_, err = fmt.Fprintf(fout, "%s %d", fname, lineNum)
-	if err != nil {
-		loglib.Error("Write line record error" + err.Error())
-		return
+	if name != "" {
+		return d + "/line." + name + ".rec"
 	}
-	loglib.Info("save line record success!")
+	return d + "/" + recordFile
 }
 
 //从带时间格式的路径中分离出时间格式，并转为go的格式
@@ -148,7 +213,7 @@ func transFmt(unixFmt string) string {
 	if unixFmt == "" {
 		return ""
 	}
-	var timeFmtMap = map[string]string{"%Y": "2006", "%m": "01", "%d": "02", "%H": "15"}
+	var timeFmtMap = map[string]string{"%Y": "2006", "%m": "01", "%d": "02", "%H": "15", "%M": "04"}
 	fmt := unixFmt
 	for k, v := range timeFmtMap {
 		fmt = strings.Replace(fmt, k, v, -1)
@@ -175,256 +240,450 @@ func (this *Tailler) getTimeFromLogName(name string) (time.Time, error) {
 
 //根据时间得到日志文件
 func (this *Tailler) getLogFileByTime(tm time.Time) string {
-	size := len(this.logPath)
-	prefix := this.logPath[0:this.nLT[0]]
-	suffix := this.logPath[size-this.nLT[1]:]
-	return prefix + tm.Format(this.goFmt) + suffix
+	return logFileByTime(this.logPath, this.nLT, this.goFmt, tm)
+}
+
+func logFileByTime(logPath string, nLT []int, goFmt string, tm time.Time) string {
+	size := len(logPath)
+	prefix := logPath[0:nLT[0]]
+	suffix := logPath[size-nLT[1]:]
+	return prefix + tm.Format(goFmt) + suffix
 }
 
 func (this *Tailler) Tailling(receiveChan chan map[string]string) {
+	if this.cs != nil {
+		defer func() {
+			loglib.Info(this.cs.String())
+			this.cs.Close()
+		}()
+	}
+	if this.ct != nil {
+		defer func() {
+			loglib.Info(this.logPath + " " + this.ct.String())
+		}()
+	}
+	if this.goFmt == "" {
+		this.tailFixed(receiveChan)
+		close(receiveChan)
+		close(this.ended)
+		this.wq.AllDone()
+		return
+	}
 	if this.currFile == "" {
 		//兼容老格式，老格式无文件路径
 		this.currFile = this.getLogFileByTime(time.Now())
 	}
 	var err error
-	this.fileHour, err = this.getTimeFromLogName(this.currFile)
+	this.fileTime, err = this.getTimeFromLogName(this.currFile)
 	if err != nil {
 		loglib.Error("can't get time from current log file:" + this.currFile + "error:" + err.Error())
 		os.Exit(1)
 	}
-	isQuit := false
-	for time.Since(this.fileHour).Hours() >= 1 {
-		//说明重启时已经跟记录行号时不属于同一个小时了
-		isQuit = this.taillingPrevious(this.currFile, this.lineNum, this.fileHour.Format(this.hourStrFmt), receiveChan)
-		if isQuit {
+	if this.lineNum >= 0 && this.offset < 0 {
+		//老格式的记录只有行数，换算成偏移
+		this.offset = offsetOfLine(this.currFile, this.lineNum)
+		loglib.Info(fmt.Sprintf("migrate line record %s %d to offset %d", this.currFile, this.lineNum, this.offset))
+	}
+
+	quit := false
+	this.fileTime = this.period.Truncate(this.fileTime)
+	for !time.Now().Before(this.period.Next(this.fileTime)) {
+		//说明重启时已经跟记录行号时不属于同一个周期了
+		quit = this.tailFile(receiveChan, false)
+		if quit {
 			break
 		}
-		//继续下一个小时
-		this.fileHour = this.fileHour.Add(time.Hour)
-		this.currFile = this.getLogFileByTime(this.fileHour)
-		this.lineNum = 0
+		//继续下一个周期
+		this.nextFile()
 	}
-	if !isQuit {
-		//处理当前这个小时
-		this.taillingCurrent(receiveChan)
+	//处理当前这个周期，之后按周期往后滚动
+	for !quit {
+		quit = this.tailFile(receiveChan, true)
+		if quit {
+			break
+		}
+		if this.untilGone && !lib.FileExists(this.currFile) && !lib.FileExists(this.getLogFileByTime(this.period.Next(this.fileTime))) {
+			//日志不再产生，这个周期的结束包已经发出
+			loglib.Info(this.logPath + " is gone, stop tailing")
+			break
+		}
+		this.nextFile()
 	}
 	close(receiveChan)
+	close(this.ended)
 	this.wq.AllDone()
 }
 
-func (this *Tailler) taillingPrevious(filePath string, lineNum int, hourStr string, receiveChan chan map[string]string) bool {
-	var n_lines = ""
-	if lineNum >= 0 {
-		n_lines = fmt.Sprintf("+%d", lineNum+1) //略过已经tail过的行
-	} else {
-		n_lines = "0" //从最后开始
+func (this *Tailler) nextFile() {
+	this.fileTime = this.period.Next(this.fileTime)
+	this.currFile = this.getLogFileByTime(this.fileTime)
+	this.lineNum = 0
+	this.offset = 0
+	this.packId = 1
+	this.packLines = 0
+}
+
+//tail一个文件，返回true表示收到退出信号
+//current为false时读到文件末尾即结束，否则一直跟踪到下一个周期的文件出现
+func (this *Tailler) tailFile(receiveChan chan map[string]string, current bool) bool {
+	filePath := this.currFile
+	hourStr := this.period.Key(this.fileTime)
+	offset := this.startOffset(filePath)
+	var fl *follower.Follower
+	this.catchup = !current
+	if !current && !lib.FileExists(filePath) {
+		fl = this.openArchive(filePath, offset)
+	}
+	if fl == nil {
+		fl = follower.New(filePath, offset, this.quitCh)
 	}
+	defer this.finishFollow(fl)
 
-	loglib.Info("begin previous log: " + filePath + " from line: " + n_lines)
-	var quit = false
-	//收尾工作
-	defer func() {
-		if err := recover(); err != nil {
-			loglib.Error(fmt.Sprintf("tailler panic:%v", err))
-		}
+	loglib.Info(fmt.Sprintf("begin log: %s from line: %d, offset: %d", filePath, this.lineNum, offset))
 
-		//如果是quit，丢弃不完整的包
-		if quit {
-			lineNum -= lineNum % this.recvBufSize
+	nextTime := this.period.Next(this.fileTime)
+	nextFile := this.getLogFileByTime(nextTime)
+	finishing := !current
+	for !this.isQuit() {
+		line, err := fl.ReadLine()
+		if err != nil {
+			if finishing {
+				//文件不会再写入，末尾的半行也要发出去
+				var ok bool
+				if line, ok = fl.Flush(); !ok {
+					this.flushLines(fl, receiveChan)
+					break
+				}
+			} else if lib.FileExists(nextFile) || time.Now().Sub(nextTime) > this.rotateWait {
+				//日志切割，把当前文件读完就结束
+				loglib.Info(fmt.Sprintf("log rotated! previous file: %s, tailed lines: %d", filePath, this.lineNum))
+				finishing = true
+				continue
+			} else {
+				this.wait(fl, receiveChan, nextTime.Add(this.rotateWait).Sub(time.Now()))
+				continue
+			}
 		}
-		saveLineRecord(this.recordPath, filePath, lineNum)
-	}()
-
-	//启动时读取行号，以后都从首行开始
-	cmd := exec.Command("tail", "-n", n_lines, filePath)
-	stdout, err := cmd.StdoutPipe()
+		this.addLine(fl, receiveChan, line)
+	}
+	loglib.Info(fmt.Sprintf("%s tailed %d lines", filePath, this.lineNum))
+	if this.cs != nil {
+		loglib.Info(this.cs.String())
+	}
+	if this.isQuit() {
+		this.flushPack(fl, receiveChan)
+		return true
+	}
+	if err := fl.Err(); err != nil {
+		//归档没有完整读出来，不发送结束包，收集端不会把这个周期当成完整的
+		loglib.Error(fmt.Sprintf("%s not finished, no done pack: %s", filePath, err.Error()))
+		this.flushPack(fl, receiveChan)
+		return false
+	}
+	// 完整tail一个文件
+	this.pendingSince = time.Time{}
+	//断点中的NextId就是结束包的id，重启后重新发送的结束包id不变
+	this.expect(hourStr, this.packId, this.makeRecord(fl, fl.Offset(), this.lineNum))
+	m := map[string]string{"hour": hourStr, "line": changeStr}
+	if !fl.Opened() && this.lineNum == 0 {
+		//这个周期没有日志文件，也要发送结束包，以便收集端判断这个周期完整
+		//读过（包括重启前读过）之后被删除的文件不算，以免收集端把收到的日志当成没有
+		m["missing"] = "1"
+		loglib.Info(filePath + " not found, send an empty done pack")
+	}
+	receiveChan <- m
+	loglib.Info("finish tail " + filePath)
+	return false
+}
 
+//之前的周期的日志已经被压缩时读归档，偏移和行数按解压后的内容计算，与原文件一致，没有归档时返回nil
+func (this *Tailler) openArchive(filePath string, offset int64) *follower.Follower {
+	archive := findArchive(filePath, this.config)
+	if archive == "" {
+		return nil
+	}
+	rc, err := openArchive(archive, this.config)
 	if err != nil {
-		loglib.Error("open pipe error")
+		loglib.Error("open archive " + archive + " error: " + err.Error())
+		return nil
 	}
+	loglib.Info(fmt.Sprintf("%s not found, read archive %s", filePath, archive))
+	return follower.NewReader(filePath, rc, offset, fingerprintSize)
+}
 
-	//系统信号监听
-	go lib.HandleQuitSignal(func() {
-		quit = true
-		if cmd.Process != nil {
-			cmd.Process.Kill() //关闭tail命令，不然读取循环无法终止
+//tail路径中没有时间格式的日志，日志由logrotate改名(app.log -> app.log.1)或copytruncate切割
+//周期的key按系统时间生成，进入新周期时通知receiver上一个周期结束
+func (this *Tailler) tailFixed(receiveChan chan map[string]string) {
+	this.currFile = this.logPath
+	this.fileTime = this.period.Truncate(time.Now())
+	cp := this.record
+	if cp != nil && cp.Hour != "" {
+		if t, err := lib.ParsePeriodKey(cp.Hour); err == nil {
+			this.fileTime = t
+		}
+	}
+	if cp != nil && cp.Inode != 0 {
+		dev, ino, size, err := fileInode(this.logPath)
+		if err != nil || dev != cp.Dev || ino != cp.Inode {
+			//重启前tail的文件已被改名，先把改名后的文件读完
+			old := findByInode(filepath.Dir(this.logPath), cp.Dev, cp.Inode)
+			if old != "" {
+				loglib.Info(fmt.Sprintf("%s was renamed to %s, finish it from offset %d", this.logPath, old, this.offset))
+				if this.followFixed(receiveChan, old, true) {
+					return
+				}
+			} else {
+				loglib.Warning(fmt.Sprintf("%s replaced and the old file (inode %d) not found, tail from the beginning", this.logPath, cp.Inode))
+			}
+			this.offset = 0
+		} else if size < this.offset {
+			loglib.Warning(fmt.Sprintf("%s truncated, size %d < offset %d, tail from the beginning", this.logPath, size, this.offset))
+			this.offset = 0
+		} else if cp.FpLen > 0 && fileFingerprintN(this.logPath, cp.FpLen) != cp.Fingerprint {
+			//删除后新建的文件可能用到原来的inode
+			loglib.Warning(fmt.Sprintf("%s replaced with the same inode %d, fingerprint changed, tail from the beginning", this.logPath, ino))
+			this.offset = 0
 		}
-	})
+	}
+	this.followFixed(receiveChan, this.logPath, false)
+}
 
-	cmd.Start()
-	rd := bufio.NewReader(stdout)
-	for line, err := rd.ReadString('\n'); err == nil; line, err = rd.ReadString('\n') {
-		//fmt.Print(line)
-		if quit {
-			break
+//跟踪固定路径的文件，改名和截断由follower处理，返回true表示收到退出信号
+//finish为true时读到文件末尾即结束，用于读完已被改名的旧文件
+func (this *Tailler) followFixed(receiveChan chan map[string]string, filePath string, finish bool) bool {
+	offset := this.startOffset(filePath)
+	fl := follower.New(filePath, offset, this.quitCh)
+	defer this.finishFollow(fl)
+	//读完被改名的旧文件也算追之前的日志
+	this.catchup = finish
+
+	loglib.Info(fmt.Sprintf("begin log: %s from line: %d, offset: %d", filePath, this.lineNum, offset))
+	gone := false //读到了末尾，文件已经不在
+	for !this.isQuit() {
+		nextTime := this.period.Next(this.fileTime)
+		if !time.Now().Before(nextTime) {
+			this.rollover(fl, receiveChan)
+			//改名切割时文件可能暂时不在，周期结束时还不在才算消失
+			if gone && !lib.FileExists(filePath) {
+				loglib.Info(filePath + " is gone, stop tailing")
+				return false
+			}
+			gone = false
+			continue
 		}
-		lineNum++
-		m := map[string]string{"hour": hourStr, "line": line}
-		receiveChan <- m
-		if lineNum%this.recvBufSize == 0 {
-			saveLineRecord(this.recordPath, filePath, lineNum)
+		line, err := fl.ReadLine()
+		if err != nil {
+			gone = this.untilGone && !finish && !lib.FileExists(filePath)
+			if finish {
+				var ok bool
+				if line, ok = fl.Flush(); !ok {
+					this.flushLines(fl, receiveChan)
+					//断点不能指向旧文件之后的新文件，先把不满一个包的日志打包
+					this.flushPack(fl, receiveChan)
+					loglib.Info(fmt.Sprintf("finish tail %s, tailed lines: %d", filePath, this.lineNum))
+					return false
+				}
+			} else {
+				//空闲时也要按时进入下一个周期
+				this.wait(fl, receiveChan, nextTime.Sub(time.Now()))
+				continue
+			}
 		}
+		this.addLine(fl, receiveChan, line)
 	}
-	if err := cmd.Wait(); err != nil {
-		loglib.Info("wait sys tail error!" + err.Error())
+	this.flushPack(fl, receiveChan)
+	return true
+}
+
+//进入新的周期，上一个周期以changeStr结束，行数从0开始
+func (this *Tailler) rollover(fl *follower.Follower, receiveChan chan map[string]string) {
+	this.flushLines(fl, receiveChan)
+	hourStr := this.period.Key(this.fileTime)
+	loglib.Info(fmt.Sprintf("period %s of %s finished, tailed lines: %d", hourStr, this.logPath, this.lineNum))
+	if this.cs != nil {
+		loglib.Info(this.cs.String())
+	}
+	doneId := this.packId
+	this.fileTime = this.period.Truncate(time.Now())
+	this.lineNum = 0
+	this.packId = 1
+	this.packLines = 0
+	this.pendingSince = time.Time{}
+	//结束包确认后从新周期的开始继续
+	this.expect(hourStr, doneId, this.makeRecord(fl, fl.Offset(), this.lineNum))
+	m := map[string]string{"hour": hourStr, "line": changeStr}
+	receiveChan <- m
+}
+
+//开始tail的偏移，lineNum小于0表示没有记录，从文件末尾开始
+func (this *Tailler) startOffset(filePath string) int64 {
+	offset := this.offset
+	dev, ino, size, _ := fileInode(filePath)
+	if this.lineNum < 0 {
+		this.lineNum = 0
+		offset = size
 	}
-	loglib.Info(fmt.Sprintf("%s tailed %d lines", filePath, lineNum))
-	if !quit {
-		// 完整tail一个文件
-		m := map[string]string{"hour": hourStr, "line": changeStr}
-		receiveChan <- m
-		saveLineRecord(this.recordPath, filePath, lineNum)
+	this.offset = 0
+	if this.record == nil {
+		//没有断点记录时先记下开始的位置，避免还没有包被确认时重启，又从文件末尾开始
+		this.record = &Checkpoint{File: filePath, Dev: dev, Inode: ino, Offset: offset, Line: this.lineNum, NextId: this.packId, Hour: this.period.Key(this.fileTime)}
+		saveCheckpoint(this.recordPath, this.record)
 	}
-	return quit
+	return offset
+}
 
+//配置了多行合并时，合并成完整的一条日志再发送
+func (this *Tailler) addLine(fl *follower.Follower, receiveChan chan map[string]string, line string) {
+	throttleTail(this.catchup)
+	if this.ct != nil {
+		var ok bool
+		if line, ok = this.ct.decode(line, fl.Offset()-int64(len(line))); !ok {
+			return
+		}
+	}
+	if this.cs != nil {
+		line = this.cs.Convert(line)
+	}
+	if this.ml == nil {
+		this.sendLine(fl, receiveChan, line, fl.Offset())
+		return
+	}
+	if record, end, ok := this.ml.add(line, fl.Offset()); ok {
+		this.sendLine(fl, receiveChan, record, end)
+	}
 }
-func (this *Tailler) taillingCurrent(receiveChan chan map[string]string) {
-	var n_lines = ""
-	if this.lineNum >= 0 {
-		n_lines = fmt.Sprintf("+%d", this.lineNum+1) //略过已经tail过的行
-	} else {
-		n_lines = "0" //从最后开始
+
+//发出正在合并的日志，用于文件读完或周期结束
+func (this *Tailler) flushLines(fl *follower.Follower, receiveChan chan map[string]string) {
+	if this.ml == nil {
+		return
+	}
+	if record, end, ok := this.ml.flush(); ok {
+		this.sendLine(fl, receiveChan, record, end)
 	}
+}
 
-	var quit = false
-	//收尾工作
-	defer func() {
-		if err := recover(); err != nil {
-			loglib.Error(fmt.Sprintf("tailler panic:%v", err))
+//等待新数据，正在合并的日志超时后不再等后续的行，不满一个包的日志到时提前打包
+func (this *Tailler) wait(fl *follower.Follower, receiveChan chan map[string]string, d time.Duration) {
+	if this.ml != nil && this.ml.pending() {
+		left := this.ml.timeLeft()
+		if left <= 0 {
+			this.flushLines(fl, receiveChan)
+			return
 		}
-
-		//如果是quit，丢弃不完整的包
-		if quit {
-			this.lineNum -= this.lineNum % this.recvBufSize
+		if left < d {
+			d = left
 		}
-		saveLineRecord(this.recordPath, this.currFile, this.lineNum)
-
-		this.wq.AllDone()
-	}()
+	}
+	if this.flushInterval > 0 && !this.pendingSince.IsZero() {
+		left := this.pendingSince.Add(this.flushInterval).Sub(time.Now())
+		if left <= 0 {
+			this.flushPack(fl, receiveChan)
+			return
+		}
+		if left < d {
+			d = left
+		}
+	}
+	fl.Wait(d)
+}
 
-	//启动时读取行号，以后都从首行开始
-	cmd := exec.Command("tail", "-F", "-n", n_lines, this.currFile)
-	n_lines = "+1"
-	stdout, err := cmd.StdoutPipe()
+//让receiver把不满一个包的日志打包，周期没有结束
+func (this *Tailler) flushPack(fl *follower.Follower, receiveChan chan map[string]string) {
+	if this.pendingSince.IsZero() || this.packLines == 0 {
+		return
+	}
+	this.pendingSince = time.Time{}
+	hourStr := this.period.Key(this.fileTime)
+	id := this.nextPack()
+	//断点在最后发出的一条日志之后，正在合并的行重启后再读
+	this.expect(hourStr, id, this.makeRecord(fl, this.sentOffset, this.lineNum))
+	receiveChan <- map[string]string{"hour": hourStr, "line": flushStr}
+}
 
-	if err != nil {
-		loglib.Error("open pipe error")
+//end为这条日志的末尾偏移，断点只记录在整条日志之后
+func (this *Tailler) sendLine(fl *follower.Follower, receiveChan chan map[string]string, line string, end int64) {
+	this.lineNum++
+	this.packLines++
+	this.sentOffset = end
+	hourStr := this.period.Key(this.fileTime)
+	if this.packLines >= this.recvBufSize {
+		//凑满一个包，要在发出这一行之前登记，包可能很快就被确认
+		id := this.nextPack()
+		this.expect(hourStr, id, this.makeRecord(fl, end, this.lineNum))
+		this.pendingSince = time.Time{}
+	} else if this.pendingSince.IsZero() {
+		this.pendingSince = time.Now()
+	}
+	m := map[string]string{"hour": hourStr, "line": line}
+	if this.ct != nil {
+		this.ct.fillTags(m)
 	}
+	//排队的包太多时等sender发出去一些
+	queueBudget.Wait()
+	receiveChan <- m
+	if this.flushInterval > 0 && !this.pendingSince.IsZero() && time.Now().Sub(this.pendingSince) >= this.flushInterval {
+		//一直有新的行但凑不满一个包
+		this.flushPack(fl, receiveChan)
+	}
+}
 
-	//系统信号监听
-	go lib.HandleQuitSignal(func() {
-		quit = true
-		if cmd.Process != nil {
-			cmd.Process.Kill() //关闭tail命令，不然读取循环无法终止
-		}
-	})
-
-	//日志切割检测
-	go func() {
-		nextHour := this.fileHour.Add(time.Hour)
-		nextHourFile := this.getLogFileByTime(nextHour)
-		timeToWait := 10 * time.Minute //到达下一小时后，等待日志文件的最长时间，10分钟
-		for {
-			if quit {
-				break
-			}
-			if lib.FileExists(nextHourFile) || time.Now().Sub(nextHour) > timeToWait {
-				currFile := this.currFile
-				totalLines := this.GetTotalLines(currFile)
-				loglib.Info(fmt.Sprintf("log rotated! previous file: %s, total lines: %d", currFile, totalLines))
-
-				//在kill前进行文件切换，避免kill后新的tail启动时文件名还是旧的
-				this.fileHour = nextHour
-				this.currFile = nextHourFile
-				nextHour = nextHour.Add(time.Hour)
-				nextHourFile = this.getLogFileByTime(nextHour)
-
-				//发现日志切割，等待1分钟
-				i := 0
-				done := false
-				for {
-					if this.lineNum >= totalLines {
-						done = true
-					}
-					if done || i > 60 {
-						if cmd.Process != nil {
-							cmd.Process.Kill() //关闭tail命令，不然读取循环无法终止
-						}
-						if done {
-							loglib.Info("finish tail " + currFile)
-						} else {
-							loglib.Info("tail " + currFile + " timeout")
-						}
-						break
-					}
-					i++
-					time.Sleep(time.Second)
-				}
-			}
-			time.Sleep(time.Second)
-		}
+//当前的包打包，返回它的id，之后的断点记录下一个包的id
+func (this *Tailler) nextPack() int {
+	id := this.packId
+	this.packId++
+	this.packLines = 0
+	return id
+}
 
-	}()
-
-outer:
-	for {
-		currFile := this.currFile //缓存当前tail的文件名
-		hourStr := this.fileHour.Format(this.hourStrFmt)
-		cmd.Start()
-		loglib.Info("begin current log: " + currFile)
-		rd := bufio.NewReader(stdout)
-		for line, err := rd.ReadString('\n'); err == nil; line, err = rd.ReadString('\n') {
-			//fmt.Print(line)
-			if quit {
-				break outer
-			}
-			this.lineNum++
-			m := map[string]string{"hour": hourStr, "line": line}
-			receiveChan <- m
-			if this.lineNum%this.recvBufSize == 0 {
-				saveLineRecord(this.recordPath, currFile, this.lineNum)
-			}
-		}
-		if err := cmd.Wait(); err != nil {
-			loglib.Info("wait sys tail error!" + err.Error())
-		}
-		loglib.Info(fmt.Sprintf("%s tailed %d lines", currFile, this.lineNum))
-		if quit {
-			break
-		}
-		// 完整tail一个文件
-		m := map[string]string{"hour": hourStr, "line": changeStr}
-		receiveChan <- m
-		saveLineRecord(this.recordPath, currFile, this.lineNum)
-		//begin a new file
-		this.lineNum = 0
-		cmd = exec.Command("tail", "-F", "-n", n_lines, this.currFile)
-		stdout, err = cmd.StdoutPipe()
+//登记id为id的包确认后要保存的断点
+func (this *Tailler) expect(hour string, id int, cp *Checkpoint) {
+	if this.acker == nil {
+		saveCheckpoint(this.recordPath, cp)
+		return
+	}
+	this.acker.expect(hour, id, cp)
+}
 
-		if err != nil {
-			loglib.Error("open pipe error")
-			break
-		}
+//收尾工作，断点由ackTracker在包被确认后保存，quit时正在合并的日志丢弃，重启后再读
+func (this *Tailler) finishFollow(fl *follower.Follower) {
+	if err := recover(); err != nil {
+		loglib.Error(fmt.Sprintf("tailler panic:%v", err))
 	}
+	fl.Close()
+}
+
+func (this *Tailler) isQuit() bool {
+	select {
+	case <-this.quitCh:
+		return true
+	default:
+	}
+	return false
 }
 
 func (this *Tailler) Quit() bool {
 	return this.wq.Quit()
 }
 
-func (this *Tailler) GetLineNum() int {
-	return this.lineNum
+func (this *Tailler) GetPeriod() lib.Period {
+	return this.period
 }
 
-func (this *Tailler) GetTotalLines(fname string) int {
-	cmd := exec.Command("/bin/sh", "-c", `wc -l `+fname+` | awk '{print $1}'`)
-	out, err := cmd.Output()
-	if err == nil {
-		n, err := strconv.Atoi(strings.Trim(string(out), "\n"))
-		if err != nil {
-			loglib.Error("trans total lines " + string(out) + " error: " + err.Error())
-		}
-		return n
+//receiver第一个包的id
+func (this *Tailler) GetNextId() int {
+	return this.packId
+}
+
+//生成断点，文件头部的指纹在文件够长后就不再重复计算，容器日志的断点不越过没结束的长行
+func (this *Tailler) makeRecord(fl *follower.Follower, offset int64, line int) *Checkpoint {
+	if this.ct != nil {
+		offset = this.ct.safeOffset(offset)
+	}
+	dev, ino := fl.Inode()
+	if ino != this.fpIno || this.fpLen < fingerprintSize {
+		head := fl.Head(fingerprintSize)
+		this.fp, this.fpLen, this.fpIno = fingerprint(head), len(head), ino
 	}
-	return 0
+	return &Checkpoint{File: fl.Path(), Dev: dev, Inode: ino, Offset: offset, Line: line, NextId: this.packId, Fingerprint: this.fp, FpLen: this.fpLen, Hour: this.period.Key(this.fileTime)}
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//路径中没有时间格式的日志，重启时按断点记录找到改名后的旧文件或发现被截断
+func TestTailFixedRestart(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int64                           //断点在"a\nb\n"中的偏移
+		rotate func(t *testing.T, path string) //停止期间的切割
+		want   []string
+	}{
+		{"unchanged", 2, func(t *testing.T, path string) {}, []string{"b\n"}},
+		//旧文件改名后还有写入，读完再读新文件
+		{"renamed", 2, func(t *testing.T, path string) {
+			os.Rename(path, path+".1")
+			appendFile(t, path+".1", "c\n")
+			appendFile(t, path, "d\n")
+		}, []string{"b\n", "c\n", "d\n"}},
+		{"copytruncate", 4, func(t *testing.T, path string) {
+			os.Truncate(path, 0)
+			appendFile(t, path, "x\n")
+		}, []string{"x\n"}},
+		//旧文件已经删除，从新文件的开头读，新文件可能用到旧文件的inode
+		{"replaced", 2, func(t *testing.T, path string) {
+			os.Remove(path)
+			appendFile(t, path, "new1\nnew2\n")
+		}, []string{"new1\n", "new2\n"}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "app.log")
+		rec := filepath.Join(dir, "app.rec")
+		appendFile(t, path, "a\nb\n")
+		dev, ino, _, err := fileInode(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hour := time.Now().Format("2006010215")
+		saveCheckpoint(rec, &Checkpoint{File: path, Dev: dev, Inode: ino, Offset: tt.offset, Line: 1, NextId: 1, Hour: hour,
+			Fingerprint: fileFingerprintN(path, 4), FpLen: 4})
+		tt.rotate(t, path)
+
+		quitCh := make(chan bool)
+		tl := NewTailler(map[string]string{logFileKey: path, recordFileKey: rec, "recv_buffer_size": "100"}, quitCh)
+		ch := make(chan map[string]string, 100)
+		go tl.Tailling(ch)
+		got := make([]string, 0)
+		deadline := time.After(5 * time.Second)
+	wait:
+		for len(got) < len(tt.want) {
+			select {
+			case m := <-ch:
+				if m["line"] != flushStr && m["line"] != changeStr {
+					got = append(got, m["line"])
+				}
+			case <-deadline:
+				break wait
+			}
+		}
+		close(quitCh)
+		for m := range ch {
+			if m["line"] != flushStr && m["line"] != changeStr {
+				got = append(got, m["line"])
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func appendFile(t *testing.T, path string, s string) {
+	fout, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fout.Close()
+	if _, err := fout.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindByInode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(path, []byte("a\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	dev, ino, _, _ := fileInode(path)
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path, []byte("b\n"), 0664)
+	if got := findByInode(dir, dev, ino); got != path+".1" {
+		t.Errorf("got %q, want %q", got, path+".1")
+	}
+	os.Remove(path + ".1")
+	if got := findByInode(dir, dev, ino); got != "" {
+		t.Errorf("removed file found as %q", got)
+	}
+}
@@ -104,9 +104,10 @@ func (t *TcpReceiver) Quit() bool {
 	return t.wq.Quit()
 }
 
-//包是否出现过
-func (t *TcpReceiver) hasAppeared(buf *bytes.Buffer) (PackAppear, bool, string) {
+//包是否出现过，不同日志源的内容可能一样，所以源也算在内
+func (t *TcpReceiver) hasAppeared(buf *bytes.Buffer, source string) (PackAppear, bool, string) {
 	h := md5.New()
+	h.Write([]byte(source))
 	h.Write(buf.Bytes())
 	code := fmt.Sprintf("%x", h.Sum(nil))
 	t.mutex.RLock()
@@ -184,6 +185,7 @@ func (t *TcpReceiver) handleConnnection(conn net.Conn, wg *sync.WaitGroup) {
 
 	var routeInfo map[string]string
 	var rePull = false //是否补拉，如果是补拉就不做重复包检验
+	var source = ""
 
 	loglib.Info("incoming: " + inAddr)
 
@@ -219,6 +221,7 @@ outer:
 			} else {
 				rePull = false
 			}
+			source = route0["source"]
 
 			buf = append(buf, headerBuf...)
 			header, _, err := tcp_pack.ExtractHeader(buf)
@@ -268,7 +271,7 @@ outer:
 				loglib.Info(fmt.Sprintf("conn:%s, response to packid:%s", inAddr, packId))
 			}
 			//避免收到重复包（补拉例外）
-			appeared, ok, code := t.hasAppeared(content)
+			appeared, ok, code := t.hasAppeared(content, source)
 			if !ok || rePull {
 				ed := time.Now()
 				routeInfo["ed"] = ed.Format("2006-01-02 15:04:05.000")
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"lib"
+	"loglib"
+)
+
+/*
+* tail和发送的限速，整个agent共用，配置在[tail]中，0或不配置表示不限速
+*   tail_rate     跟踪当前周期的日志时每秒最多读的行数
+*   catchup_rate  追之前周期的日志时每秒最多读的行数，默认同tail_rate，一般配得比tail_rate小
+*   send_rate     sender每秒最多发送的字节数，所有sender共用
+* 读日志的限速按行数，发送的限速按字节数（压缩后的包），单位是固定的
+* 收到SIGHUP时重新读配置文件调整，不用重启，syslog等输入、pipe和repull也一样（只有send_rate和repull_rate）
+ */
+var liveLimiter = lib.NewRateLimiter(0)
+var catchupLimiter = lib.NewRateLimiter(0)
+var sendLimiter = lib.NewRateLimiter(0)
+
+//配置文件路径，用于重新加载
+var configFile string
+
+func setLimits(config map[string]string) {
+	live := atoiDefault(config["tail_rate"], 0)
+	catchup := atoiDefault(config["catchup_rate"], live)
+	liveLimiter.SetRate(live)
+	catchupLimiter.SetRate(catchup)
+	loglib.Info(fmt.Sprintf("rate limits: tail %d lines/s, catch-up %d lines/s", live, catchup))
+	setSendRate(config)
+}
+
+//没有tail的角色（syslog等输入、pipe、repull）只有发送的限速
+func setSendRate(config map[string]string) {
+	send := atoiDefault(config["send_rate"], 0)
+	sendLimiter.SetRate(send)
+	loglib.Info(fmt.Sprintf("rate limits: send %d bytes/s", send))
+}
+
+func atoiDefault(s string, def int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return def
+	}
+	return n
+}
+
+//goroutine，收到SIGHUP时重新读取配置文件，由apply从中取出各个角色的限速
+func reloadLimitsOnHup(apply func(cfg map[string]map[string]string)) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if !lib.FileExists(configFile) {
+			loglib.Error("reload config: " + configFile + " not found")
+			continue
+		}
+		loglib.Info("reload rate limits from " + configFile)
+		apply(lib.ReadConfig(configFile))
+	}
+}
+
+//读一行之前调用，catchup为true表示在追之前周期的日志
+func throttleTail(catchup bool) {
+	if catchup {
+		catchupLimiter.Wait(1)
+	} else {
+		liveLimiter.Wait(1)
+	}
+}
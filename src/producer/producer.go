@@ -0,0 +1,540 @@
+package producer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lib"
+	"tcp_pack"
+)
+
+/*
+* 应用直接把日志发给collector，不经过文件和tailer
+* 和tail端一样：日志按周期（默认小时）打包，包头带ip、hour、source、id、lines，周期结束时发送done包，
+* 包用zlib压缩，发给collector后等待ok应答，失败时换到备用地址
+* 配置了SpoolDir时，发送失败的包写到本地目录，之后按顺序重发，包的id和周期也保存在这个目录，重启后接着之前的
+* 没有配置SpoolDir时发送失败会一直重试，Write在排队的包太多时阻塞（不持有锁，Close会让等待的Write返回ErrClosed）
+* 没有配置SpoolDir时不保存id，同一个周期内重启后id又从1开始，collector会把这些包当成重复的丢掉，
+* 所以进程重启后要接着发同一个Source的日志时必须配置SpoolDir
+*
+*	p, err := producer.New(producer.Config{Addrs: []string{"collector1:1302", "collector2:1302"}, Source: "app"})
+*	p.Write(ctx, []byte("a log line"))
+*	p.Close()
+ */
+type Config struct {
+	Addrs         []string      //collector的地址，第一个之后的是备用地址
+	Source        string        //包头的source，同一台机器上的多个日志源各自有独立的id序列
+	Ip            string        //包头的ip，默认取本机的ip
+	Period        lib.Period    //日志的周期，默认小时
+	BatchLines    int           //多少条日志打一个包，默认2000
+	BatchBytes    int           //日志超过这么多字节也打包，默认1m
+	FlushInterval time.Duration //不满一个包的日志最多等待这么久，默认1秒
+	MaxPending    int           //最多排队的包数，默认100
+	SpoolDir      string        //本地缓存目录，为空时不缓存，也不保存id（见上面的说明）
+	Timeout       time.Duration //连接、发送和等待应答的超时，默认30秒
+	Logger        *log.Logger   //为nil时不打日志
+}
+
+type Producer struct {
+	cfg     Config
+	ip      string
+	start   time.Time //当前周期的开始
+	id      int       //下一个包的id
+	buf     bytes.Buffer
+	nLines  int
+	first   time.Time //包中第一条日志的时间
+	slots   chan bool //控制排队的包数，Flush的标记也占一个位置
+	queue   chan *packItem
+	conn    net.Conn
+	addrIdx int
+	failed  int64 //上次Flush之后没有发出去也没有缓存的包数
+	closed  bool
+	quitCh  chan bool
+	stats   Stats
+	mutex   *sync.Mutex
+	wg      sync.WaitGroup
+}
+
+type Stats struct {
+	Records int64 //Write的日志条数
+	Packs   int64 //打的包数
+	Sent    int64 //collector确认的包数
+	Spooled int64 //写到本地缓存的包数
+	Dropped int64 //丢弃的包数，只在Close时发不出去且没有缓存时发生
+}
+
+//pack为nil时是Flush的标记，之前的包都处理完后在done上返回结果
+type packItem struct {
+	pack []byte
+	id   string
+	done chan error
+}
+
+//之前的周期和下一个包的id，用于重启后接着发
+type producerState struct {
+	Hour string
+	Id   int
+}
+
+var ErrClosed = errors.New("producer closed")
+var errNoAddr = errors.New("no collector address")
+
+func New(cfg Config) (*Producer, error) {
+	if len(cfg.Addrs) == 0 {
+		return nil, errNoAddr
+	}
+	if cfg.Period.Duration == 0 {
+		cfg.Period = lib.Hourly
+	}
+	if cfg.BatchLines <= 0 {
+		cfg.BatchLines = 2000
+	}
+	if cfg.BatchBytes <= 0 {
+		cfg.BatchBytes = 1 << 20
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.MaxPending <= 0 {
+		cfg.MaxPending = 100
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	p := &Producer{
+		cfg:    cfg,
+		ip:     cfg.Ip,
+		start:  cfg.Period.Truncate(time.Now()),
+		id:     1,
+		slots:  make(chan bool, cfg.MaxPending),
+		queue:  make(chan *packItem, cfg.MaxPending),
+		quitCh: make(chan bool),
+		mutex:  &sync.Mutex{},
+	}
+	if p.ip == "" {
+		p.ip = lib.GetIp()
+	}
+	if cfg.SpoolDir == "" {
+		p.logf("no SpoolDir, pack ids restart from 1 if the process restarts within a period")
+	} else {
+		if err := os.MkdirAll(cfg.SpoolDir, 0775); err != nil {
+			return nil, err
+		}
+		if st := p.loadState(); st != nil {
+			if t, err := lib.ParsePeriodKey(st.Hour); err == nil && !t.After(p.start) {
+				//上次退出时的周期没有结束的话，之后由tick发送done包
+				p.start, p.id = t, st.Id
+			}
+		}
+	}
+	p.wg.Add(2)
+	go p.sendLoop()
+	go p.tickLoop()
+	return p, nil
+}
+
+//写一条日志，日志中的换行转为\n，排队的包太多时阻塞到ctx结束或者Close
+//返回错误时日志已经在缓冲中，之后和下一个包一起发送
+func (this *Producer) Write(ctx context.Context, record []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return ErrClosed
+	}
+	if err := this.rollover(ctx); err != nil {
+		return err
+	}
+	record = bytes.TrimRight(record, "\r\n")
+	if this.nLines == 0 {
+		this.first = time.Now()
+	}
+	this.buf.Write(bytes.Replace(record, []byte("\n"), []byte(`\n`), -1))
+	this.buf.WriteByte('\n')
+	this.nLines++
+	atomic.AddInt64(&this.stats.Records, 1)
+	if this.nLines >= this.cfg.BatchLines || this.buf.Len() >= this.cfg.BatchBytes {
+		return this.enqueue(ctx, false)
+	}
+	return nil
+}
+
+//把已经Write的日志都发出去（或写到本地缓存）后返回
+func (this *Producer) Flush(ctx context.Context) error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return ErrClosed
+	}
+	done, err := this.flush(ctx)
+	this.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//发送剩下的日志后退出，发不出去的包写到本地缓存，没有配置缓存时丢弃
+//周期没有结束，done包在下次启动后发送
+func (this *Producer) Close() error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return ErrClosed
+	}
+	this.closed = true
+	close(this.quitCh)
+	done, err := this.flush(context.Background())
+	close(this.queue)
+	this.mutex.Unlock()
+	if err == nil {
+		err = <-done
+	}
+	this.wg.Wait()
+	if this.conn != nil {
+		this.conn.Close()
+	}
+	return err
+}
+
+func (this *Producer) Stats() Stats {
+	return Stats{
+		Records: atomic.LoadInt64(&this.stats.Records),
+		Packs:   atomic.LoadInt64(&this.stats.Packs),
+		Sent:    atomic.LoadInt64(&this.stats.Sent),
+		Spooled: atomic.LoadInt64(&this.stats.Spooled),
+		Dropped: atomic.LoadInt64(&this.stats.Dropped),
+	}
+}
+
+//调用时持有mutex
+func (this *Producer) flush(ctx context.Context) (chan error, error) {
+	if this.nLines > 0 {
+		if err := this.enqueue(ctx, false); err != nil {
+			return nil, err
+		}
+	}
+	if err := this.reserve(ctx); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	this.queue <- &packItem{done: done}
+	return done, nil
+}
+
+//进入新的周期前，上一个周期以done包结束，调用时持有mutex
+func (this *Producer) rollover(ctx context.Context) error {
+	for this.start.Before(this.cfg.Period.Truncate(time.Now())) {
+		if err := this.enqueue(ctx, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//占一个队列中的位置，调用时持有mutex
+//没有空位时释放mutex等待（否则Close拿不到mutex，发不出去的包也不会被丢掉而空出位置），返回时重新持有mutex，
+//等待期间其他的Write、tick可能已经打包或者结束周期，调用方要重新检查；ctx已经结束时不等待
+func (this *Producer) reserve(ctx context.Context) error {
+	select {
+	case this.slots <- true:
+		return nil
+	default:
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	//Close自己打最后的包时不能被quitCh打断
+	closed := this.closed
+	quit := this.quitCh
+	if closed {
+		quit = nil
+	}
+	this.mutex.Unlock()
+	var err error
+	select {
+	case this.slots <- true:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-quit:
+		err = ErrClosed
+	}
+	this.mutex.Lock()
+	if err == nil && this.closed != closed {
+		//等待期间被Close，Close已经发走了缓冲的日志并关闭了队列
+		<-this.slots
+		err = ErrClosed
+	}
+	return err
+}
+
+//把当前的日志打包放到发送队列，done时结束当前周期，调用时持有mutex
+//先占到队列中的位置再分配id，ctx结束时不会留下id的空洞
+func (this *Producer) enqueue(ctx context.Context, done bool) error {
+	if err := this.reserve(ctx); err != nil {
+		return err
+	}
+	if done && !this.start.Before(this.cfg.Period.Truncate(time.Now())) || !done && this.nLines == 0 {
+		//等待期间已经被别人打包
+		<-this.slots
+		return nil
+	}
+	hour := this.cfg.Period.Key(this.start)
+	m := map[string]string{
+		"ip":    this.ip,
+		"hour":  hour,
+		"id":    strconv.Itoa(this.id),
+		"lines": strconv.Itoa(this.nLines),
+		"stage": "make pack",
+	}
+	if this.cfg.Source != "" {
+		m["source"] = this.cfg.Source
+	}
+	if this.cfg.Period != lib.Hourly {
+		m["period"] = strconv.Itoa(this.cfg.Period.Seconds())
+	}
+	st := this.first
+	if this.nLines == 0 {
+		st = time.Now()
+	}
+	ed := time.Now()
+	m["st"] = st.Format("2006-01-02 15:04:05.000")
+	m["ed"] = ed.Format("2006-01-02 15:04:05.000")
+	m["elapse"] = ed.Sub(st).String()
+	if done {
+		m["done"] = "1"
+		if this.nLines == 0 {
+			//空的done包内容都一样，设置repull以免被当成重复包
+			m["repull"] = "1"
+		}
+	}
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write(this.buf.Bytes())
+	w.Close()
+	pack := tcp_pack.Packing(b.Bytes(), m, false)
+	id := fmt.Sprintf("%s_%d", hour, this.id)
+
+	this.buf.Reset()
+	this.nLines = 0
+	this.id++
+	if done {
+		this.start = this.cfg.Period.Next(this.start)
+		this.id = 1
+	}
+	this.saveState()
+	atomic.AddInt64(&this.stats.Packs, 1)
+	this.queue <- &packItem{pack: pack, id: id}
+	return nil
+}
+
+//按时发送不满的包和done包
+//持有mutex时不能等待队列的空位（会卡住Write和Close），队列满时下一次再试
+func (this *Producer) tickLoop() {
+	defer this.wg.Done()
+	ticker := time.NewTicker(this.cfg.FlushInterval / 2)
+	defer ticker.Stop()
+	noWait, cancel := context.WithCancel(context.Background())
+	cancel()
+	for {
+		select {
+		case <-this.quitCh:
+			return
+		case <-ticker.C:
+		}
+		this.mutex.Lock()
+		if !this.closed {
+			err := this.rollover(noWait)
+			if err == nil && this.nLines > 0 && time.Now().Sub(this.first) >= this.cfg.FlushInterval {
+				err = this.enqueue(noWait, false)
+			}
+			if err != nil && err != context.Canceled {
+				this.logf("flush error: %s", err.Error())
+			}
+		}
+		this.mutex.Unlock()
+	}
+}
+
+//按顺序发送队列中的包，空闲时重发本地缓存的包
+func (this *Producer) sendLoop() {
+	defer this.wg.Done()
+	retry := time.NewTicker(2 * time.Second)
+	defer retry.Stop()
+	this.resendSpool()
+	for {
+		select {
+		case item, ok := <-this.queue:
+			if !ok {
+				return
+			}
+			if item.pack == nil {
+				var err error
+				if n := atomic.SwapInt64(&this.failed, 0); n > 0 {
+					err = fmt.Errorf("%d packs dropped", n)
+				}
+				item.done <- err
+				<-this.slots
+				continue
+			}
+			this.deliver(item)
+			<-this.slots
+		case <-retry.C:
+			this.resendSpool()
+		}
+	}
+}
+
+//发送失败时写到本地缓存，没有缓存时一直重试，Close后不再重试
+func (this *Producer) deliver(item *packItem) {
+	wait := time.Second
+	for {
+		err := this.send(item.pack)
+		if err == nil {
+			atomic.AddInt64(&this.stats.Sent, 1)
+			return
+		}
+		this.logf("send pack %s error: %s", item.id, err.Error())
+		if this.cfg.SpoolDir != "" {
+			if err = this.spool(item.pack); err == nil {
+				atomic.AddInt64(&this.stats.Spooled, 1)
+				return
+			}
+			this.logf("spool pack %s error: %s", item.id, err.Error())
+		}
+		select {
+		case <-this.quitCh:
+			atomic.AddInt64(&this.stats.Dropped, 1)
+			atomic.AddInt64(&this.failed, 1)
+			this.logf("drop pack %s", item.id)
+			return
+		case <-time.After(wait):
+		}
+		if wait < 30*time.Second {
+			wait *= 2
+		}
+	}
+}
+
+//依次尝试各个地址，collector应答ok才算成功
+func (this *Producer) send(pack []byte) error {
+	var err error
+	for i := 0; i < len(this.cfg.Addrs); i++ {
+		if this.conn == nil {
+			addr := this.cfg.Addrs[this.addrIdx]
+			if this.conn, err = net.DialTimeout("tcp", addr, this.cfg.Timeout); err != nil {
+				this.conn = nil
+				this.addrIdx = (this.addrIdx + 1) % len(this.cfg.Addrs)
+				continue
+			}
+		}
+		if err = this.sendConn(pack); err == nil {
+			return nil
+		}
+		this.conn.Close()
+		this.conn = nil
+		this.addrIdx = (this.addrIdx + 1) % len(this.cfg.Addrs)
+	}
+	return err
+}
+
+func (this *Producer) sendConn(pack []byte) error {
+	this.conn.SetDeadline(time.Now().Add(this.cfg.Timeout))
+	if _, err := this.conn.Write(pack); err != nil {
+		return err
+	}
+	reply := make([]byte, 128)
+	n, err := this.conn.Read(reply)
+	if err != nil {
+		return err
+	}
+	if string(reply[:n]) != "ok" {
+		return fmt.Errorf("collector replied %q", reply[:n])
+	}
+	return nil
+}
+
+func (this *Producer) spool(pack []byte) error {
+	fname := filepath.Join(this.cfg.SpoolDir, fmt.Sprintf("%d.pack", time.Now().UnixNano()))
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, pack, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+//按写入的顺序重发，遇到失败就等下次
+func (this *Producer) resendSpool() {
+	if this.cfg.SpoolDir == "" {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(this.cfg.SpoolDir, "*.pack"))
+	sort.Strings(files)
+	for _, fname := range files {
+		pack, err := ioutil.ReadFile(fname)
+		if err != nil {
+			continue
+		}
+		if err = this.send(pack); err != nil {
+			return
+		}
+		os.Remove(fname)
+		atomic.AddInt64(&this.stats.Sent, 1)
+		this.logf("resent spooled pack %s", tcp_pack.GetPackId(pack))
+	}
+}
+
+func (this *Producer) statePath() string {
+	name := "state"
+	if this.cfg.Source != "" {
+		name = "state." + this.cfg.Source
+	}
+	return filepath.Join(this.cfg.SpoolDir, name)
+}
+
+func (this *Producer) loadState() *producerState {
+	b, err := ioutil.ReadFile(this.statePath())
+	if err != nil {
+		return nil
+	}
+	var st producerState
+	if err = json.Unmarshal(b, &st); err != nil || st.Id <= 0 {
+		return nil
+	}
+	return &st
+}
+
+func (this *Producer) saveState() {
+	if this.cfg.SpoolDir == "" {
+		return
+	}
+	b, _ := json.Marshal(producerState{Hour: this.cfg.Period.Key(this.start), Id: this.id})
+	tmp := this.statePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err == nil {
+		os.Rename(tmp, this.statePath())
+	}
+}
+
+func (this *Producer) logf(format string, v ...interface{}) {
+	if this.cfg.Logger != nil {
+		this.cfg.Logger.Printf("[producer] "+format, v...)
+	}
+}
@@ -0,0 +1,327 @@
+package producer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tcp_pack"
+)
+
+type fakePack struct {
+	header map[string]string
+	lines  []string
+}
+
+//收包并应答ok，down时收到包后直接断开
+type fakeCollector struct {
+	ln    net.Listener
+	packs []fakePack
+	down  bool
+	mutex sync.Mutex
+}
+
+func newFakeCollector(t *testing.T) *fakeCollector {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeCollector{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go c.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return c
+}
+
+func (this *fakeCollector) addr() string {
+	return this.ln.Addr().String()
+}
+
+func (this *fakeCollector) setDown(down bool) {
+	this.mutex.Lock()
+	this.down = down
+	this.mutex.Unlock()
+}
+
+func (this *fakeCollector) received() []fakePack {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]fakePack{}, this.packs...)
+}
+
+func (this *fakeCollector) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := readPack(conn)
+		if err != nil {
+			return
+		}
+		this.mutex.Lock()
+		down := this.down
+		if !down {
+			this.packs = append(this.packs, p)
+		}
+		this.mutex.Unlock()
+		if down {
+			return
+		}
+		if _, err := conn.Write([]byte("ok")); err != nil {
+			return
+		}
+	}
+}
+
+func readPack(rd io.Reader) (fakePack, error) {
+	var p fakePack
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(rd, lenBuf); err != nil {
+		return p, err
+	}
+	l, _ := binary.Uvarint(lenBuf)
+	hb := make([]byte, l)
+	if _, err := io.ReadFull(rd, hb); err != nil {
+		return p, err
+	}
+	var header tcp_pack.PackHeader
+	if err := json.Unmarshal(hb, &header); err != nil {
+		return p, err
+	}
+	content := make([]byte, header.PackLen)
+	if _, err := io.ReadFull(rd, content); err != nil {
+		return p, err
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return p, err
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return p, err
+	}
+	p.header = header.Route[0]
+	if s := strings.TrimSuffix(string(b), "\n"); s != "" {
+		p.lines = strings.Split(s, "\n")
+	}
+	return p, nil
+}
+
+//已经关闭的端口，连接会被拒绝
+func deadAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func writeLines(t *testing.T, p *Producer, lines ...string) {
+	for _, l := range lines {
+		if err := p.Write(context.Background(), []byte(l)); err != nil {
+			t.Fatalf("write %q: %v", l, err)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestProducerBatching(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    Config
+		lines  []string
+		counts []string //各个包的lines
+		want   []string //collector收到的行
+	}{
+		{"by lines", Config{BatchLines: 3}, []string{"a", "b", "c", "d", "e", "f", "g"}, []string{"3", "3", "1"}, []string{"a", "b", "c", "d", "e", "f", "g"}},
+		{"by bytes", Config{BatchBytes: 8}, []string{"aaaa", "bbbb", "cc", "dd", "ee", "ff"}, []string{"2", "3", "1"}, []string{"aaaa", "bbbb", "cc", "dd", "ee", "ff"}},
+		{"newline escaped", Config{}, []string{"x\ny\n", "z"}, []string{"2"}, []string{`x\ny`, "z"}},
+	}
+	for _, tt := range tests {
+		c := newFakeCollector(t)
+		cfg := tt.cfg
+		cfg.Addrs = []string{c.addr()}
+		cfg.Source = "batch"
+		cfg.FlushInterval = time.Hour
+		p, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeLines(t, p, tt.lines...)
+		if err := p.Flush(context.Background()); err != nil {
+			t.Fatalf("%s: flush: %v", tt.name, err)
+		}
+		packs := c.received()
+		var all []string
+		if len(packs) != len(tt.counts) {
+			t.Errorf("%s: got %d packs, want %d", tt.name, len(packs), len(tt.counts))
+		}
+		for i, pk := range packs {
+			if i < len(tt.counts) && pk.header["lines"] != tt.counts[i] {
+				t.Errorf("%s: pack %d lines %s, want %s", tt.name, i, pk.header["lines"], tt.counts[i])
+			}
+			if pk.header["id"] != strconv.Itoa(i+1) || pk.header["source"] != "batch" {
+				t.Errorf("%s: pack %d header %v", tt.name, i, pk.header)
+			}
+			all = append(all, pk.lines...)
+		}
+		if !reflect.DeepEqual(all, tt.want) {
+			t.Errorf("%s: lines %q, want %q", tt.name, all, tt.want)
+		}
+		p.Close()
+	}
+}
+
+//第一个地址连不上时换到备用地址
+func TestProducerFailover(t *testing.T) {
+	c := newFakeCollector(t)
+	p, err := New(Config{Addrs: []string{deadAddr(t), c.addr()}, BatchLines: 2, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, p, "a", "b", "c")
+	if err := p.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if n := len(c.received()); n != 2 {
+		t.Errorf("collector got %d packs, want 2", n)
+	}
+	if st := p.Stats(); st.Sent != 2 || st.Records != 3 || st.Dropped != 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+//collector不可用时写到本地缓存，恢复后按顺序重发，重启后id接着之前的
+func TestProducerSpoolResend(t *testing.T) {
+	c := newFakeCollector(t)
+	c.setDown(true)
+	dir := t.TempDir()
+	cfg := Config{Addrs: []string{c.addr()}, Source: "spool", BatchLines: 1, SpoolDir: dir, Timeout: time.Second, FlushInterval: time.Hour}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, p, "a", "b")
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if st := p.Stats(); st.Spooled != 2 {
+		t.Fatalf("spooled %d, want 2", st.Spooled)
+	}
+	c.setDown(false)
+	waitFor(t, "spooled packs resent", func() bool { return len(c.received()) == 2 })
+	packs := c.received()
+	if packs[0].lines[0] != "a" || packs[1].lines[0] != "b" {
+		t.Errorf("resent out of order: %v", packs)
+	}
+	waitFor(t, "spool dir emptied", func() bool {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.pack"))
+		return len(files) == 0
+	})
+	if err := p.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	p, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, p, "c")
+	if err := p.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	packs = c.received()
+	if last := packs[len(packs)-1].header; last["id"] != "3" {
+		t.Errorf("after restart pack id %s, want 3", last["id"])
+	}
+}
+
+//没有缓存时collector不可用，Close要让等待队列空位的Write返回，而不是互相等待
+func TestProducerCloseWhileDown(t *testing.T) {
+	p, err := New(Config{Addrs: []string{deadAddr(t)}, BatchLines: 1, MaxPending: 1, Timeout: time.Second, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; err == nil && i < 10; i++ {
+			err = p.Write(context.Background(), []byte("line"))
+		}
+		errCh <- err
+	}()
+	//等Write阻塞在队列的空位上
+	time.Sleep(200 * time.Millisecond)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- p.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Error("close: want dropped packs error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked")
+	}
+	select {
+	case err := <-errCh:
+		if err != ErrClosed {
+			t.Errorf("blocked write returned %v, want ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write still blocked after Close")
+	}
+	if st := p.Stats(); st.Dropped == 0 || st.Sent != 0 {
+		t.Errorf("stats %+v", st)
+	}
+	if err := p.Write(context.Background(), []byte("x")); err != ErrClosed {
+		t.Errorf("write after close: %v", err)
+	}
+}
+
+//ctx结束时Write不再等待
+func TestProducerWriteCancel(t *testing.T) {
+	p, err := New(Config{Addrs: []string{deadAddr(t)}, BatchLines: 1, MaxPending: 1, Timeout: time.Second, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	var werr error
+	for i := 0; werr == nil && i < 10; i++ {
+		werr = p.Write(ctx, []byte("line"))
+	}
+	if werr != context.DeadlineExceeded {
+		t.Errorf("write got %v, want %v", werr, context.DeadlineExceeded)
+	}
+}
@@ -111,11 +111,19 @@ func GetPackId(data []byte) string {
 		if ok {
 			done = "_done"
 		}
-		packId = route["ip"] + "_" + hour + "_" + route["id"] + done
+		packId = StreamKey(route) + "_" + hour + "_" + route["id"] + done
 	}
 	return packId
 }
 
+//包所属的日志流，同一个ip上的多个日志源各自有独立的id序列
+func StreamKey(route map[string]string) string {
+	if source, ok := route["source"]; ok && source != "" {
+		return route["ip"] + "_" + source
+	}
+	return route["ip"]
+}
+
 func ParseHeader(vbytes []byte) map[string]string {
 	m := map[string]string{"ip": "", "hour": "", "done": "", "lines": "0"}
 	var header PackHeader